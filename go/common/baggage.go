@@ -0,0 +1,30 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+)
+
+// WithBaggage returns ctx with kvs added to its baggage, replacing members
+// with the same key and keeping the rest. Values are taken as-is and
+// percent-encoded by the propagator. Members with an invalid key or value
+// are skipped and reported in the returned error; the valid ones are
+// still added.
+func WithBaggage(ctx context.Context, kvs ...attribute.KeyValue) (context.Context, error) {
+	bag := baggage.FromContext(ctx)
+	var errs []error
+	for _, kv := range kvs {
+		member, err := baggage.NewMemberRaw(string(kv.Key), kv.Value.Emit())
+		if err == nil {
+			bag, err = bag.SetMember(member)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("baggage member %q: %w", kv.Key, err))
+		}
+	}
+	return baggage.ContextWithBaggage(ctx, bag), errors.Join(errs...)
+}
@@ -0,0 +1,49 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+func TestWithBaggageRoundTrip(t *testing.T) {
+	existing, _ := baggage.NewMemberRaw("session.id", "abc")
+	bag, _ := baggage.New(existing)
+	ctx := baggage.ContextWithBaggage(context.Background(), bag)
+
+	ctx, err := WithBaggage(ctx,
+		attribute.String("user.id", "user 42"),
+		attribute.Bool("synthetic", true),
+		attribute.String("", "no key"),
+		attribute.String("note", "\xff"),
+	)
+	if err == nil {
+		t.Error("WithBaggage accepted an empty key and a non-UTF-8 value")
+	}
+
+	header := http.Header{}
+	propagation.Baggage{}.Inject(ctx, propagation.HeaderCarrier(header))
+	got := baggage.FromContext(propagation.Baggage{}.Extract(context.Background(), propagation.HeaderCarrier(header)))
+
+	want := map[string]string{"session.id": "abc", "user.id": "user 42", "synthetic": "true"}
+	for key, value := range want {
+		if m := got.Member(key); m.Value() != value {
+			t.Errorf("member %s after round trip = %q, want %q (header %q)", key, m.Value(), value, header.Get("baggage"))
+		}
+	}
+	if got.Len() != len(want) {
+		t.Errorf("round trip carried %d members, want %d: %q", got.Len(), len(want), header.Get("baggage"))
+	}
+}
+
+func TestWithBaggageReplacesMember(t *testing.T) {
+	ctx, _ := WithBaggage(context.Background(), attribute.String("user.id", "first"))
+	ctx, _ = WithBaggage(ctx, attribute.String("user.id", "second"))
+	if got := baggage.FromContext(ctx).Member("user.id").Value(); got != "second" {
+		t.Errorf("user.id = %q, want second", got)
+	}
+}
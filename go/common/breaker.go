@@ -0,0 +1,201 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrCircuitOpen is returned by CircuitBreaker.Do without calling op while
+// the breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// BreakerState is reported as the circuit_breaker.state gauge value
+type BreakerState int64
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half_open"
+	default:
+		return "unknown"
+	}
+}
+
+// BreakerSettings controls when a CircuitBreaker trips. While closed, it
+// opens once at least MinRequests calls within Window have failed at
+// FailureRatio or worse. After Cooldown a single trial call is let through:
+// success closes the breaker, failure reopens it.
+type BreakerSettings struct {
+	FailureRatio float64
+	MinRequests  int
+	Window       time.Duration
+	Cooldown     time.Duration
+}
+
+// DefaultBreakerSettings trips on a 50% failure rate over at least 5 calls
+var DefaultBreakerSettings = BreakerSettings{
+	FailureRatio: 0.5,
+	MinRequests:  5,
+	Window:       30 * time.Second,
+	Cooldown:     10 * time.Second,
+}
+
+// CircuitBreaker fails calls fast while a dependency is unhealthy
+type CircuitBreaker struct {
+	name     string
+	settings BreakerSettings
+	// now is time.Now outside tests
+	now func() time.Time
+
+	mu          sync.Mutex
+	state       BreakerState
+	changedAt   time.Time
+	windowStart time.Time
+	requests    int
+	failures    int
+	trialActive bool
+	// generation counts state changes, so a call's outcome is only
+	// recorded against the state that let it through
+	generation uint64
+}
+
+// NewCircuitBreaker returns a closed breaker and registers its
+// circuit_breaker.state gauge on meter
+func NewCircuitBreaker(name string, meter metric.Meter, settings BreakerSettings) (*CircuitBreaker, error) {
+	return newCircuitBreaker(name, meter, settings, time.Now)
+}
+
+func newCircuitBreaker(name string, meter metric.Meter, settings BreakerSettings, now func() time.Time) (*CircuitBreaker, error) {
+	start := now()
+	b := &CircuitBreaker{name: name, settings: settings, now: now, changedAt: start, windowStart: start}
+
+	nameAttr := metric.WithAttributes(attribute.String("circuit_breaker.name", name))
+	_, err := meter.Int64ObservableGauge("circuit_breaker.state",
+		metric.WithDescription("Circuit breaker state: 0 closed, 1 open, 2 half-open"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			o.Observe(int64(b.State()), nameAttr)
+			return nil
+		}))
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// State returns the breaker's current state, moving an open breaker to
+// half-open once its cooldown has passed
+func (b *CircuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance()
+	return b.state
+}
+
+// Do runs op unless the breaker is open and records its outcome. State
+// changes are added as events to the span in ctx.
+func (b *CircuitBreaker) Do(ctx context.Context, op func() error) error {
+	generation, ok := b.allow()
+	if !ok {
+		return ErrCircuitOpen
+	}
+	err := op()
+	if from, to, changed := b.record(generation, err == nil); changed {
+		trace.SpanFromContext(ctx).AddEvent("circuit_breaker.state_change", trace.WithAttributes(
+			attribute.String("circuit_breaker.name", b.name),
+			attribute.String("circuit_breaker.from", from.String()),
+			attribute.String("circuit_breaker.to", to.String()),
+		))
+	}
+	return err
+}
+
+// allow reports whether a call may run, and the generation to record its
+// outcome against
+func (b *CircuitBreaker) allow() (uint64, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance()
+
+	switch b.state {
+	case BreakerOpen:
+		return 0, false
+	case BreakerHalfOpen:
+		if b.trialActive {
+			return 0, false
+		}
+		b.trialActive = true
+	}
+	return b.generation, true
+}
+
+// record counts a call's outcome. Calls let through before the last state
+// change are ignored, so a slow call from the closed state can't decide
+// the half-open trial.
+func (b *CircuitBreaker) record(generation uint64, success bool) (from, to BreakerState, changed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	from = b.state
+	if generation != b.generation {
+		return from, from, false
+	}
+
+	switch b.state {
+	case BreakerHalfOpen:
+		b.trialActive = false
+		if success {
+			b.setState(BreakerClosed)
+		} else {
+			b.setState(BreakerOpen)
+		}
+	case BreakerClosed:
+		b.requests++
+		if !success {
+			b.failures++
+		}
+		if b.requests >= b.settings.MinRequests &&
+			float64(b.failures)/float64(b.requests) >= b.settings.FailureRatio {
+			b.setState(BreakerOpen)
+		}
+	}
+	return from, b.state, from != b.state
+}
+
+// advance applies the time-based transitions; b.mu must be held
+func (b *CircuitBreaker) advance() {
+	now := b.now()
+	switch b.state {
+	case BreakerOpen:
+		if now.Sub(b.changedAt) >= b.settings.Cooldown {
+			b.setState(BreakerHalfOpen)
+		}
+	case BreakerClosed:
+		if now.Sub(b.windowStart) >= b.settings.Window {
+			b.windowStart, b.requests, b.failures = now, 0, 0
+		}
+	}
+}
+
+// setState switches state and resets the counts; b.mu must be held
+func (b *CircuitBreaker) setState(s BreakerState) {
+	b.state = s
+	b.generation++
+	b.changedAt = b.now()
+	b.windowStart = b.changedAt
+	b.requests, b.failures = 0, 0
+}
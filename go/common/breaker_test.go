@@ -0,0 +1,207 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/metric/noop"
+)
+
+// fakeClock is a breaker clock that only moves when told to
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+// breakerStep advances the clock by wait, then calls Do unless check is
+// set, and expects the breaker to end up in want
+type breakerStep struct {
+	wait     time.Duration
+	check    bool
+	fail     bool
+	rejected bool
+	want     BreakerState
+}
+
+var testBreakerSettings = BreakerSettings{
+	FailureRatio: 0.5,
+	MinRequests:  3,
+	Window:       time.Minute,
+	Cooldown:     10 * time.Second,
+}
+
+// tripSteps opens a breaker under testBreakerSettings
+var tripSteps = []breakerStep{
+	{fail: true, want: BreakerClosed},
+	{fail: true, want: BreakerClosed},
+	{fail: true, want: BreakerOpen},
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []breakerStep
+	}{
+		{
+			name: "closed to open after MinRequests failures",
+			steps: append(tripSteps,
+				breakerStep{rejected: true, want: BreakerOpen},
+			),
+		},
+		{
+			name: "stays closed below the failure ratio",
+			steps: []breakerStep{
+				{want: BreakerClosed},
+				{want: BreakerClosed},
+				{fail: true, want: BreakerClosed},
+				{want: BreakerClosed},
+			},
+		},
+		{
+			name: "window expiry forgets failures",
+			steps: []breakerStep{
+				{fail: true, want: BreakerClosed},
+				{fail: true, want: BreakerClosed},
+				{wait: time.Minute, fail: true, want: BreakerClosed},
+			},
+		},
+		{
+			name: "open to half-open after the cooldown",
+			steps: append(tripSteps,
+				breakerStep{wait: 9 * time.Second, check: true, want: BreakerOpen},
+				breakerStep{wait: time.Second, check: true, want: BreakerHalfOpen},
+			),
+		},
+		{
+			name: "half-open to closed on success",
+			steps: append(tripSteps,
+				breakerStep{wait: 10 * time.Second, want: BreakerClosed},
+				breakerStep{fail: true, want: BreakerClosed},
+			),
+		},
+		{
+			name: "half-open to open on failure",
+			steps: append(tripSteps,
+				breakerStep{wait: 10 * time.Second, fail: true, want: BreakerOpen},
+				breakerStep{wait: 9 * time.Second, rejected: true, want: BreakerOpen},
+				breakerStep{wait: time.Second, check: true, want: BreakerHalfOpen},
+			),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &fakeClock{t: time.Unix(0, 0)}
+			b, err := newCircuitBreaker("test", noop.NewMeterProvider().Meter("test"), testBreakerSettings, clock.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opErr := errors.New("dependency failed")
+
+			for i, step := range tt.steps {
+				clock.t = clock.t.Add(step.wait)
+				if !step.check {
+					called := false
+					err := b.Do(context.Background(), func() error {
+						called = true
+						if step.fail {
+							return opErr
+						}
+						return nil
+					})
+					if step.rejected {
+						if called || !errors.Is(err, ErrCircuitOpen) {
+							t.Fatalf("step %d: Do ran op (called=%v, err=%v), want ErrCircuitOpen", i, called, err)
+						}
+					} else if !called {
+						t.Fatalf("step %d: Do rejected the call with %v", i, err)
+					}
+				}
+				if got := b.State(); got != step.want {
+					t.Fatalf("step %d: state = %v, want %v", i, got, step.want)
+				}
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerHalfOpenAllowsOneTrial(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	b, err := newCircuitBreaker("test", noop.NewMeterProvider().Meter("test"), testBreakerSettings, clock.now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range testBreakerSettings.MinRequests {
+		b.Do(context.Background(), func() error { return errors.New("dependency failed") })
+	}
+	clock.t = clock.t.Add(testBreakerSettings.Cooldown)
+
+	// A second call while the trial is still running is rejected
+	err = b.Do(context.Background(), func() error {
+		if err := b.Do(context.Background(), func() error { return nil }); !errors.Is(err, ErrCircuitOpen) {
+			t.Errorf("concurrent call during trial: err = %v, want ErrCircuitOpen", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("trial call: %v", err)
+	}
+	if got := b.State(); got != BreakerClosed {
+		t.Errorf("state after successful trial = %v, want %v", got, BreakerClosed)
+	}
+}
+
+// A call let through while closed that only finishes once the breaker is
+// half-open must not decide the trial, or a second trial could start
+func TestCircuitBreakerStaleCallIgnored(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	b, err := newCircuitBreaker("test", noop.NewMeterProvider().Meter("test"), testBreakerSettings, clock.now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	staleStarted, releaseStale, staleDone := make(chan struct{}), make(chan struct{}), make(chan error)
+	go func() {
+		staleDone <- b.Do(context.Background(), func() error {
+			close(staleStarted)
+			<-releaseStale
+			return nil
+		})
+	}()
+	<-staleStarted
+
+	for range testBreakerSettings.MinRequests {
+		b.Do(context.Background(), func() error { return errors.New("dependency failed") })
+	}
+	clock.t = clock.t.Add(testBreakerSettings.Cooldown)
+
+	trialStarted, releaseTrial, trialDone := make(chan struct{}), make(chan struct{}), make(chan error)
+	go func() {
+		trialDone <- b.Do(context.Background(), func() error {
+			close(trialStarted)
+			<-releaseTrial
+			return nil
+		})
+	}()
+	<-trialStarted
+
+	close(releaseStale)
+	if err := <-staleDone; err != nil {
+		t.Fatalf("stale call: %v", err)
+	}
+	if got := b.State(); got != BreakerHalfOpen {
+		t.Errorf("state after the stale call finished = %v, want %v", got, BreakerHalfOpen)
+	}
+	if err := b.Do(context.Background(), func() error { return nil }); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("second call during the trial: err = %v, want ErrCircuitOpen", err)
+	}
+
+	close(releaseTrial)
+	if err := <-trialDone; err != nil {
+		t.Fatalf("trial call: %v", err)
+	}
+	if got := b.State(); got != BreakerClosed {
+		t.Errorf("state after successful trial = %v, want %v", got, BreakerClosed)
+	}
+}
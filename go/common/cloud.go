@@ -0,0 +1,182 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"otel-mock/config"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/contrib/detectors/gcp"
+	"go.opentelemetry.io/otel/attribute"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+)
+
+// cloudDetectTimeout bounds cloud detection as a whole; the detectors run
+// concurrently and any still waiting on a metadata server are abandoned
+const cloudDetectTimeout = 2 * time.Second
+
+// imdsAddr is the link-local instance metadata server on both EC2 and Azure
+const imdsAddr = "http://169.254.169.254"
+
+// metadataClient skips any configured proxy, which can't reach imdsAddr
+var metadataClient = &http.Client{Transport: &http.Transport{Proxy: nil}}
+
+// processCloudDetector is shared by every service in the process. The
+// metadata servers describe the host, not the service, so they're asked once
+// rather than each service waiting out cloudDetectTimeout again.
+var processCloudDetector = &cloudDetector{
+	detectors: []sdkresource.Detector{gcp.NewDetector(), ec2Detector{}, azureVMDetector{}},
+}
+
+// cloudDetectors returns the cloud detector when ENABLE_CLOUD_DETECTORS is on
+func cloudDetectors() []sdkresource.Detector {
+	if !config.EnableCloudDetectors {
+		return nil
+	}
+	return []sdkresource.Detector{processCloudDetector}
+}
+
+// cloudDetector merges whatever its detectors find, on the first Detect
+// call only; later calls return the same resource. Off their cloud the
+// detectors fail or time out, so errors are dropped rather than reported as
+// a partial resource.
+type cloudDetector struct {
+	detectors []sdkresource.Detector
+
+	once sync.Once
+	res  *sdkresource.Resource
+}
+
+func (d *cloudDetector) Detect(ctx context.Context) (*sdkresource.Resource, error) {
+	d.once.Do(func() { d.res = d.detect(ctx) })
+	return d.res, nil
+}
+
+func (d *cloudDetector) detect(ctx context.Context) *sdkresource.Resource {
+	ctx, cancel := context.WithTimeout(ctx, cloudDetectTimeout)
+	defer cancel()
+
+	results := make(chan *sdkresource.Resource, len(d.detectors))
+	for _, detector := range d.detectors {
+		go func() {
+			res, err := detector.Detect(ctx)
+			if err != nil {
+				res = nil
+			}
+			results <- res
+		}()
+	}
+
+	merged := sdkresource.Empty()
+	for range d.detectors {
+		select {
+		case res := <-results:
+			if res != nil {
+				if m, err := sdkresource.Merge(merged, res); err == nil {
+					merged = m
+				}
+			}
+		case <-ctx.Done():
+			return merged
+		}
+	}
+	return merged
+}
+
+// ec2Detector reads the EC2 instance identity document through IMDSv2
+type ec2Detector struct{}
+
+func (ec2Detector) Detect(ctx context.Context) (*sdkresource.Resource, error) {
+	tokenReq, err := http.NewRequestWithContext(ctx, http.MethodPut, imdsAddr+"/latest/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	tokenReq.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	var token []byte
+	if err := fetchMetadata(tokenReq, &token); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, imdsAddr+"/latest/dynamic/instance-identity/document", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", string(token))
+	var doc struct {
+		InstanceID       string `json:"instanceId"`
+		InstanceType     string `json:"instanceType"`
+		ImageID          string `json:"imageId"`
+		Region           string `json:"region"`
+		AvailabilityZone string `json:"availabilityZone"`
+		AccountID        string `json:"accountId"`
+	}
+	if err := fetchMetadata(req, &doc); err != nil {
+		return nil, err
+	}
+
+	return sdkresource.NewSchemaless(
+		semconv.CloudProviderAWS,
+		semconv.CloudPlatformAWSEC2,
+		semconv.CloudRegion(doc.Region),
+		semconv.CloudAvailabilityZone(doc.AvailabilityZone),
+		semconv.CloudAccountID(doc.AccountID),
+		semconv.HostID(doc.InstanceID),
+		semconv.HostType(doc.InstanceType),
+		semconv.HostImageID(doc.ImageID),
+	), nil
+}
+
+// azureVMDetector reads the compute section of the Azure instance metadata
+type azureVMDetector struct{}
+
+func (azureVMDetector) Detect(ctx context.Context) (*sdkresource.Resource, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, imdsAddr+"/metadata/instance/compute?api-version=2021-02-01&format=json", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata", "true")
+	var compute struct {
+		Location       string `json:"location"`
+		VMID           string `json:"vmId"`
+		VMSize         string `json:"vmSize"`
+		SubscriptionID string `json:"subscriptionId"`
+		ResourceID     string `json:"resourceId"`
+	}
+	if err := fetchMetadata(req, &compute); err != nil {
+		return nil, err
+	}
+
+	return sdkresource.NewSchemaless(
+		semconv.CloudProviderAzure,
+		semconv.CloudPlatformAzureVM,
+		semconv.CloudRegion(compute.Location),
+		semconv.CloudAccountID(compute.SubscriptionID),
+		semconv.CloudResourceID(compute.ResourceID),
+		semconv.HostID(compute.VMID),
+		semconv.HostType(compute.VMSize),
+		attribute.String("azure.vm.size", compute.VMSize),
+	), nil
+}
+
+// fetchMetadata sends req and decodes the body into out, which is either a
+// *[]byte for a raw value or a struct pointer for JSON
+func fetchMetadata(req *http.Request, out interface{}) error {
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s returned %d", req.Method, req.URL.Path, resp.StatusCode)
+	}
+	if raw, ok := out.(*[]byte); ok {
+		*raw, err = io.ReadAll(resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
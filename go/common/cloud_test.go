@@ -0,0 +1,42 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+)
+
+// countingDetector returns res, or err when set, and counts its calls
+type countingDetector struct {
+	calls atomic.Int32
+	res   *sdkresource.Resource
+	err   error
+}
+
+func (d *countingDetector) Detect(context.Context) (*sdkresource.Resource, error) {
+	d.calls.Add(1)
+	return d.res, d.err
+}
+
+func TestCloudDetectorDetectsOnce(t *testing.T) {
+	found := &countingDetector{res: sdkresource.NewSchemaless(semconv.CloudProviderAWS, semconv.CloudRegion("eu-west-1"))}
+	failing := &countingDetector{err: errors.New("no metadata server")}
+	d := &cloudDetector{detectors: []sdkresource.Detector{found, failing}}
+
+	for i := range 3 {
+		res, err := d.Detect(context.Background())
+		if err != nil {
+			t.Fatalf("Detect #%d: %v", i+1, err)
+		}
+		if v, ok := res.Set().Value(semconv.CloudRegionKey); !ok || v.AsString() != "eu-west-1" {
+			t.Errorf("Detect #%d: cloud.region = %q, want eu-west-1", i+1, v.AsString())
+		}
+	}
+	if found.calls.Load() != 1 || failing.calls.Load() != 1 {
+		t.Errorf("detectors called %d and %d times, want once each", found.calls.Load(), failing.calls.Load())
+	}
+}
@@ -0,0 +1,96 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"otel-mock/config"
+	"strconv"
+	"strings"
+
+	"go.yaml.in/yaml/v2"
+)
+
+// Config is the optional file passed with -config. It's YAML, which also
+// accepts JSON. Precedence is flag > env > file > default: Apply only fills in
+// settings whose environment variable is unset or empty, and -service
+// overrides the services section.
+type Config struct {
+	// Endpoint sets OTEL_EXPORTER_OTLP_ENDPOINT
+	Endpoint string `yaml:"endpoint"`
+	// Services enables or disables services for -service all; unlisted
+	// services run
+	Services map[string]bool `yaml:"services"`
+	// SamplingRatio sets OTEL_TRACES_SAMPLER_ARG, and the sampler to
+	// parentbased_traceidratio unless OTEL_TRACES_SAMPLER picks one
+	SamplingRatio *float64 `yaml:"sampling_ratio"`
+	// KafkaBroker sets KAFKA_ADDR (host:port, comma-separated)
+	KafkaBroker string `yaml:"kafka_broker"`
+}
+
+// LoadConfig reads and validates the config file at path
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+	var c Config
+	if err := yaml.UnmarshalStrict(data, &c); err != nil {
+		return nil, fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+	if r := c.SamplingRatio; r != nil && (*r < 0 || *r > 1) {
+		return nil, fmt.Errorf("config file %s: sampling_ratio %v is outside [0, 1]", path, *r)
+	}
+	return &c, nil
+}
+
+// Apply copies the file's settings into package config wherever the matching
+// environment variable isn't set. It must run before any telemetry is
+// initialized.
+func (c *Config) Apply() {
+	if c.Endpoint != "" && !envSet("OTEL_EXPORTER_OTLP_ENDPOINT") {
+		config.OTLPEndpoint = c.Endpoint
+		// Values derived from the shared endpoint follow it
+		if !envSet("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") {
+			config.OTLPTracesEndpoint = c.Endpoint
+		}
+		if !envSet("OTEL_EXPORTER_OTLP_METRICS_ENDPOINT") {
+			config.OTLPMetricsEndpoint = c.Endpoint
+		}
+		if !envSet("OTEL_EXPORTER_OTLP_LOGS_ENDPOINT") {
+			config.OTLPLogsEndpoint = c.Endpoint
+		}
+	}
+	if c.SamplingRatio != nil {
+		if !envSet("OTEL_TRACES_SAMPLER_ARG") {
+			config.TracesSamplerArg = strconv.FormatFloat(*c.SamplingRatio, 'f', -1, 64)
+		}
+		if !envSet("OTEL_TRACES_SAMPLER") {
+			config.TracesSampler = "parentbased_traceidratio"
+		}
+	}
+	if c.KafkaBroker != "" && !envSet("KAFKA_ADDR") {
+		var brokers []string
+		for _, b := range strings.Split(c.KafkaBroker, ",") {
+			if b = strings.TrimSpace(b); b != "" {
+				brokers = append(brokers, b)
+			}
+		}
+		config.KafkaBrokers = brokers
+	}
+}
+
+// ServiceEnabled reports whether name should run under -service all. A nil
+// Config enables everything.
+func (c *Config) ServiceEnabled(name string) bool {
+	if c == nil {
+		return true
+	}
+	enabled, ok := c.Services[name]
+	return !ok || enabled
+}
+
+// envSet matches how package config reads the environment: an empty
+// variable falls back to the default, so it mustn't block the file either
+func envSet(key string) bool {
+	return os.Getenv(key) != ""
+}
@@ -0,0 +1,155 @@
+package common
+
+import (
+	"otel-mock/config"
+	"testing"
+)
+
+// setConfig overrides a package config value for the length of the test
+func setConfig[T any](t *testing.T, v *T, value T) {
+	t.Helper()
+	old := *v
+	*v = value
+	t.Cleanup(func() { *v = old })
+}
+
+func TestConfigApplyPrecedence(t *testing.T) {
+	ratio := 0.25
+	tests := []struct {
+		name string
+		file Config
+		// env is set before Apply; package config is loaded from the
+		// environment at startup, so the matching values are set too
+		env          map[string]string
+		wantEndpoint string
+		wantTraces   string
+		wantMetrics  string
+		wantSampler  string
+		wantArg      string
+	}{
+		{
+			name:         "default without env or file",
+			wantEndpoint: "localhost:4317",
+			wantTraces:   "localhost:4317",
+			wantMetrics:  "localhost:4317",
+			wantSampler:  "parentbased_always_on",
+		},
+		{
+			name:         "file over default",
+			file:         Config{Endpoint: "https://collector:4317", SamplingRatio: &ratio},
+			wantEndpoint: "https://collector:4317",
+			wantTraces:   "https://collector:4317",
+			wantMetrics:  "https://collector:4317",
+			wantSampler:  "parentbased_traceidratio",
+			wantArg:      "0.25",
+		},
+		{
+			name: "env over file",
+			file: Config{Endpoint: "https://collector:4317", SamplingRatio: &ratio},
+			env: map[string]string{
+				"OTEL_EXPORTER_OTLP_ENDPOINT": "env-collector:4317",
+				"OTEL_TRACES_SAMPLER":         "always_on",
+			},
+			wantEndpoint: "env-collector:4317",
+			wantTraces:   "env-collector:4317",
+			wantMetrics:  "env-collector:4317",
+			wantSampler:  "always_on",
+			wantArg:      "0.25",
+		},
+		{
+			name: "per-signal env over file",
+			file: Config{Endpoint: "collector:4317"},
+			env: map[string]string{
+				"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT": "traces:4317",
+			},
+			wantEndpoint: "collector:4317",
+			wantTraces:   "traces:4317",
+			wantMetrics:  "collector:4317",
+			wantSampler:  "parentbased_always_on",
+		},
+		{
+			name: "empty env counts as unset",
+			file: Config{Endpoint: "collector:4317", SamplingRatio: &ratio},
+			env: map[string]string{
+				"OTEL_EXPORTER_OTLP_ENDPOINT": "",
+				"OTEL_TRACES_SAMPLER_ARG":     "",
+			},
+			wantEndpoint: "collector:4317",
+			wantTraces:   "collector:4317",
+			wantMetrics:  "collector:4317",
+			wantSampler:  "parentbased_traceidratio",
+			wantArg:      "0.25",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{
+				"OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT",
+				"OTEL_EXPORTER_OTLP_METRICS_ENDPOINT", "OTEL_EXPORTER_OTLP_LOGS_ENDPOINT",
+				"OTEL_EXPORTER_OTLP_INSECURE", "OTEL_TRACES_SAMPLER", "OTEL_TRACES_SAMPLER_ARG",
+			} {
+				t.Setenv(key, tt.env[key])
+			}
+
+			endpoint := "localhost:4317"
+			if v := tt.env["OTEL_EXPORTER_OTLP_ENDPOINT"]; v != "" {
+				endpoint = v
+			}
+			traces := endpoint
+			if v := tt.env["OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"]; v != "" {
+				traces = v
+			}
+			sampler := "parentbased_always_on"
+			if v := tt.env["OTEL_TRACES_SAMPLER"]; v != "" {
+				sampler = v
+			}
+			setConfig(t, &config.OTLPEndpoint, endpoint)
+			setConfig(t, &config.OTLPTracesEndpoint, traces)
+			setConfig(t, &config.OTLPMetricsEndpoint, endpoint)
+			setConfig(t, &config.OTLPLogsEndpoint, endpoint)
+			setConfig(t, &config.TracesSampler, sampler)
+			setConfig(t, &config.TracesSamplerArg, "")
+
+			tt.file.Apply()
+
+			if config.OTLPEndpoint != tt.wantEndpoint {
+				t.Errorf("OTLPEndpoint = %q, want %q", config.OTLPEndpoint, tt.wantEndpoint)
+			}
+			if config.OTLPTracesEndpoint != tt.wantTraces {
+				t.Errorf("OTLPTracesEndpoint = %q, want %q", config.OTLPTracesEndpoint, tt.wantTraces)
+			}
+			if config.OTLPMetricsEndpoint != tt.wantMetrics {
+				t.Errorf("OTLPMetricsEndpoint = %q, want %q", config.OTLPMetricsEndpoint, tt.wantMetrics)
+			}
+			if config.TracesSampler != tt.wantSampler {
+				t.Errorf("TracesSampler = %q, want %q", config.TracesSampler, tt.wantSampler)
+			}
+			if config.TracesSamplerArg != tt.wantArg {
+				t.Errorf("TracesSamplerArg = %q, want %q", config.TracesSamplerArg, tt.wantArg)
+			}
+		})
+	}
+}
+
+func TestConfigServiceEnabled(t *testing.T) {
+	file := &Config{Services: map[string]bool{"cart": false, "currency": true}}
+	tests := []struct {
+		name    string
+		config  *Config
+		service string
+		want    bool
+	}{
+		{"no file", nil, "cart", true},
+		{"disabled in file", file, "cart", false},
+		{"enabled in file", file, "currency", true},
+		{"unlisted", file, "shipping", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.config.ServiceEnabled(tt.service); got != tt.want {
+				t.Errorf("ServiceEnabled(%q) = %v, want %v", tt.service, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package common
+
+import (
+	"context"
+	"crypto/sha256"
+	"log"
+	"runtime"
+	"time"
+)
+
+// Each CPU worker is busy for cpuWorkerBusy out of every cpuWorkerPeriod,
+// so the load is obvious on a dashboard but leaves headroom for the demo
+const (
+	cpuWorkerPeriod = 100 * time.Millisecond
+	cpuWorkerBusy   = 80 * time.Millisecond
+)
+
+// StartCPUWorkers starts n goroutines that burn CPU hashing until ctx is
+// cancelled, to drive system.cpu.* and the load averages up on purpose.
+// n is capped at the number of CPUs.
+func StartCPUWorkers(ctx context.Context, n int) {
+	if n <= 0 {
+		return
+	}
+	if n > runtime.NumCPU() {
+		log.Printf("SIMULATE_CPU_WORKERS=%d exceeds %d CPUs, using %d", n, runtime.NumCPU(), runtime.NumCPU())
+		n = runtime.NumCPU()
+	}
+	log.Printf("WARNING: simulating CPU load with %d workers at %d%% each", n, cpuWorkerBusy*100/cpuWorkerPeriod)
+	for range n {
+		go burnCPU(ctx)
+	}
+}
+
+func burnCPU(ctx context.Context) {
+	ticker := time.NewTicker(cpuWorkerPeriod)
+	defer ticker.Stop()
+	var sum [sha256.Size]byte
+	for {
+		for deadline := time.Now().Add(cpuWorkerBusy); time.Now().Before(deadline); {
+			sum = sha256.Sum256(sum[:])
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
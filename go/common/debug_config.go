@@ -0,0 +1,173 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"otel-mock/config"
+	"strings"
+)
+
+// redacted replaces OTLP header values, which usually carry API keys
+const redacted = "<redacted>"
+
+// effectiveConfig is the telemetry configuration this process resolved from
+// defaults, the -config file and the environment
+type effectiveConfig struct {
+	ServiceInstanceID string `json:"service_instance_id"`
+	SDKDisabled       bool   `json:"sdk_disabled"`
+	DebugExporter     string `json:"debug_exporter,omitempty"`
+
+	OTLP struct {
+		Protocol         string            `json:"protocol"`
+		TracesEndpoints  []string          `json:"traces_endpoints"`
+		MetricsEndpoints []string          `json:"metrics_endpoints"`
+		LogsEndpoints    []string          `json:"logs_endpoints"`
+		Insecure         *bool             `json:"insecure,omitempty"`
+		Certificate      string            `json:"certificate,omitempty"`
+		Compression      string            `json:"compression"`
+		TracesHeaders    map[string]string `json:"traces_headers"`
+		MetricsHeaders   map[string]string `json:"metrics_headers"`
+		LogsHeaders      map[string]string `json:"logs_headers"`
+		Timeout          string            `json:"timeout"`
+		RetryEnabled     bool              `json:"retry_enabled"`
+		RetryInitial     string            `json:"retry_initial_interval"`
+		RetryMax         string            `json:"retry_max_interval"`
+		RetryMaxElapsed  string            `json:"retry_max_elapsed_time"`
+		KeepaliveTime    string            `json:"grpc_keepalive_time,omitempty"`
+	} `json:"otlp"`
+
+	Traces struct {
+		Exporter           string             `json:"exporter"`
+		Sampler            string             `json:"sampler"`
+		SamplerArg         string             `json:"sampler_arg"`
+		PerServiceRatios   map[string]float64 `json:"per_service_ratios"`
+		KeepErrorSpans     bool               `json:"keep_error_spans"`
+		SamplerDebug       bool               `json:"sampler_debug"`
+		BatchMaxQueueSize  int                `json:"batch_max_queue_size"`
+		BatchMaxExportSize int                `json:"batch_max_export_batch_size"`
+		BatchScheduleDelay string             `json:"batch_schedule_delay"`
+		BaggageAttributes  []string           `json:"baggage_span_attributes"`
+		AttrValueLength    int                `json:"attribute_value_length_limit"`
+		AttrCount          int                `json:"attribute_count_limit"`
+	} `json:"traces"`
+
+	Metrics struct {
+		Exporter       string `json:"exporter"`
+		PrometheusAddr string `json:"prometheus_addr,omitempty"`
+		ExportInterval string `json:"export_interval"`
+		ExportTimeout  string `json:"export_timeout"`
+		Temporality    string `json:"temporality"`
+		ExemplarFilter string `json:"exemplar_filter"`
+		Exponential    bool   `json:"exponential_histograms"`
+	} `json:"metrics"`
+
+	Logs struct {
+		Exporter string `json:"exporter"`
+	} `json:"logs"`
+
+	Instrumentation struct {
+		HostMetrics     bool   `json:"host_metrics"`
+		RuntimeMetrics  bool   `json:"runtime_metrics"`
+		RuntimeInterval string `json:"runtime_metrics_interval"`
+		CloudDetectors  bool   `json:"cloud_detectors"`
+	} `json:"instrumentation"`
+
+	ShutdownTimeout string `json:"shutdown_timeout"`
+}
+
+// resolveConfig snapshots the config package. Zero intervals mean the SDK
+// default is in use.
+func resolveConfig() effectiveConfig {
+	var c effectiveConfig
+	c.ServiceInstanceID = config.ServiceInstanceID
+	c.SDKDisabled = config.SDKDisabled
+	c.DebugExporter = config.DebugExporter
+
+	c.OTLP.Protocol = otlpProtocol()
+	c.OTLP.TracesEndpoints = otlpEndpoints(config.OTLPTracesEndpoint)
+	c.OTLP.MetricsEndpoints = otlpEndpoints(config.OTLPMetricsEndpoint)
+	c.OTLP.LogsEndpoints = otlpEndpoints(config.OTLPLogsEndpoint)
+	c.OTLP.Insecure = config.OTLPInsecure
+	c.OTLP.Certificate = config.OTLPCertificate
+	c.OTLP.Compression = config.OTLPCompression
+	c.OTLP.TracesHeaders = redactHeaders(otlpHeaders(config.OTLPTracesHeaders))
+	c.OTLP.MetricsHeaders = redactHeaders(otlpHeaders(config.OTLPMetricsHeaders))
+	c.OTLP.LogsHeaders = redactHeaders(otlpHeaders(config.OTLPLogsHeaders))
+	c.OTLP.Timeout = config.OTLPTimeout.String()
+	c.OTLP.RetryEnabled = config.OTLPRetryEnabled
+	c.OTLP.RetryInitial = config.OTLPRetryInitialInterval.String()
+	c.OTLP.RetryMax = config.OTLPRetryMaxInterval.String()
+	c.OTLP.RetryMaxElapsed = config.OTLPRetryMaxElapsedTime.String()
+	if _, ok := grpcKeepalive(); ok {
+		c.OTLP.KeepaliveTime = config.OTLPGRPCKeepaliveTime.String()
+	}
+
+	c.Traces.Exporter = config.TracesExporter
+	c.Traces.Sampler = config.TracesSampler
+	c.Traces.SamplerArg = config.TracesSamplerArg
+	c.Traces.PerServiceRatios = perServiceRatios()
+	c.Traces.KeepErrorSpans = config.KeepErrorSpans
+	c.Traces.SamplerDebug = config.SamplerDebug
+	c.Traces.BatchMaxQueueSize = config.BSPMaxQueueSize
+	c.Traces.BatchMaxExportSize = config.BSPMaxExportBatchSize
+	c.Traces.BatchScheduleDelay = config.BSPScheduleDelay.String()
+	c.Traces.BaggageAttributes = config.BaggageSpanAttributes
+	c.Traces.AttrValueLength = config.SpanAttributeValueLengthLimit
+	c.Traces.AttrCount = config.SpanAttributeCountLimit
+
+	c.Metrics.Exporter = config.MetricsExporter
+	if usePrometheusExporter() {
+		c.Metrics.PrometheusAddr = net.JoinHostPort(config.PrometheusHost, config.PrometheusPort)
+	}
+	c.Metrics.ExportInterval = config.MetricExportInterval.String()
+	c.Metrics.ExportTimeout = config.MetricExportTimeout.String()
+	c.Metrics.Temporality = strings.ToLower(config.MetricsTemporality)
+	c.Metrics.ExemplarFilter = config.MetricsExemplarFilter
+	c.Metrics.Exponential = config.ExponentialHistograms
+
+	c.Logs.Exporter = config.LogsExporter
+
+	c.Instrumentation.HostMetrics = config.EnableHostMetrics
+	c.Instrumentation.RuntimeMetrics = config.EnableRuntimeMetrics
+	c.Instrumentation.RuntimeInterval = config.RuntimeMetricsInterval.String()
+	c.Instrumentation.CloudDetectors = config.EnableCloudDetectors
+
+	c.ShutdownTimeout = config.ShutdownTimeout.String()
+	return c
+}
+
+// redactHeaders keeps header names but hides their values
+func redactHeaders(headers map[string]string) map[string]string {
+	out := make(map[string]string, len(headers))
+	for k := range headers {
+		out[k] = redacted
+	}
+	return out
+}
+
+// ServeDebugConfig serves the effective configuration as JSON on
+// DebugConfigAddr/debug/config when ENABLE_DEBUG_CONFIG is set. Settings are
+// shared by every service in the process, so there is one listener.
+func ServeDebugConfig() {
+	if !config.EnableDebugConfig {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/config", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		enc.Encode(resolveConfig())
+	})
+
+	log.Printf("serving effective config on http://%s/debug/config", config.DebugConfigAddr)
+	go func() {
+		if err := http.ListenAndServe(config.DebugConfigAddr, mux); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("debug config server failed: %v", err)
+		}
+	}()
+}
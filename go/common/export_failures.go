@@ -0,0 +1,77 @@
+package common
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// exportFailures counts failed export calls as otel.export.failures. The
+// exporters are built before the meter provider they report through, so the
+// counter is bound afterwards and failures before that are only dropped.
+type exportFailures struct {
+	counter atomic.Pointer[metric.Int64Counter]
+}
+
+func (f *exportFailures) bind(mp metric.MeterProvider) {
+	counter, err := mp.Meter("telemetry").Int64Counter("otel.export.failures",
+		metric.WithDescription("Telemetry export calls that returned an error"),
+		metric.WithUnit("{failure}"))
+	if err != nil {
+		log.Printf("failed to create otel.export.failures counter: %v", err)
+		return
+	}
+	f.counter.Store(&counter)
+}
+
+func (f *exportFailures) record(err error, signal string) {
+	if err == nil {
+		return
+	}
+	if counter := f.counter.Load(); counter != nil {
+		(*counter).Add(context.Background(), 1, metric.WithAttributes(attribute.String("signal", signal)))
+	}
+}
+
+// countingSpanExporter reports ExportSpans errors to failures
+type countingSpanExporter struct {
+	sdktrace.SpanExporter
+	failures *exportFailures
+}
+
+func (e countingSpanExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	err := e.SpanExporter.ExportSpans(ctx, spans)
+	e.failures.record(err, "traces")
+	return err
+}
+
+// countingMetricExporter reports Export errors to failures
+type countingMetricExporter struct {
+	sdkmetric.Exporter
+	failures *exportFailures
+}
+
+func (e countingMetricExporter) Export(ctx context.Context, rm *metricdata.ResourceMetrics) error {
+	err := e.Exporter.Export(ctx, rm)
+	e.failures.record(err, "metrics")
+	return err
+}
+
+// countingLogExporter reports Export errors to failures
+type countingLogExporter struct {
+	sdklog.Exporter
+	failures *exportFailures
+}
+
+func (e countingLogExporter) Export(ctx context.Context, records []sdklog.Record) error {
+	err := e.Exporter.Export(ctx, records)
+	e.failures.record(err, "logs")
+	return err
+}
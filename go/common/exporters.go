@@ -0,0 +1,456 @@
+package common
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"otel-mock/config"
+	"path"
+	"strings"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploggrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploghttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdoutlog"
+	"go.opentelemetry.io/otel/exporters/stdout/stdoutmetric"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+)
+
+const (
+	protocolGRPC         = "grpc"
+	protocolHTTPProtobuf = "http/protobuf"
+)
+
+// otlpProtocol returns the configured OTLP transport, falling back to gRPC
+// for unknown values.
+func otlpProtocol() string {
+	switch config.OTLPProtocol {
+	case protocolGRPC, protocolHTTPProtobuf:
+		return config.OTLPProtocol
+	default:
+		log.Printf("unsupported OTLP protocol %q, using %s", config.OTLPProtocol, protocolGRPC)
+		return protocolGRPC
+	}
+}
+
+// useGzip reports whether OTLP payloads should be gzip-compressed.
+func useGzip() bool {
+	switch config.OTLPCompression {
+	case "gzip":
+		return true
+	case "", "none":
+		return false
+	default:
+		log.Printf("unsupported OTLP compression %q, sending uncompressed", config.OTLPCompression)
+		return false
+	}
+}
+
+// useStdoutExporters reports whether telemetry should be printed to the
+// console instead of sent over OTLP, for running without a collector.
+func useStdoutExporters() bool {
+	return config.DebugExporter == "stdout"
+}
+
+// otlpEndpoints splits a comma-separated endpoint setting, so one pipeline
+// can fan out to several collectors
+func otlpEndpoints(raw string) []string {
+	var endpoints []string
+	for _, endpoint := range strings.Split(raw, ",") {
+		if endpoint = strings.TrimSpace(endpoint); endpoint != "" {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints
+}
+
+// newExporters builds one exporter per endpoint in raw, or a single stdout
+// exporter in debug mode. If any fails the ones already built are shut down.
+func newExporters[E interface{ Shutdown(context.Context) error }](ctx context.Context, raw string, newExporter func(context.Context, string) (E, error)) ([]E, error) {
+	endpoints := otlpEndpoints(raw)
+	if useStdoutExporters() {
+		endpoints = []string{""}
+	}
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("no OTLP endpoint configured")
+	}
+	exporters := make([]E, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		exporter, err := newExporter(ctx, endpoint)
+		if err != nil {
+			for _, e := range exporters {
+				e.Shutdown(ctx)
+			}
+			return nil, err
+		}
+		exporters = append(exporters, exporter)
+	}
+	return exporters, nil
+}
+
+func newTraceExporter(ctx context.Context, endpoint string) (sdktrace.SpanExporter, error) {
+	if useStdoutExporters() {
+		return stdouttrace.New(stdouttrace.WithPrettyPrint())
+	}
+
+	insecure := endpointInsecure(endpoint)
+	tlsCfg, err := otlpTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if otlpProtocol() == protocolHTTPProtobuf {
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(hostPort(endpoint))}
+		if u, ok := httpSignalURL(endpoint, config.OTLPTracesEndpoint, "/v1/traces"); ok {
+			opts[0] = otlptracehttp.WithEndpointURL(u)
+		}
+		if insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		} else if tlsCfg != nil {
+			opts = append(opts, otlptracehttp.WithTLSClientConfig(tlsCfg))
+		}
+		opts = append(opts,
+			otlptracehttp.WithTimeout(config.OTLPTimeout),
+			otlptracehttp.WithRetry(otlptracehttp.RetryConfig{
+				Enabled:         config.OTLPRetryEnabled,
+				InitialInterval: config.OTLPRetryInitialInterval,
+				MaxInterval:     config.OTLPRetryMaxInterval,
+				MaxElapsedTime:  config.OTLPRetryMaxElapsedTime,
+			}),
+		)
+		if headers := otlpHeaders(config.OTLPTracesHeaders); len(headers) > 0 {
+			opts = append(opts, otlptracehttp.WithHeaders(headers))
+		}
+		if useGzip() {
+			opts = append(opts, otlptracehttp.WithCompression(otlptracehttp.GzipCompression))
+		}
+		return otlptracehttp.New(ctx, opts...)
+	}
+
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(hostPort(endpoint))}
+	if insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	} else if tlsCfg != nil {
+		opts = append(opts, otlptracegrpc.WithTLSCredentials(credentials.NewTLS(tlsCfg)))
+	}
+	opts = append(opts,
+		otlptracegrpc.WithTimeout(config.OTLPTimeout),
+		otlptracegrpc.WithRetry(otlptracegrpc.RetryConfig{
+			Enabled:         config.OTLPRetryEnabled,
+			InitialInterval: config.OTLPRetryInitialInterval,
+			MaxInterval:     config.OTLPRetryMaxInterval,
+			MaxElapsedTime:  config.OTLPRetryMaxElapsedTime,
+		}),
+	)
+	if headers := otlpHeaders(config.OTLPTracesHeaders); len(headers) > 0 {
+		opts = append(opts, otlptracegrpc.WithHeaders(headers))
+	}
+	if useGzip() {
+		opts = append(opts, otlptracegrpc.WithCompressor("gzip"))
+	}
+	if keepalive, ok := grpcKeepalive(); ok {
+		opts = append(opts, otlptracegrpc.WithDialOption(keepalive))
+	}
+	return otlptracegrpc.New(ctx, opts...)
+}
+
+func newMetricExporter(ctx context.Context, endpoint string) (sdkmetric.Exporter, error) {
+	if useStdoutExporters() {
+		return stdoutmetric.New(stdoutmetric.WithPrettyPrint())
+	}
+
+	insecure := endpointInsecure(endpoint)
+	tlsCfg, err := otlpTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if otlpProtocol() == protocolHTTPProtobuf {
+		opts := []otlpmetrichttp.Option{otlpmetrichttp.WithEndpoint(hostPort(endpoint))}
+		if u, ok := httpSignalURL(endpoint, config.OTLPMetricsEndpoint, "/v1/metrics"); ok {
+			opts[0] = otlpmetrichttp.WithEndpointURL(u)
+		}
+		if insecure {
+			opts = append(opts, otlpmetrichttp.WithInsecure())
+		} else if tlsCfg != nil {
+			opts = append(opts, otlpmetrichttp.WithTLSClientConfig(tlsCfg))
+		}
+		opts = append(opts,
+			otlpmetrichttp.WithTimeout(config.OTLPTimeout),
+			otlpmetrichttp.WithRetry(otlpmetrichttp.RetryConfig{
+				Enabled:         config.OTLPRetryEnabled,
+				InitialInterval: config.OTLPRetryInitialInterval,
+				MaxInterval:     config.OTLPRetryMaxInterval,
+				MaxElapsedTime:  config.OTLPRetryMaxElapsedTime,
+			}),
+		)
+		if headers := otlpHeaders(config.OTLPMetricsHeaders); len(headers) > 0 {
+			opts = append(opts, otlpmetrichttp.WithHeaders(headers))
+		}
+		if useGzip() {
+			opts = append(opts, otlpmetrichttp.WithCompression(otlpmetrichttp.GzipCompression))
+		}
+		opts = append(opts, otlpmetrichttp.WithTemporalitySelector(temporalitySelector()))
+		return otlpmetrichttp.New(ctx, opts...)
+	}
+
+	opts := []otlpmetricgrpc.Option{otlpmetricgrpc.WithEndpoint(hostPort(endpoint))}
+	if insecure {
+		opts = append(opts, otlpmetricgrpc.WithInsecure())
+	} else if tlsCfg != nil {
+		opts = append(opts, otlpmetricgrpc.WithTLSCredentials(credentials.NewTLS(tlsCfg)))
+	}
+	opts = append(opts,
+		otlpmetricgrpc.WithTimeout(config.OTLPTimeout),
+		otlpmetricgrpc.WithRetry(otlpmetricgrpc.RetryConfig{
+			Enabled:         config.OTLPRetryEnabled,
+			InitialInterval: config.OTLPRetryInitialInterval,
+			MaxInterval:     config.OTLPRetryMaxInterval,
+			MaxElapsedTime:  config.OTLPRetryMaxElapsedTime,
+		}),
+	)
+	if headers := otlpHeaders(config.OTLPMetricsHeaders); len(headers) > 0 {
+		opts = append(opts, otlpmetricgrpc.WithHeaders(headers))
+	}
+	if useGzip() {
+		opts = append(opts, otlpmetricgrpc.WithCompressor("gzip"))
+	}
+	if keepalive, ok := grpcKeepalive(); ok {
+		opts = append(opts, otlpmetricgrpc.WithDialOption(keepalive))
+	}
+	opts = append(opts, otlpmetricgrpc.WithTemporalitySelector(temporalitySelector()))
+	return otlpmetricgrpc.New(ctx, opts...)
+}
+
+// temporalitySelector maps OTEL_EXPORTER_OTLP_METRICS_TEMPORALITY_PREFERENCE
+// to a selector, following the spec's definitions of delta and lowmemory.
+func temporalitySelector() sdkmetric.TemporalitySelector {
+	switch strings.ToLower(config.MetricsTemporality) {
+	case "cumulative":
+		return sdkmetric.DefaultTemporalitySelector
+	case "delta":
+		return func(kind sdkmetric.InstrumentKind) metricdata.Temporality {
+			switch kind {
+			case sdkmetric.InstrumentKindUpDownCounter, sdkmetric.InstrumentKindObservableUpDownCounter:
+				return metricdata.CumulativeTemporality
+			default:
+				return metricdata.DeltaTemporality
+			}
+		}
+	case "lowmemory":
+		return func(kind sdkmetric.InstrumentKind) metricdata.Temporality {
+			switch kind {
+			case sdkmetric.InstrumentKindCounter, sdkmetric.InstrumentKindHistogram:
+				return metricdata.DeltaTemporality
+			default:
+				return metricdata.CumulativeTemporality
+			}
+		}
+	default:
+		log.Printf("unsupported metrics temporality %q, using cumulative", config.MetricsTemporality)
+		return sdkmetric.DefaultTemporalitySelector
+	}
+}
+
+func newLogExporter(ctx context.Context, endpoint string) (sdklog.Exporter, error) {
+	if useStdoutExporters() {
+		return stdoutlog.New(stdoutlog.WithPrettyPrint())
+	}
+
+	insecure := endpointInsecure(endpoint)
+	tlsCfg, err := otlpTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if otlpProtocol() == protocolHTTPProtobuf {
+		opts := []otlploghttp.Option{otlploghttp.WithEndpoint(hostPort(endpoint))}
+		if u, ok := httpSignalURL(endpoint, config.OTLPLogsEndpoint, "/v1/logs"); ok {
+			opts[0] = otlploghttp.WithEndpointURL(u)
+		}
+		if insecure {
+			opts = append(opts, otlploghttp.WithInsecure())
+		} else if tlsCfg != nil {
+			opts = append(opts, otlploghttp.WithTLSClientConfig(tlsCfg))
+		}
+		opts = append(opts,
+			otlploghttp.WithTimeout(config.OTLPTimeout),
+			otlploghttp.WithRetry(otlploghttp.RetryConfig{
+				Enabled:         config.OTLPRetryEnabled,
+				InitialInterval: config.OTLPRetryInitialInterval,
+				MaxInterval:     config.OTLPRetryMaxInterval,
+				MaxElapsedTime:  config.OTLPRetryMaxElapsedTime,
+			}),
+		)
+		if headers := otlpHeaders(config.OTLPLogsHeaders); len(headers) > 0 {
+			opts = append(opts, otlploghttp.WithHeaders(headers))
+		}
+		if useGzip() {
+			opts = append(opts, otlploghttp.WithCompression(otlploghttp.GzipCompression))
+		}
+		return otlploghttp.New(ctx, opts...)
+	}
+
+	opts := []otlploggrpc.Option{otlploggrpc.WithEndpoint(hostPort(endpoint))}
+	if insecure {
+		opts = append(opts, otlploggrpc.WithInsecure())
+	} else if tlsCfg != nil {
+		opts = append(opts, otlploggrpc.WithTLSCredentials(credentials.NewTLS(tlsCfg)))
+	}
+	opts = append(opts,
+		otlploggrpc.WithTimeout(config.OTLPTimeout),
+		otlploggrpc.WithRetry(otlploggrpc.RetryConfig{
+			Enabled:         config.OTLPRetryEnabled,
+			InitialInterval: config.OTLPRetryInitialInterval,
+			MaxInterval:     config.OTLPRetryMaxInterval,
+			MaxElapsedTime:  config.OTLPRetryMaxElapsedTime,
+		}),
+	)
+	if headers := otlpHeaders(config.OTLPLogsHeaders); len(headers) > 0 {
+		opts = append(opts, otlploggrpc.WithHeaders(headers))
+	}
+	if useGzip() {
+		opts = append(opts, otlploggrpc.WithCompressor("gzip"))
+	}
+	if keepalive, ok := grpcKeepalive(); ok {
+		opts = append(opts, otlploggrpc.WithDialOption(keepalive))
+	}
+	return otlploggrpc.New(ctx, opts...)
+}
+
+// otlpHeaders merges OTEL_EXPORTER_OTLP_HEADERS with a per-signal override,
+// the latter winning on duplicate keys. Values are never logged since they
+// usually carry API keys.
+func otlpHeaders(signalHeaders string) map[string]string {
+	headers := parseHeaders(config.OTLPHeaders)
+	for k, v := range parseHeaders(signalHeaders) {
+		headers[k] = v
+	}
+	return headers
+}
+
+// parseHeaders parses the spec's comma-separated, URL-encoded key=value list.
+func parseHeaders(raw string) map[string]string {
+	headers := make(map[string]string)
+	for i, pair := range strings.Split(raw, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		key, kerr := url.PathUnescape(strings.TrimSpace(k))
+		value, verr := url.PathUnescape(strings.TrimSpace(v))
+		if !ok || key == "" || kerr != nil || verr != nil {
+			log.Printf("ignoring malformed OTLP header entry #%d", i+1)
+			continue
+		}
+		headers[key] = value
+	}
+	return headers
+}
+
+// logExportSettings reports the effective OTLP timeout and retry policy.
+// Called once per process since the settings are shared by every service.
+func logExportSettings() {
+	log.Printf("OTLP export: timeout=%v retry_enabled=%v retry_initial=%v retry_max=%v retry_max_elapsed=%v",
+		config.OTLPTimeout, config.OTLPRetryEnabled, config.OTLPRetryInitialInterval,
+		config.OTLPRetryMaxInterval, config.OTLPRetryMaxElapsedTime)
+	if _, ok := grpcKeepalive(); ok && otlpProtocol() == protocolGRPC {
+		log.Printf("OTLP gRPC keepalive: time=%v timeout=%v", config.OTLPGRPCKeepaliveTime, config.OTLPGRPCKeepaliveTimeout)
+	}
+}
+
+// grpcKeepalive returns the dial option that makes gRPC exporters ping an
+// idle connection every config.OTLPGRPCKeepaliveTime, if one is set. The
+// collector must allow pings that often (its keepalive enforcement_policy
+// min_time) or it closes the connection.
+func grpcKeepalive() (grpc.DialOption, bool) {
+	if config.OTLPGRPCKeepaliveTime <= 0 {
+		return nil, false
+	}
+	return grpc.WithKeepaliveParams(keepalive.ClientParameters{
+		Time:                config.OTLPGRPCKeepaliveTime,
+		Timeout:             config.OTLPGRPCKeepaliveTimeout,
+		PermitWithoutStream: true,
+	}), true
+}
+
+// otlpTLSConfig builds a TLS config trusting the CA certificate configured
+// for the OTLP exporters. It returns nil when no certificate is set.
+func otlpTLSConfig() (*tls.Config, error) {
+	if config.OTLPCertificate == "" {
+		return nil, nil
+	}
+	pem, err := os.ReadFile(config.OTLPCertificate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read OTLP certificate: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", config.OTLPCertificate)
+	}
+	return &tls.Config{RootCAs: pool}, nil
+}
+
+// endpointInsecure reports whether endpoint is exported to in plain text.
+// OTEL_EXPORTER_OTLP_INSECURE decides when set; otherwise the endpoint's own
+// scheme does, and a bare host:port uses TLS only if a CA certificate is
+// configured.
+func endpointInsecure(endpoint string) bool {
+	switch {
+	case config.OTLPInsecure != nil:
+		return *config.OTLPInsecure
+	case strings.HasPrefix(endpoint, "https://"):
+		return false
+	case strings.HasPrefix(endpoint, "http://"):
+		return true
+	default:
+		return config.OTLPCertificate == ""
+	}
+}
+
+// httpSignalURL returns the URL an OTLP/HTTP exporter posts to when
+// endpoint, one entry of the signal's endpoint list raw, is a full URL. A
+// per-signal URL is used as-is, while the shared OTEL_EXPORTER_OTLP_ENDPOINT
+// is a base URL that signalPath is appended to. A URL without a path still
+// gets the exporter's default signalPath.
+func httpSignalURL(endpoint, raw, signalPath string) (string, bool) {
+	if !strings.Contains(endpoint, "://") {
+		return "", false
+	}
+	if raw != config.OTLPEndpoint {
+		return endpoint, true
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		// WithEndpointURL reports it
+		return endpoint, true
+	}
+	u.Path = path.Join(u.Path, signalPath)
+	return u.String(), true
+}
+
+// hostPort strips the scheme and path from an endpoint so both
+// "collector:4317" and "http://collector:4317" are accepted.
+func hostPort(endpoint string) string {
+	if i := strings.Index(endpoint, "://"); i >= 0 {
+		endpoint = endpoint[i+3:]
+	}
+	if i := strings.Index(endpoint, "/"); i >= 0 {
+		endpoint = endpoint[:i]
+	}
+	return endpoint
+}
@@ -0,0 +1,411 @@
+package common
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"otel-mock/config"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// otlpRequest is what a fake HTTP collector saw for one export call
+type otlpRequest struct {
+	path     string
+	encoding string
+	body     []byte
+}
+
+// fakeHTTPCollector records the OTLP/HTTP requests it's sent
+type fakeHTTPCollector struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []otlpRequest
+}
+
+func startHTTPCollector(t *testing.T) *fakeHTTPCollector {
+	t.Helper()
+	c := &fakeHTTPCollector{}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		c.mu.Lock()
+		c.requests = append(c.requests, otlpRequest{path: r.URL.Path, encoding: r.Header.Get("Content-Encoding"), body: body})
+		c.mu.Unlock()
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}))
+	t.Cleanup(c.Close)
+	return c
+}
+
+func (c *fakeHTTPCollector) received() []otlpRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]otlpRequest(nil), c.requests...)
+}
+
+// exportTestSpan pushes one span through every exporter built for raw
+func exportTestSpan(t *testing.T, raw string) {
+	t.Helper()
+	ctx := context.Background()
+	exporters, err := newExporters(ctx, raw, newTraceExporter)
+	if err != nil {
+		t.Fatalf("newExporters(%q): %v", raw, err)
+	}
+	for _, e := range exporters {
+		if err := e.ExportSpans(ctx, tracetest.SpanStubs{{Name: "test"}}.Snapshots()); err != nil {
+			t.Errorf("ExportSpans: %v", err)
+		}
+		e.Shutdown(ctx)
+	}
+}
+
+func TestTraceExporterEndpoint(t *testing.T) {
+	tests := []struct {
+		name string
+		// endpoints builds the shared and per-signal endpoint settings from
+		// the collectors' base URLs
+		endpoints func(first, second string) (shared, traces string)
+		wantPath  string
+	}{
+		{
+			name:      "fan-out to per-signal URLs without a path",
+			endpoints: func(first, second string) (string, string) { return "localhost:4318", first + ", " + second },
+			wantPath:  "/v1/traces",
+		},
+		{
+			name: "per-signal URL path used as-is",
+			endpoints: func(first, second string) (string, string) {
+				return "localhost:4318", first + "/otlp/v1/traces, " + second + "/otlp/v1/traces"
+			},
+			wantPath: "/otlp/v1/traces",
+		},
+		{
+			name: "shared URL path is a base for the signal path",
+			endpoints: func(first, second string) (string, string) {
+				list := first + "/otlp, " + second + "/otlp"
+				return list, list
+			},
+			wantPath: "/otlp/v1/traces",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, &config.OTLPProtocol, protocolHTTPProtobuf)
+			setConfig(t, &config.OTLPCertificate, "")
+			setConfig(t, &config.DebugExporter, "")
+
+			first, second := startHTTPCollector(t), startHTTPCollector(t)
+			shared, traces := tt.endpoints(first.URL, second.URL)
+			setConfig(t, &config.OTLPEndpoint, shared)
+			setConfig(t, &config.OTLPTracesEndpoint, traces)
+			exportTestSpan(t, config.OTLPTracesEndpoint)
+
+			for i, c := range []*fakeHTTPCollector{first, second} {
+				got := c.received()
+				if len(got) != 1 || got[0].path != tt.wantPath {
+					t.Errorf("collector %d received %+v, want one request to %s", i, got, tt.wantPath)
+				}
+			}
+		})
+	}
+}
+
+func TestNewExportersNoEndpoint(t *testing.T) {
+	setConfig(t, &config.DebugExporter, "")
+	if _, err := newExporters(context.Background(), " , ", newTraceExporter); err == nil {
+		t.Error("newExporters with no endpoint succeeded, want an error")
+	}
+}
+
+func TestHostPort(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		want     string
+	}{
+		{"collector:4317", "collector:4317"},
+		{"http://collector:4318", "collector:4318"},
+		{"https://collector:4318/v1/traces", "collector:4318"},
+		{"localhost:4317/", "localhost:4317"},
+	}
+	for _, tt := range tests {
+		if got := hostPort(tt.endpoint); got != tt.want {
+			t.Errorf("hostPort(%q) = %q, want %q", tt.endpoint, got, tt.want)
+		}
+	}
+}
+
+// fakeTraceCollector is an OTLP/gRPC trace service counting export calls
+type fakeTraceCollector struct {
+	coltracepb.UnimplementedTraceServiceServer
+	mu      sync.Mutex
+	exports int
+}
+
+func (c *fakeTraceCollector) Export(context.Context, *coltracepb.ExportTraceServiceRequest) (*coltracepb.ExportTraceServiceResponse, error) {
+	c.mu.Lock()
+	c.exports++
+	c.mu.Unlock()
+	return &coltracepb.ExportTraceServiceResponse{}, nil
+}
+
+func (c *fakeTraceCollector) received() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.exports
+}
+
+// startGRPCCollector serves a fakeTraceCollector on a loopback port, over
+// TLS when cert is non-nil, and returns it with its address
+func startGRPCCollector(t *testing.T, cert *tls.Certificate) (*fakeTraceCollector, string) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var opts []grpc.ServerOption
+	if cert != nil {
+		opts = append(opts, grpc.Creds(credentials.NewServerTLSFromCert(cert)))
+	}
+	server := grpc.NewServer(opts...)
+	collector := &fakeTraceCollector{}
+	coltracepb.RegisterTraceServiceServer(server, collector)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+	return collector, lis.Addr().String()
+}
+
+// selfSignedCert returns a certificate for 127.0.0.1 and the path of a temp
+// file holding it in PEM form
+func selfSignedCert(t *testing.T) (tls.Certificate, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, path
+}
+
+func TestTraceExporterGRPCTransport(t *testing.T) {
+	cert, certPath := selfSignedCert(t)
+	tests := []struct {
+		name     string
+		tls      bool
+		certPath string
+	}{
+		{"insecure by default", false, ""},
+		{"TLS with a self-signed CA", true, certPath},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, &config.OTLPProtocol, protocolGRPC)
+			setConfig(t, &config.OTLPCertificate, tt.certPath)
+			setConfig(t, &config.DebugExporter, "")
+			setConfig(t, &config.OTLPRetryEnabled, false)
+
+			var serverCert *tls.Certificate
+			if tt.tls {
+				serverCert = &cert
+			}
+			collector, addr := startGRPCCollector(t, serverCert)
+			exportTestSpan(t, addr)
+			if got := collector.received(); got != 1 {
+				t.Errorf("collector received %d exports, want 1", got)
+			}
+		})
+	}
+}
+
+func TestOTLPTLSConfig(t *testing.T) {
+	_, certPath := selfSignedCert(t)
+	notPEM := filepath.Join(t.TempDir(), "not.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		wantCfg bool
+		wantErr bool
+	}{
+		{"unset", "", false, false},
+		{"self-signed CA", certPath, true, false},
+		{"missing file", filepath.Join(t.TempDir(), "missing.pem"), false, true},
+		{"no certificates in file", notPEM, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, &config.OTLPCertificate, tt.path)
+			cfg, err := otlpTLSConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("otlpTLSConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (cfg != nil) != tt.wantCfg {
+				t.Errorf("otlpTLSConfig() = %v, want config: %v", cfg, tt.wantCfg)
+			}
+		})
+	}
+}
+
+func TestTraceExporterCompression(t *testing.T) {
+	tests := []struct {
+		name        string
+		compression string
+		want        string
+	}{
+		{"gzip", "gzip", "gzip"},
+		{"none", "none", ""},
+		{"unset", "", ""},
+		{"unsupported falls back to none", "zstd", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, &config.OTLPProtocol, protocolHTTPProtobuf)
+			setConfig(t, &config.OTLPCertificate, "")
+			setConfig(t, &config.DebugExporter, "")
+			setConfig(t, &config.OTLPCompression, tt.compression)
+
+			collector := startHTTPCollector(t)
+			exportTestSpan(t, collector.URL)
+			got := collector.received()
+			if len(got) != 1 {
+				t.Fatalf("collector received %d requests, want 1", len(got))
+			}
+			if got[0].encoding != tt.want {
+				t.Errorf("Content-Encoding = %q, want %q", got[0].encoding, tt.want)
+			}
+		})
+	}
+}
+
+func TestGRPCKeepalive(t *testing.T) {
+	tests := []struct {
+		name string
+		time time.Duration
+		want bool
+	}{
+		{"off by default", 0, false},
+		{"negative is off", -time.Second, false},
+		{"configured", 30 * time.Second, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, &config.OTLPGRPCKeepaliveTime, tt.time)
+			opt, ok := grpcKeepalive()
+			if ok != tt.want || (opt != nil) != tt.want {
+				t.Errorf("grpcKeepalive() = %v, %v, want a dial option: %v", opt, ok, tt.want)
+			}
+		})
+	}
+}
+
+// With keepalive configured the exporter still dials and exports normally
+func TestTraceExporterGRPCKeepalive(t *testing.T) {
+	setConfig(t, &config.OTLPProtocol, protocolGRPC)
+	setConfig(t, &config.OTLPCertificate, "")
+	setConfig(t, &config.DebugExporter, "")
+	setConfig(t, &config.OTLPRetryEnabled, false)
+	setConfig(t, &config.OTLPGRPCKeepaliveTime, 30*time.Second)
+
+	collector, addr := startGRPCCollector(t, nil)
+	exportTestSpan(t, addr)
+	if got := collector.received(); got != 1 {
+		t.Errorf("collector received %d exports, want 1", got)
+	}
+}
+
+func TestEndpointInsecure(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		name     string
+		endpoint string
+		override *bool
+		certPath string
+		want     bool
+	}{
+		{"bare endpoint", "collector:4317", nil, "", true},
+		{"bare endpoint with a CA certificate", "collector:4317", nil, "ca.pem", false},
+		{"http scheme", "http://collector:4318", nil, "ca.pem", true},
+		{"https scheme", "https://collector:4318", nil, "", false},
+		{"explicitly insecure", "https://collector:4318", &yes, "", true},
+		{"explicitly secure", "collector:4317", &no, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, &config.OTLPInsecure, tt.override)
+			setConfig(t, &config.OTLPCertificate, tt.certPath)
+			if got := endpointInsecure(tt.endpoint); got != tt.want {
+				t.Errorf("endpointInsecure(%q) = %v, want %v", tt.endpoint, got, tt.want)
+			}
+		})
+	}
+}
+
+// An https:// per-signal endpoint gets TLS from its own scheme, even when it
+// shares a fan-out list with a plain-text one
+func TestTraceExporterTLSFromScheme(t *testing.T) {
+	setConfig(t, &config.OTLPProtocol, protocolHTTPProtobuf)
+	setConfig(t, &config.OTLPInsecure, nil)
+	setConfig(t, &config.DebugExporter, "")
+	setConfig(t, &config.OTLPRetryEnabled, false)
+	setConfig(t, &config.OTLPEndpoint, "localhost:4318")
+
+	plain := startHTTPCollector(t)
+	secure := &fakeHTTPCollector{}
+	secure.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secure.mu.Lock()
+		secure.requests = append(secure.requests, otlpRequest{path: r.URL.Path})
+		secure.mu.Unlock()
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}))
+	t.Cleanup(secure.Close)
+	certPath := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: secure.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	setConfig(t, &config.OTLPCertificate, certPath)
+
+	setConfig(t, &config.OTLPTracesEndpoint, plain.URL+","+secure.URL)
+	exportTestSpan(t, config.OTLPTracesEndpoint)
+
+	for name, c := range map[string]*fakeHTTPCollector{"http": plain, "https": secure} {
+		if got := c.received(); len(got) != 1 {
+			t.Errorf("%s collector received %d requests, want 1", name, len(got))
+		}
+	}
+}
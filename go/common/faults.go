@@ -0,0 +1,76 @@
+package common
+
+import (
+	"log"
+	"math/rand"
+	"net/http"
+	"otel-mock/config"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// leaked holds the memory InjectFaults leaks on purpose; nothing is ever
+// removed from it
+var (
+	leakedMu sync.Mutex
+	leaked   [][]byte
+)
+
+// InjectFaults wraps next with the latency and error rate configured for
+// service through FAULT_<SERVICE>_DELAY_MS and FAULT_<SERVICE>_ERROR_RATE,
+// and the per-request leak set by FAULT_<SERVICE>_LEAK_KB. It must run
+// inside the otelhttp handler so faults land on the server span. With none
+// set, next is returned unchanged.
+func InjectFaults(service string, next http.Handler) http.Handler {
+	delay := config.FaultDelay(service)
+	errorRate := config.FaultErrorRate(service)
+	leakKB := config.FaultLeakKB(service)
+	if delay == 0 && errorRate == 0 && leakKB <= 0 {
+		return next
+	}
+	if delay > 0 || errorRate > 0 {
+		log.Printf("%s: injecting faults (delay=%s, error_rate=%.2f)", service, delay, errorRate)
+	}
+	if leakKB > 0 {
+		log.Printf("WARNING %s: LEAKING %d KiB OF MEMORY PER REQUEST on purpose; the process grows until restarted", service, leakKB)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		span := trace.SpanFromContext(r.Context())
+
+		if leakKB > 0 {
+			leakedMu.Lock()
+			leaked = append(leaked, make([]byte, leakKB*1024))
+			leakedMu.Unlock()
+			span.AddEvent("fault.memory_leaked", trace.WithAttributes(
+				attribute.Int("fault.leak_kb", leakKB),
+			))
+		}
+
+		if delay > 0 {
+			span.AddEvent("fault.delay_injected", trace.WithAttributes(
+				attribute.Int64("fault.delay_ms", delay.Milliseconds()),
+			))
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		if errorRate > 0 && rand.Float64() < errorRate {
+			span.AddEvent("fault.error_injected", trace.WithAttributes(
+				attribute.Float64("fault.error_rate", errorRate),
+			))
+			span.SetStatus(codes.Error, "injected fault")
+			http.Error(w, `{"error":"injected fault"}`, http.StatusInternalServerError)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
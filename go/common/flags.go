@@ -0,0 +1,115 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"otel-mock/config"
+	"sync"
+)
+
+// Demo behaviors that can be toggled at runtime through /flags
+const (
+	// FlagSlowProductCatalog slows every product search down
+	FlagSlowProductCatalog = "slowProductCatalog"
+	// FlagFailCurrency makes every currency conversion fail with a 500
+	FlagFailCurrency = "failCurrency"
+)
+
+// FlagStore holds named boolean flags that services check at request time.
+// It is safe for concurrent use.
+type FlagStore struct {
+	mu    sync.RWMutex
+	flags map[string]bool
+}
+
+// NewFlagStore returns a store with exactly the flags in defaults; Set
+// rejects any other name
+func NewFlagStore(defaults map[string]bool) *FlagStore {
+	return &FlagStore{flags: maps.Clone(defaults)}
+}
+
+// Flags is the process-wide store shared by every Go service
+var Flags = NewFlagStore(map[string]bool{
+	FlagSlowProductCatalog: false,
+	FlagFailCurrency:       false,
+})
+
+// Enabled reports whether name is on; unknown flags are off
+func (s *FlagStore) Enabled(name string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.flags[name]
+}
+
+// Set turns name on or off
+func (s *FlagStore) Set(name string, on bool) error {
+	return s.update(map[string]bool{name: on})
+}
+
+// update applies every change in flags or, if any name is unknown, none
+func (s *FlagStore) update(flags map[string]bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name := range flags {
+		if _, ok := s.flags[name]; !ok {
+			return fmt.Errorf("unknown flag %q", name)
+		}
+	}
+	maps.Copy(s.flags, flags)
+	return nil
+}
+
+// All returns a copy of every flag and its value
+func (s *FlagStore) All() map[string]bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return maps.Clone(s.flags)
+}
+
+// ServeHTTP lists the flags on GET and, on POST, applies a JSON object of
+// flag names to values, e.g. {"failCurrency": true}, then lists them
+func (s *FlagStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var update map[string]bool
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			http.Error(w, `{"error":"body must be a JSON object of flag names to booleans"}`, http.StatusBadRequest)
+			return
+		}
+		if err := s.update(update); err != nil {
+			http.Error(w, fmt.Sprintf(`{"error":%q}`, err.Error()), http.StatusBadRequest)
+			return
+		}
+		for name, on := range update {
+			log.Printf("flag %s set to %v", name, on)
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, `{"error":"method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.All())
+}
+
+// ServeFlags serves Flags on config.FlagsAddr under /flags when
+// ENABLE_FLAGS is true
+func ServeFlags() {
+	if !config.EnableFlags {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/flags", Flags)
+
+	log.Printf("serving feature flags on http://%s/flags", config.FlagsAddr)
+	go func() {
+		if err := http.ListenAndServe(config.FlagsAddr, mux); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("flags server failed: %v", err)
+		}
+	}()
+}
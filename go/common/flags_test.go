@@ -0,0 +1,60 @@
+package common
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFlagStoreServeHTTP(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		body       string
+		wantStatus int
+		want       map[string]bool
+	}{
+		{"list", http.MethodGet, "", http.StatusOK, map[string]bool{"a": false, "b": true}},
+		{"update", http.MethodPost, `{"a": true}`, http.StatusOK, map[string]bool{"a": true, "b": true}},
+		{"unknown flag applies nothing", http.MethodPost, `{"a": true, "nope": true}`, http.StatusBadRequest, map[string]bool{"a": false, "b": true}},
+		{"bad body", http.MethodPost, `{"a": "yes"}`, http.StatusBadRequest, map[string]bool{"a": false, "b": true}},
+		{"other method", http.MethodDelete, "", http.StatusMethodNotAllowed, map[string]bool{"a": false, "b": true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewFlagStore(map[string]bool{"a": false, "b": true})
+			rec := httptest.NewRecorder()
+			store.ServeHTTP(rec, httptest.NewRequest(tt.method, "/flags", strings.NewReader(tt.body)))
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if rec.Code == http.StatusOK {
+				var listed map[string]bool
+				if err := json.Unmarshal(rec.Body.Bytes(), &listed); err != nil {
+					t.Fatalf("decoding response %q: %v", rec.Body, err)
+				}
+				if len(listed) != len(tt.want) {
+					t.Errorf("listed %v, want %v", listed, tt.want)
+				}
+			}
+			for name, want := range tt.want {
+				if got := store.Enabled(name); got != want {
+					t.Errorf("Enabled(%s) = %v, want %v", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFlagStoreSetUnknown(t *testing.T) {
+	store := NewFlagStore(map[string]bool{"a": false})
+	if err := store.Set("nope", true); err == nil {
+		t.Error("Set accepted an unknown flag")
+	}
+	if store.Enabled("nope") {
+		t.Error("unknown flag reads as enabled")
+	}
+}
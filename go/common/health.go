@@ -0,0 +1,161 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"otel-mock/config"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// collectorDialTimeout bounds the TCP dial done by CollectorCheck
+const collectorDialTimeout = time.Second
+
+// HealthCheck reports whether a dependency is usable; a non-nil error makes
+// /readyz fail
+type HealthCheck func(ctx context.Context) error
+
+// Health backs a service's /healthz and /readyz endpoints. /healthz answers
+// 200 as soon as it's mounted; /readyz answers 200 only once MarkReady has
+// been called and every registered check passes.
+type Health struct {
+	ready atomic.Bool
+
+	mu     sync.Mutex
+	checks map[string]HealthCheck
+}
+
+// NewHealth returns a Health that is not yet ready
+func NewHealth() *Health {
+	return &Health{checks: make(map[string]HealthCheck)}
+}
+
+// AddCheck registers a readiness check under name, replacing any existing one
+func (h *Health) AddCheck(name string, check HealthCheck) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks[name] = check
+}
+
+// MarkReady flips /readyz to healthy once startup has finished
+func (h *Health) MarkReady() {
+	h.ready.Store(true)
+}
+
+// Register mounts /healthz and /readyz on mux
+func (h *Health) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"status":"ok"}`))
+	})
+	mux.HandleFunc("/readyz", h.serveReady)
+}
+
+func (h *Health) serveReady(w http.ResponseWriter, r *http.Request) {
+	if !h.ready.Load() {
+		http.Error(w, `{"status":"starting"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	h.mu.Lock()
+	checks := make(map[string]HealthCheck, len(h.checks))
+	for name, check := range h.checks {
+		checks[name] = check
+	}
+	h.mu.Unlock()
+
+	for name, check := range checks {
+		if err := check(r.Context()); err != nil {
+			http.Error(w, fmt.Sprintf(`{"status":"unavailable","check":%q}`, name), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"status":"ready"}`))
+}
+
+// CollectorCheck reports the collector as unavailable when no TCP connection
+// to any OTLP endpoint in use can be opened. It always passes when nothing
+// is exported over OTLP: the SDK is disabled, telemetry goes to stdout, or
+// every signal is off or pulled by Prometheus.
+func CollectorCheck() HealthCheck {
+	return func(ctx context.Context) error {
+		endpoints := collectorEndpoints()
+		if len(endpoints) == 0 {
+			return nil
+		}
+		ctx, cancel := context.WithTimeout(ctx, collectorDialTimeout)
+		defer cancel()
+		var errs []error
+		for _, endpoint := range endpoints {
+			err := dialEndpoint(ctx, endpoint)
+			if err == nil {
+				return nil
+			}
+			errs = append(errs, err)
+		}
+		return fmt.Errorf("collector unreachable: %w", errors.Join(errs...))
+	}
+}
+
+// collectorEndpoints lists, without duplicates, the OTLP endpoints of every
+// signal that is exported over OTLP
+func collectorEndpoints() []string {
+	if config.SDKDisabled || useStdoutExporters() {
+		return nil
+	}
+	var raw []string
+	if config.TracesExporter != exporterNone {
+		raw = append(raw, config.OTLPTracesEndpoint)
+	}
+	if config.MetricsExporter != exporterNone && !usePrometheusExporter() {
+		raw = append(raw, config.OTLPMetricsEndpoint)
+	}
+	if config.LogsExporter != exporterNone {
+		raw = append(raw, config.OTLPLogsEndpoint)
+	}
+
+	var endpoints []string
+	seen := make(map[string]bool)
+	for _, r := range raw {
+		for _, endpoint := range otlpEndpoints(r) {
+			if !seen[endpoint] {
+				seen[endpoint] = true
+				endpoints = append(endpoints, endpoint)
+			}
+		}
+	}
+	return endpoints
+}
+
+// dialEndpoint opens and closes a TCP connection to an OTLP endpoint
+func dialEndpoint(ctx context.Context, endpoint string) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", hostPort(endpoint))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// checkConnectivity dials every OTLP endpoint in use within
+// StartupConnectivityTimeout and logs a warning for each one that can't be
+// reached. Exporters connect lazily, so otherwise a wrong endpoint only
+// shows up as failed exports later. It never fails startup.
+func checkConnectivity(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, config.StartupConnectivityTimeout)
+	defer cancel()
+
+	for _, endpoint := range collectorEndpoints() {
+		if err := dialEndpoint(ctx, endpoint); err != nil {
+			log.Printf("WARNING: OTLP endpoint %s is unreachable, telemetry will not arrive until it is: %v", endpoint, err)
+		} else {
+			log.Printf("OTLP endpoint %s is reachable", endpoint)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package common
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"otel-mock/config"
+	"testing"
+)
+
+// closedAddr returns a local address nothing is listening on
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func TestCollectorCheck(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	open, closed := ln.Addr().String(), closedAddr(t)
+
+	tests := []struct {
+		name     string
+		disabled bool
+		debug    string
+		traces   string
+		metrics  string
+		logs     string
+		endpoint string
+		wantErr  bool
+	}{
+		{name: "collector reachable", endpoint: open},
+		{name: "collector unreachable", endpoint: closed, wantErr: true},
+		{name: "SDK disabled", disabled: true, endpoint: closed},
+		{name: "stdout exporters", debug: "stdout", endpoint: closed},
+		{name: "every signal off", traces: "none", metrics: "none", logs: "none", endpoint: closed},
+		{name: "traces off, prometheus metrics", traces: "none", metrics: "prometheus", logs: "none", endpoint: closed},
+		{name: "traces off, logs over OTLP", traces: "none", metrics: "none", endpoint: closed, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			orOTLP := func(v string) string {
+				if v == "" {
+					return "otlp"
+				}
+				return v
+			}
+			setConfig(t, &config.SDKDisabled, tt.disabled)
+			setConfig(t, &config.DebugExporter, tt.debug)
+			setConfig(t, &config.TracesExporter, orOTLP(tt.traces))
+			setConfig(t, &config.MetricsExporter, orOTLP(tt.metrics))
+			setConfig(t, &config.LogsExporter, orOTLP(tt.logs))
+			setConfig(t, &config.OTLPTracesEndpoint, tt.endpoint)
+			setConfig(t, &config.OTLPMetricsEndpoint, tt.endpoint)
+			setConfig(t, &config.OTLPLogsEndpoint, tt.endpoint)
+
+			err := CollectorCheck()(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CollectorCheck() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestKafkaCheckUnreachable(t *testing.T) {
+	if err := KafkaCheck([]string{closedAddr(t)}, "orders")(context.Background()); err == nil {
+		t.Error("KafkaCheck passed with no broker listening")
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	h := NewHealth()
+	mux := http.NewServeMux()
+	h.Register(mux)
+
+	status := func() int {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return rec.Code
+	}
+
+	if got := status(); got != http.StatusServiceUnavailable {
+		t.Errorf("/readyz before MarkReady = %d, want 503", got)
+	}
+	h.MarkReady()
+	if got := status(); got != http.StatusOK {
+		t.Errorf("/readyz after MarkReady = %d, want 200", got)
+	}
+	h.AddCheck("kafka", KafkaCheck([]string{closedAddr(t)}, "orders"))
+	if got := status(); got != http.StatusServiceUnavailable {
+		t.Errorf("/readyz with Kafka down = %d, want 503", got)
+	}
+}
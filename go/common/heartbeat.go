@@ -0,0 +1,40 @@
+package common
+
+import (
+	"context"
+	"time"
+
+	"otel-mock/config"
+
+	otellog "go.opentelemetry.io/otel/log"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// StartHeartbeat logs a heartbeat for service through lp and increments
+// service.heartbeat every config.HeartbeatInterval until ctx is cancelled,
+// so an idle service still shows its logs and metrics are flowing.
+func StartHeartbeat(ctx context.Context, service string, mp metric.MeterProvider, lp otellog.LoggerProvider) {
+	beats, err := mp.Meter(service).Int64Counter("service.heartbeat",
+		metric.WithDescription("Heartbeats emitted by the service while it is running"),
+		metric.WithUnit("{heartbeat}"))
+	logger := NewLogger(service, lp)
+	if err != nil {
+		logger.Error("Failed to create service.heartbeat counter, not starting heartbeat", "error", err)
+		return
+	}
+	started := time.Now()
+
+	go func() {
+		ticker := time.NewTicker(config.HeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				beats.Add(ctx, 1)
+				logger.InfoContext(ctx, "heartbeat", "uptime_s", int64(time.Since(started).Seconds()))
+			}
+		}
+	}()
+}
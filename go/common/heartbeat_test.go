@@ -0,0 +1,74 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"otel-mock/config"
+	"testing"
+	"time"
+
+	lognoop "go.opentelemetry.io/otel/log/noop"
+	"go.opentelemetry.io/otel/metric"
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// sumValue returns the value of the int64 sum named name, or -1 when it
+// hasn't been reported
+func sumValue(t *testing.T, reader *sdkmetric.ManualReader, name string) int64 {
+	t.Helper()
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != name {
+				continue
+			}
+			var total int64
+			for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+				total += dp.Value
+			}
+			return total
+		}
+	}
+	return -1
+}
+
+func TestStartHeartbeat(t *testing.T) {
+	setConfig(t, &config.HeartbeatInterval, 5*time.Millisecond)
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	StartHeartbeat(ctx, "cart", mp, lognoop.NewLoggerProvider())
+
+	deadline := time.Now().Add(time.Second)
+	for sumValue(t, reader, "service.heartbeat") < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("service.heartbeat did not reach 2 within a second")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// failingMeterProvider hands out meters whose counters can't be created
+type failingMeterProvider struct{ metricnoop.MeterProvider }
+
+func (failingMeterProvider) Meter(string, ...metric.MeterOption) metric.Meter {
+	return failingMeter{}
+}
+
+type failingMeter struct{ metricnoop.Meter }
+
+func (failingMeter) Int64Counter(string, ...metric.Int64CounterOption) (metric.Int64Counter, error) {
+	return nil, errors.New("instrument rejected")
+}
+
+func TestStartHeartbeatCounterError(t *testing.T) {
+	// Must log and return rather than panic
+	StartHeartbeat(context.Background(), "cart", failingMeterProvider{}, lognoop.NewLoggerProvider())
+}
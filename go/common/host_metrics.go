@@ -0,0 +1,120 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/shirou/gopsutil/v3/load"
+	"github.com/shirou/gopsutil/v3/mem"
+	"github.com/shirou/gopsutil/v3/net"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+var (
+	memoryStateUsed = metric.WithAttributes(attribute.String("state", "used"))
+	memoryStateFree = metric.WithAttributes(attribute.String("state", "free"))
+)
+
+// startHostMetrics registers load-average, memory, disk and network
+// instruments. Errors name the instrument that failed.
+func startHostMetrics(mp *sdkmetric.MeterProvider) error {
+	meter := mp.Meter("host-metrics")
+
+	var errs []error
+	check := func(name string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+
+	// Probe once so hosts without load averages (some containers, Windows)
+	// get no load gauges instead of gauges that never observe
+	var loadAvg1m, loadAvg5m, loadAvg15m metric.Float64ObservableGauge
+	_, loadErr := load.Avg()
+	if loadErr == nil {
+		log.Printf("host metrics: load averages supported, registering system.cpu.load_average.*")
+		var err error
+		loadAvg15m, err = meter.Float64ObservableGauge("system.cpu.load_average.15m",
+			metric.WithDescription("15-minute CPU load average"), metric.WithUnit("1"))
+		check("system.cpu.load_average.15m", err)
+		loadAvg1m, err = meter.Float64ObservableGauge("system.cpu.load_average.1m",
+			metric.WithDescription("1-minute CPU load average"), metric.WithUnit("1"))
+		check("system.cpu.load_average.1m", err)
+		loadAvg5m, err = meter.Float64ObservableGauge("system.cpu.load_average.5m",
+			metric.WithDescription("5-minute CPU load average"), metric.WithUnit("1"))
+		check("system.cpu.load_average.5m", err)
+	} else {
+		log.Printf("host metrics: load averages unavailable on this host (%v), skipping system.cpu.load_average.*", loadErr)
+	}
+
+	memUsage, err := meter.Int64ObservableGauge("system.memory.usage",
+		metric.WithDescription("Memory in use by state"), metric.WithUnit("By"))
+	check("system.memory.usage", err)
+	memUtilization, err := meter.Float64ObservableGauge("system.memory.utilization",
+		metric.WithDescription("Fraction of memory in use by state"), metric.WithUnit("1"))
+	check("system.memory.utilization", err)
+
+	diskIO, err := meter.Int64ObservableCounter("system.disk.io",
+		metric.WithDescription("Disk bytes transferred by device and direction"), metric.WithUnit("By"))
+	check("system.disk.io", err)
+
+	networkIO, err := meter.Int64ObservableCounter("system.network.io",
+		metric.WithDescription("Network bytes transferred by interface and direction"), metric.WithUnit("By"))
+	check("system.network.io", err)
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	instruments := []metric.Observable{memUsage, memUtilization, diskIO, networkIO}
+	if loadErr == nil {
+		instruments = append(instruments, loadAvg1m, loadAvg5m, loadAvg15m)
+	}
+
+	// Register callback for load averages, memory, disk and network
+	_, err = meter.RegisterCallback(
+		func(ctx context.Context, observer metric.Observer) error {
+			if loadErr == nil {
+				if loadAvg, err := load.Avg(); err == nil {
+					observer.ObserveFloat64(loadAvg1m, loadAvg.Load1)
+					observer.ObserveFloat64(loadAvg5m, loadAvg.Load5)
+					observer.ObserveFloat64(loadAvg15m, loadAvg.Load15)
+				}
+			}
+			if vm, err := mem.VirtualMemory(); err == nil && vm.Total > 0 {
+				observer.ObserveInt64(memUsage, int64(vm.Used), memoryStateUsed)
+				observer.ObserveInt64(memUsage, int64(vm.Free), memoryStateFree)
+				observer.ObserveFloat64(memUtilization, float64(vm.Used)/float64(vm.Total), memoryStateUsed)
+				observer.ObserveFloat64(memUtilization, float64(vm.Free)/float64(vm.Total), memoryStateFree)
+			}
+			if counters, err := disk.IOCounters(); err == nil {
+				for device, c := range counters {
+					observer.ObserveInt64(diskIO, int64(c.ReadBytes), metric.WithAttributes(
+						attribute.String("device", device), attribute.String("direction", "read")))
+					observer.ObserveInt64(diskIO, int64(c.WriteBytes), metric.WithAttributes(
+						attribute.String("device", device), attribute.String("direction", "write")))
+				}
+			}
+			// Skip the cycle on error; counters resume on the next collection
+			if counters, err := net.IOCounters(true); err == nil {
+				for _, c := range counters {
+					observer.ObserveInt64(networkIO, int64(c.BytesRecv), metric.WithAttributes(
+						attribute.String("device", c.Name), attribute.String("direction", "receive")))
+					observer.ObserveInt64(networkIO, int64(c.BytesSent), metric.WithAttributes(
+						attribute.String("device", c.Name), attribute.String("direction", "transmit")))
+				}
+			}
+			return nil
+		},
+		instruments...,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to register host metrics callback: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package common
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// collectMetrics runs one collection on reader and indexes it by name
+func collectMetrics(t *testing.T, reader *sdkmetric.ManualReader) map[string]metricdata.Metrics {
+	t.Helper()
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	metrics := make(map[string]metricdata.Metrics)
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			metrics[m.Name] = m
+		}
+	}
+	return metrics
+}
+
+// byState indexes gauge data points by their state attribute
+func byState[N int64 | float64](t *testing.T, m metricdata.Metrics) map[string]N {
+	t.Helper()
+	gauge, ok := m.Data.(metricdata.Gauge[N])
+	if !ok {
+		t.Fatalf("%s is a %T, want a gauge", m.Name, m.Data)
+	}
+	values := make(map[string]N)
+	for _, dp := range gauge.DataPoints {
+		state, _ := dp.Attributes.Value(attribute.Key("state"))
+		values[state.AsString()] = dp.Value
+	}
+	return values
+}
+
+func TestHostMetricsMemory(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	defer mp.Shutdown(context.Background())
+	if err := startHostMetrics(mp); err != nil {
+		t.Fatal(err)
+	}
+	metrics := collectMetrics(t, reader)
+
+	usage, ok := metrics["system.memory.usage"]
+	if !ok {
+		t.Fatal("system.memory.usage was not reported")
+	}
+	bytes := byState[int64](t, usage)
+	if bytes["used"] <= 0 || bytes["free"] <= 0 {
+		t.Errorf("system.memory.usage = %v, want positive used and free", bytes)
+	}
+
+	utilization, ok := metrics["system.memory.utilization"]
+	if !ok {
+		t.Fatal("system.memory.utilization was not reported")
+	}
+	ratios := byState[float64](t, utilization)
+	used, free := ratios["used"], ratios["free"]
+	if used <= 0 || free <= 0 || used+free > 1 {
+		t.Errorf("system.memory.utilization = %v, want used and free in (0, 1] summing to at most 1", ratios)
+	}
+}
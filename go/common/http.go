@@ -0,0 +1,118 @@
+package common
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// traceIDHeader carries the server span's trace ID on responses
+const traceIDHeader = "X-Trace-Id"
+
+// untracedPaths are probe endpoints that would otherwise flood traces
+var untracedPaths = map[string]bool{
+	"/health":  true,
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+// NewHTTPClient returns a client for inter-service calls. Its transport
+// starts a CLIENT span per request on tp and injects traceparent and baggage
+// with the global propagator, so the callee's spans join the caller's trace.
+// It also records http.client.request.duration on mp. A zero timeout means
+// none.
+func NewHTTPClient(tp trace.TracerProvider, mp metric.MeterProvider, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: otelhttp.NewTransport(
+			http.DefaultTransport,
+			otelhttp.WithTracerProvider(tp),
+			otelhttp.WithMeterProvider(mp),
+			otelhttp.WithPropagators(otel.GetTextMapPropagator()),
+		),
+	}
+}
+
+// SetSpanStatusFromHTTP records statusCode on a client span and marks the
+// span as an error for 5xx responses. A 4xx is the caller's mistake rather
+// than a fault in the dependency, so it leaves the status unset.
+func SetSpanStatusFromHTTP(span trace.Span, statusCode int) {
+	span.SetAttributes(semconv.HTTPResponseStatusCode(statusCode))
+	if statusCode >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, fmt.Sprintf("HTTP %d", statusCode))
+	}
+}
+
+// NewServerHandler wraps mux so every inbound request extracts the caller's
+// trace context and gets a SERVER span with http.route, status code and
+// duration. Spans are named operations[route] when the matched route has an
+// entry, otherwise "METHOD route", and sampled responses carry X-Trace-Id.
+// The http.server.* request metrics go to mp. Health probes are neither
+// traced nor measured.
+func NewServerHandler(mux *http.ServeMux, service string, tp trace.TracerProvider, mp metric.MeterProvider, operations map[string]string) http.Handler {
+	// otelhttp only records the route on metrics, so add it to the span once
+	// the mux has matched one. Sampled requests also get their trace ID back
+	// in X-Trace-Id, for looking the trace up by hand.
+	routed := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() && sc.IsSampled() {
+			w.Header().Set(traceIDHeader, sc.TraceID().String())
+		}
+		mux.ServeHTTP(w, r)
+		if r.Pattern != "" {
+			trace.SpanFromContext(r.Context()).SetAttributes(semconv.HTTPRoute(r.Pattern))
+		}
+	})
+
+	handler := otelhttp.NewHandler(routed, service,
+		otelhttp.WithTracerProvider(tp),
+		otelhttp.WithMeterProvider(mp),
+		otelhttp.WithFilter(func(r *http.Request) bool {
+			return !untracedPaths[r.URL.Path]
+		}),
+		otelhttp.WithSpanNameFormatter(func(operation string, r *http.Request) string {
+			// Pattern is only known once the mux has routed the request
+			if r.Pattern == "" {
+				return operation
+			}
+			if name, ok := operations[r.Pattern]; ok {
+				return name
+			}
+			return r.Method + " " + r.Pattern
+		}),
+	)
+	return countActiveRequests(handler, service, mp)
+}
+
+// countActiveRequests tracks http.server.active_requests around handler,
+// which otelhttp doesn't report itself
+func countActiveRequests(handler http.Handler, service string, mp metric.MeterProvider) http.Handler {
+	active, err := mp.Meter(service).Int64UpDownCounter("http.server.active_requests",
+		metric.WithDescription("Number of active HTTP server requests"),
+		metric.WithUnit("{request}"))
+	if err != nil {
+		log.Printf("failed to create http.server.active_requests: %v", err)
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if untracedPaths[r.URL.Path] {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		attrs := metric.WithAttributes(semconv.HTTPRequestMethodKey.String(r.Method), semconv.URLScheme(scheme))
+		active.Add(r.Context(), 1, attrs)
+		defer active.Add(r.Context(), -1, attrs)
+		handler.ServeHTTP(w, r)
+	})
+}
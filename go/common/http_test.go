@@ -0,0 +1,154 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/trace"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestNewServerHandler(t *testing.T) {
+	old := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTextMapPropagator(old) })
+
+	tp, exporter := NewInMemoryTracerProvider()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/consume", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/orders/{id}", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {})
+	ts := httptest.NewServer(NewServerHandler(mux, "test", tp, metricnoop.NewMeterProvider(), map[string]string{"/consume": "orders receive"}))
+	t.Cleanup(ts.Close)
+
+	const traceparent = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	tests := []struct {
+		path      string
+		wantName  string
+		wantRoute string
+	}{
+		{"/consume", "orders receive", "/consume"},
+		{"/orders/42", "GET /orders/{id}", "/orders/{id}"},
+		{"/health", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			exporter.Reset()
+			req, _ := http.NewRequest(http.MethodGet, ts.URL+tt.path, nil)
+			req.Header.Set("traceparent", traceparent)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			spans := exporter.GetSpans()
+			if tt.wantName == "" {
+				if len(spans) != 0 {
+					t.Errorf("health probe produced %d spans, want none", len(spans))
+				}
+				return
+			}
+			if len(spans) != 1 {
+				t.Fatalf("got %d spans, want 1", len(spans))
+			}
+			s := spans[0]
+			if s.Name != tt.wantName || s.SpanKind != trace.SpanKindServer {
+				t.Errorf("span = %q (%v), want %q (server)", s.Name, s.SpanKind, tt.wantName)
+			}
+			if got := s.SpanContext.TraceID().String(); got != "0af7651916cd43dd8448eb211c80319c" {
+				t.Errorf("trace ID = %s, want the incoming traceparent's", got)
+			}
+			if !s.Parent.IsRemote() || s.Parent.SpanID().String() != "b7ad6b7169203331" {
+				t.Errorf("parent = %s (remote %v), want the incoming span", s.Parent.SpanID(), s.Parent.IsRemote())
+			}
+			if route, _ := spanAttr(s, attribute.Key("http.route")); route.AsString() != tt.wantRoute {
+				t.Errorf("http.route = %q, want %q", route.AsString(), tt.wantRoute)
+			}
+			if got := resp.Header.Get("X-Trace-Id"); got != s.SpanContext.TraceID().String() {
+				t.Errorf("X-Trace-Id = %q, want %s", got, s.SpanContext.TraceID())
+			}
+		})
+	}
+}
+
+func TestHTTPMetrics(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	defer mp.Shutdown(context.Background())
+	tp := tracenoop.NewTracerProvider()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/checkout", func(w http.ResponseWriter, r *http.Request) {})
+	ts := httptest.NewServer(NewServerHandler(mux, "test", tp, mp, nil))
+	t.Cleanup(ts.Close)
+
+	resp, err := NewHTTPClient(tp, mp, time.Second).Get(ts.URL + "/checkout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	metrics := collectMetrics(t, reader)
+	for _, name := range []string{"http.server.request.duration", "http.client.request.duration"} {
+		m, ok := metrics[name]
+		if !ok {
+			t.Errorf("%s was not recorded", name)
+			continue
+		}
+		var count uint64
+		for _, dp := range m.Data.(metricdata.Histogram[float64]).DataPoints {
+			count += dp.Count
+		}
+		if count != 1 {
+			t.Errorf("%s count = %d, want 1", name, count)
+		}
+	}
+	if _, ok := metrics["http.server.active_requests"]; !ok {
+		t.Error("http.server.active_requests was not recorded")
+	}
+}
+
+func TestSetSpanStatusFromHTTP(t *testing.T) {
+	tests := []struct {
+		status int
+		want   codes.Code
+	}{
+		{http.StatusOK, codes.Unset},
+		{http.StatusNoContent, codes.Unset},
+		{http.StatusMovedPermanently, codes.Unset},
+		{http.StatusBadRequest, codes.Unset},
+		{http.StatusNotFound, codes.Unset},
+		{http.StatusTooManyRequests, codes.Unset},
+		{http.StatusInternalServerError, codes.Error},
+		{http.StatusBadGateway, codes.Error},
+		{http.StatusServiceUnavailable, codes.Error},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			tp, exporter := NewInMemoryTracerProvider()
+			defer tp.Shutdown(context.Background())
+			_, span := tp.Tracer("test").Start(context.Background(), "call", trace.WithSpanKind(trace.SpanKindClient))
+			SetSpanStatusFromHTTP(span, tt.status)
+			span.End()
+
+			s := exporter.GetSpans()[0]
+			if s.Status.Code != tt.want {
+				t.Errorf("status for %d = %v, want %v", tt.status, s.Status.Code, tt.want)
+			}
+			if v, _ := spanAttr(s, "http.response.status_code"); v.AsInt64() != int64(tt.status) {
+				t.Errorf("http.response.status_code = %v, want %d", v.Emit(), tt.status)
+			}
+		})
+	}
+}
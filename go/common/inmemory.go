@@ -0,0 +1,19 @@
+package common
+
+import (
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// NewInMemoryTracerProvider returns a tracer provider that records every span
+// into the returned exporter, for driving a service's handlers in tests and
+// asserting on exporter.GetSpans(). Spans are exported synchronously as they
+// end, so no flush is needed before reading them.
+func NewInMemoryTracerProvider() (*sdktrace.TracerProvider, *tracetest.InMemoryExporter) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithSampler(sdktrace.AlwaysSample()),
+		sdktrace.WithSyncer(exporter),
+	)
+	return tp, exporter
+}
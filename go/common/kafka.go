@@ -0,0 +1,295 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// KafkaHeaderCarrier adapts a Kafka message's headers to a
+// propagation.TextMapCarrier, so traceparent and baggage travel with the
+// message
+type KafkaHeaderCarrier struct {
+	Headers *[]kafka.Header
+}
+
+var _ propagation.TextMapCarrier = KafkaHeaderCarrier{}
+
+func (c KafkaHeaderCarrier) Get(key string) string {
+	for _, h := range *c.Headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+func (c KafkaHeaderCarrier) Set(key, value string) {
+	for i, h := range *c.Headers {
+		if h.Key == key {
+			(*c.Headers)[i].Value = []byte(value)
+			return
+		}
+	}
+	*c.Headers = append(*c.Headers, kafka.Header{Key: key, Value: []byte(value)})
+}
+
+func (c KafkaHeaderCarrier) Keys() []string {
+	keys := make([]string, len(*c.Headers))
+	for i, h := range *c.Headers {
+		keys[i] = h.Key
+	}
+	return keys
+}
+
+// KafkaProducer publishes messages with the caller's trace context injected
+// into their headers. It doesn't start spans; callers wrap Publish in their
+// own PRODUCER span.
+type KafkaProducer struct {
+	writer *kafka.Writer
+}
+
+// NewKafkaProducer returns a producer for brokers. Topics are created on
+// first use.
+func NewKafkaProducer(brokers []string) *KafkaProducer {
+	return &KafkaProducer{writer: &kafka.Writer{
+		Addr:                   kafka.TCP(brokers...),
+		Balancer:               &kafka.LeastBytes{},
+		RequiredAcks:           kafka.RequireOne,
+		AllowAutoTopicCreation: true,
+		// Publish is synchronous, so don't hold each order for a full batch
+		BatchTimeout: 10 * time.Millisecond,
+	}}
+}
+
+// Publish writes one message to topic and waits for the broker to ack it.
+// headers are sent alongside the trace context.
+func (p *KafkaProducer) Publish(ctx context.Context, topic string, key, value []byte, headers ...kafka.Header) error {
+	msg := kafka.Message{Topic: topic, Key: key, Value: value, Headers: headers}
+	otel.GetTextMapPropagator().Inject(ctx, KafkaHeaderCarrier{&msg.Headers})
+	return p.writer.WriteMessages(ctx, msg)
+}
+
+// Close flushes pending writes and closes broker connections
+func (p *KafkaProducer) Close() error {
+	return p.writer.Close()
+}
+
+// commitTimeout bounds each offset commit, including the last one made
+// after ctx is cancelled
+const commitTimeout = 5 * time.Second
+
+// Failed fetches are retried after a backoff doubling from
+// fetchInitialBackoff up to fetchMaxBackoff, reset by the next success
+const (
+	fetchInitialBackoff = 250 * time.Millisecond
+	fetchMaxBackoff     = 10 * time.Second
+)
+
+// kafkaCheckTimeout bounds the metadata request made by KafkaCheck
+const kafkaCheckTimeout = 2 * time.Second
+
+// KafkaCheck reports Kafka as unavailable unless one of brokers answers a
+// metadata request for topic. A topic that doesn't exist yet still passes,
+// since it's created on first publish.
+func KafkaCheck(brokers []string, topic string) HealthCheck {
+	client := &kafka.Client{Addr: kafka.TCP(brokers...), Timeout: kafkaCheckTimeout}
+	return func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, kafkaCheckTimeout)
+		defer cancel()
+		if _, err := client.Metadata(ctx, &kafka.MetadataRequest{Topics: []string{topic}}); err != nil {
+			return fmt.Errorf("kafka unreachable: %w", err)
+		}
+		return nil
+	}
+}
+
+// ErrRedeliver, wrapped in a handler's error, tells KafkaConsumer.Run to
+// leave the message uncommitted and stop, so the group fetches it again once
+// the consumer restarts. Run can't carry on past it: committing any later
+// message would commit this one too.
+var ErrRedeliver = errors.New("message left uncommitted for redelivery")
+
+// messageReader is the part of *kafka.Reader KafkaConsumer uses
+type messageReader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// KafkaConsumer reads a topic as a member of a consumer group. Each message
+// is handled inside a CONSUMER span that continues the producer's trace.
+type KafkaConsumer struct {
+	reader messageReader
+	client *kafka.Client
+	tracer trace.Tracer
+	topic  string
+	group  string
+}
+
+// NewKafkaConsumer returns a consumer for topic on brokers in group
+func NewKafkaConsumer(brokers []string, topic, group string, tp trace.TracerProvider) *KafkaConsumer {
+	return &KafkaConsumer{
+		reader: kafka.NewReader(kafka.ReaderConfig{
+			Brokers: brokers,
+			Topic:   topic,
+			GroupID: group,
+		}),
+		client: &kafka.Client{Addr: kafka.TCP(brokers...), Timeout: 5 * time.Second},
+		tracer: tp.Tracer("kafka-consumer"),
+		topic:  topic,
+		group:  group,
+	}
+}
+
+// RegisterLag reports kafka.consumer.lag on meter: per partition, the
+// distance between the high-water mark and the group's committed offset.
+// Partitions without a committed offset yet are skipped, as is the whole
+// observation while the brokers can't be reached.
+func (c *KafkaConsumer) RegisterLag(meter metric.Meter) error {
+	_, err := meter.Int64ObservableGauge("kafka.consumer.lag",
+		metric.WithDescription("Messages not yet committed by the consumer group"),
+		metric.WithUnit("{message}"),
+		metric.WithInt64Callback(c.observeLag))
+	return err
+}
+
+func (c *KafkaConsumer) observeLag(ctx context.Context, o metric.Int64Observer) error {
+	meta, err := c.client.Metadata(ctx, &kafka.MetadataRequest{Topics: []string{c.topic}})
+	if err != nil || len(meta.Topics) == 0 || meta.Topics[0].Error != nil {
+		return nil
+	}
+	partitions := make([]int, len(meta.Topics[0].Partitions))
+	lastOffsets := make([]kafka.OffsetRequest, len(partitions))
+	for i, p := range meta.Topics[0].Partitions {
+		partitions[i] = p.ID
+		lastOffsets[i] = kafka.LastOffsetOf(p.ID)
+	}
+
+	committed, err := c.client.OffsetFetch(ctx, &kafka.OffsetFetchRequest{
+		GroupID: c.group,
+		Topics:  map[string][]int{c.topic: partitions},
+	})
+	if err != nil || committed.Error != nil {
+		return nil
+	}
+	highWater, err := c.client.ListOffsets(ctx, &kafka.ListOffsetsRequest{
+		Topics: map[string][]kafka.OffsetRequest{c.topic: lastOffsets},
+	})
+	if err != nil {
+		return nil
+	}
+
+	last := make(map[int]int64)
+	for _, p := range highWater.Topics[c.topic] {
+		if p.Error == nil {
+			last[p.Partition] = p.LastOffset
+		}
+	}
+	for _, p := range committed.Topics[c.topic] {
+		hwm, ok := last[p.Partition]
+		if p.Error != nil || p.CommittedOffset < 0 || !ok {
+			continue
+		}
+		o.Observe(max(hwm-p.CommittedOffset, 0), metric.WithAttributes(
+			attribute.String("messaging.destination.name", c.topic),
+			attribute.String("messaging.destination.partition.id", strconv.Itoa(p.Partition)),
+			attribute.String("messaging.consumer.group.name", c.group),
+		))
+	}
+	return nil
+}
+
+// Run hands each message to handle and commits it afterwards, so a message
+// is redelivered if the process dies mid-handling. A failed fetch, e.g.
+// while the brokers are down, is logged and retried with backoff. A handler
+// error still commits the message unless it wraps ErrRedeliver, which Run
+// returns without committing. It returns nil once ctx is cancelled; a
+// message already being handled then is still committed, so a graceful
+// shutdown doesn't replay it.
+func (c *KafkaConsumer) Run(ctx context.Context, handle func(context.Context, kafka.Message) error) error {
+	backoff := fetchInitialBackoff
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+
+		msg, err := c.reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			log.Printf("kafka: fetching from %s failed, retrying in %v: %v", c.topic, backoff, err)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, fetchMaxBackoff)
+			continue
+		}
+		backoff = fetchInitialBackoff
+
+		if err := c.handle(ctx, msg, handle); errors.Is(err, ErrRedeliver) {
+			log.Printf("kafka: leaving %s/%d@%d uncommitted: %v", msg.Topic, msg.Partition, msg.Offset, err)
+			return err
+		}
+
+		if err := c.commit(ctx, msg); err != nil {
+			log.Printf("kafka: committing %s/%d@%d failed: %v", msg.Topic, msg.Partition, msg.Offset, err)
+		}
+	}
+}
+
+// commit commits msg's offset even if ctx has just been cancelled, giving
+// up after commitTimeout
+func (c *KafkaConsumer) commit(ctx context.Context, msg kafka.Message) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), commitTimeout)
+	defer cancel()
+	return c.reader.CommitMessages(ctx, msg)
+}
+
+// handle runs handle for msg inside its CONSUMER span and returns the
+// handler's error
+func (c *KafkaConsumer) handle(ctx context.Context, msg kafka.Message, handle func(context.Context, kafka.Message) error) error {
+	ctx = otel.GetTextMapPropagator().Extract(ctx, KafkaHeaderCarrier{&msg.Headers})
+	// The producer is also the parent; the link marks it as the message's
+	// creation context, as the messaging conventions ask
+	ctx, span := c.tracer.Start(ctx, msg.Topic+" receive",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithLinks(trace.LinkFromContext(ctx)),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "kafka"),
+			attribute.String("messaging.destination.name", msg.Topic),
+			attribute.String("messaging.operation.type", "receive"),
+			attribute.String("messaging.consumer.group.name", c.group),
+			attribute.String("messaging.kafka.destination.partition", strconv.Itoa(msg.Partition)),
+			attribute.Int64("messaging.kafka.message.offset", msg.Offset),
+		))
+	defer span.End()
+
+	err := handle(ctx, msg)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+// Close leaves the consumer group and closes broker connections
+func (c *KafkaConsumer) Close() error {
+	return c.reader.Close()
+}
@@ -0,0 +1,214 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// fakeReader serves queued fetch results in order, then blocks until ctx is
+// done, recording the offsets committed. Like the real reader it refuses to
+// commit under a cancelled context.
+type fakeReader struct {
+	mu        sync.Mutex
+	fetches   []fakeFetch
+	committed []int64
+	closed    bool
+}
+
+type fakeFetch struct {
+	msg kafka.Message
+	err error
+}
+
+func (r *fakeReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	r.mu.Lock()
+	if len(r.fetches) > 0 {
+		f := r.fetches[0]
+		r.fetches = r.fetches[1:]
+		r.mu.Unlock()
+		return f.msg, f.err
+	}
+	r.mu.Unlock()
+	<-ctx.Done()
+	return kafka.Message{}, ctx.Err()
+}
+
+func (r *fakeReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, m := range msgs {
+		r.committed = append(r.committed, m.Offset)
+	}
+	return nil
+}
+
+func (r *fakeReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	return nil
+}
+
+func (r *fakeReader) commits() []int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]int64(nil), r.committed...)
+}
+
+func newFakeConsumer(messages ...kafka.Message) (*KafkaConsumer, *fakeReader) {
+	reader := &fakeReader{}
+	for _, m := range messages {
+		reader.fetches = append(reader.fetches, fakeFetch{msg: m})
+	}
+	return &KafkaConsumer{
+		reader: reader,
+		tracer: noop.NewTracerProvider().Tracer("test"),
+		topic:  "orders",
+		group:  "test",
+	}, reader
+}
+
+func TestKafkaConsumerRedeliver(t *testing.T) {
+	consumer, reader := newFakeConsumer(
+		kafka.Message{Topic: "orders", Offset: 1},
+		kafka.Message{Topic: "orders", Offset: 2},
+		kafka.Message{Topic: "orders", Offset: 3},
+		kafka.Message{Topic: "orders", Offset: 4},
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err := consumer.Run(ctx, func(_ context.Context, msg kafka.Message) error {
+		switch msg.Offset {
+		case 2:
+			return errors.New("handler failed")
+		case 3:
+			return fmt.Errorf("%w: dead-lettering failed", ErrRedeliver)
+		}
+		return nil
+	})
+	if !errors.Is(err, ErrRedeliver) {
+		t.Fatalf("Run = %v, want ErrRedeliver", err)
+	}
+	// A plain handler error is still committed; the redelivery stops Run
+	// before anything past it is
+	if got := reader.commits(); fmt.Sprint(got) != "[1 2]" {
+		t.Errorf("committed offsets = %v, want [1 2]", got)
+	}
+}
+
+func TestKafkaConsumerRetriesFetchErrors(t *testing.T) {
+	consumer, reader := newFakeConsumer()
+	reader.fetches = []fakeFetch{
+		{err: errors.New("broker unreachable")},
+		{msg: kafka.Message{Topic: "orders", Offset: 1}},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handled := make(chan int64, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- consumer.Run(ctx, func(_ context.Context, msg kafka.Message) error {
+			handled <- msg.Offset
+			return nil
+		})
+	}()
+
+	select {
+	case offset := <-handled:
+		if offset != 1 {
+			t.Errorf("handled offset %d, want 1", offset)
+		}
+	case err := <-done:
+		t.Fatalf("Run returned %v after a fetch error, want it to retry", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message after the fetch error was never handled")
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Run after cancel = %v, want nil", err)
+	}
+	if got := reader.commits(); fmt.Sprint(got) != "[1]" {
+		t.Errorf("committed offsets = %v, want [1]", got)
+	}
+}
+
+func TestKafkaConsumerLinksProducer(t *testing.T) {
+	old := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTextMapPropagator(old) })
+
+	tp, exporter := NewInMemoryTracerProvider()
+	defer tp.Shutdown(context.Background())
+	producerCtx, producer := tp.Tracer("test").Start(context.Background(), "orders publish")
+	producer.End()
+	msg := kafka.Message{Topic: "orders", Offset: 1}
+	otel.GetTextMapPropagator().Inject(producerCtx, KafkaHeaderCarrier{&msg.Headers})
+
+	consumer, _ := newFakeConsumer(msg)
+	consumer.tracer = tp.Tracer("consumer")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	consumer.Run(ctx, func(context.Context, kafka.Message) error {
+		cancel()
+		return nil
+	})
+
+	for _, s := range exporter.GetSpans() {
+		if s.Name != "orders receive" {
+			continue
+		}
+		if len(s.Links) != 1 || !s.Links[0].SpanContext.Equal(producer.SpanContext().WithRemote(true)) {
+			t.Errorf("orders receive links = %+v, want one link to the producer %s", s.Links, producer.SpanContext().SpanID())
+		}
+		return
+	}
+	t.Error("no orders receive span")
+}
+
+// A shutdown arriving mid-message still commits that message, then Close
+// releases the reader
+func TestKafkaConsumerCommitsOnShutdown(t *testing.T) {
+	consumer, reader := newFakeConsumer(
+		kafka.Message{Topic: "orders", Offset: 5},
+		kafka.Message{Topic: "orders", Offset: 6},
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var handled []int64
+	err := consumer.Run(ctx, func(_ context.Context, msg kafka.Message) error {
+		handled = append(handled, msg.Offset)
+		cancel()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Run after cancel = %v, want nil", err)
+	}
+	if fmt.Sprint(handled) != "[5]" {
+		t.Errorf("handled offsets = %v, want only [5] after shutdown", handled)
+	}
+	if got := reader.commits(); fmt.Sprint(got) != "[5]" {
+		t.Errorf("committed offsets = %v, want [5]", got)
+	}
+
+	if err := consumer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !reader.closed {
+		t.Error("Close did not close the reader")
+	}
+}
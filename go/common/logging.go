@@ -0,0 +1,67 @@
+package common
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"otel-mock/config"
+	"strings"
+
+	"go.opentelemetry.io/contrib/bridges/otelslog"
+	otellog "go.opentelemetry.io/otel/log"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// NewLogger returns an slog.Logger whose records are exported through lp
+// under the instrumentation scope name. Records logged with a *Context method
+// inside a span are linked to it and also carry trace_id and span_id
+// attributes, for backends and log views that only look at attributes.
+// Records below the service's configured level (see config.LogLevel) are
+// dropped before they reach lp.
+func NewLogger(name string, lp otellog.LoggerProvider) *slog.Logger {
+	return slog.New(traceContextHandler{
+		Handler: otelslog.NewHandler(name, otelslog.WithLoggerProvider(lp)),
+		level:   parseLogLevel(name, config.LogLevel(name)),
+	})
+}
+
+func parseLogLevel(name, v string) slog.Level {
+	var level slog.Level
+	if strings.EqualFold(v, "warning") {
+		v = "warn"
+	}
+	if err := level.UnmarshalText([]byte(v)); err != nil {
+		log.Printf("%s: invalid log level %q, using info", name, v)
+		return slog.LevelInfo
+	}
+	return level
+}
+
+// traceContextHandler adds the active span's IDs to each record and drops
+// records below level
+type traceContextHandler struct {
+	slog.Handler
+	level slog.Level
+}
+
+func (h traceContextHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	return l >= h.level && h.Handler.Enabled(ctx, l)
+}
+
+func (h traceContextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(
+			slog.String("trace_id", sc.TraceID().String()),
+			slog.String("span_id", sc.SpanID().String()),
+		)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h traceContextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return traceContextHandler{h.Handler.WithAttrs(attrs), h.level}
+}
+
+func (h traceContextHandler) WithGroup(name string) slog.Handler {
+	return traceContextHandler{h.Handler.WithGroup(name), h.level}
+}
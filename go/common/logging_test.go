@@ -0,0 +1,107 @@
+package common
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel/log"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+)
+
+// recordingProcessor keeps every record emitted through it
+type recordingProcessor struct {
+	mu      sync.Mutex
+	records []sdklog.Record
+}
+
+func (p *recordingProcessor) Enabled(context.Context, sdklog.EnabledParameters) bool { return true }
+func (p *recordingProcessor) Shutdown(context.Context) error                         { return nil }
+func (p *recordingProcessor) ForceFlush(context.Context) error                       { return nil }
+
+func (p *recordingProcessor) OnEmit(_ context.Context, r *sdklog.Record) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.records = append(p.records, r.Clone())
+	return nil
+}
+
+// recordAttrs returns r's attributes rendered as strings
+func recordAttrs(r sdklog.Record) map[string]string {
+	attrs := make(map[string]string)
+	r.WalkAttributes(func(kv log.KeyValue) bool {
+		attrs[kv.Key] = kv.Value.String()
+		return true
+	})
+	return attrs
+}
+
+func TestNewLoggerTraceContext(t *testing.T) {
+	processor := &recordingProcessor{}
+	lp := sdklog.NewLoggerProvider(sdklog.WithProcessor(processor))
+	defer lp.Shutdown(context.Background())
+	logger := NewLogger("test", lp)
+
+	tp, _ := NewInMemoryTracerProvider()
+	defer tp.Shutdown(context.Background())
+	ctx, span := tp.Tracer("test").Start(context.Background(), "request")
+	logger.InfoContext(ctx, "inside span")
+	span.End()
+	logger.InfoContext(context.Background(), "outside span")
+
+	if len(processor.records) != 2 {
+		t.Fatalf("got %d records, want 2", len(processor.records))
+	}
+	inside, outside := processor.records[0], processor.records[1]
+	sc := span.SpanContext()
+	if inside.TraceID() != sc.TraceID() || inside.SpanID() != sc.SpanID() {
+		t.Errorf("record linked to %s/%s, want %s/%s", inside.TraceID(), inside.SpanID(), sc.TraceID(), sc.SpanID())
+	}
+	attrs := recordAttrs(inside)
+	if attrs["trace_id"] != sc.TraceID().String() || attrs["span_id"] != sc.SpanID().String() {
+		t.Errorf("record attributes %v, want trace_id %s and span_id %s", attrs, sc.TraceID(), sc.SpanID())
+	}
+
+	if attrs := recordAttrs(outside); attrs["trace_id"] != "" || attrs["span_id"] != "" {
+		t.Errorf("record outside any span has trace attributes %v", attrs)
+	}
+}
+
+func TestNewLoggerLevel(t *testing.T) {
+	tests := []struct {
+		name       string
+		global     string
+		perService string
+		want       []string
+	}{
+		{"default is info", "", "", []string{"INFO", "WARN", "ERROR"}},
+		{"OTEL_LOG_LEVEL", "error", "", []string{"ERROR"}},
+		{"per-service level wins", "error", "debug", []string{"DEBUG", "INFO", "WARN", "ERROR"}},
+		{"warning is an alias for warn", "warning", "", []string{"WARN", "ERROR"}},
+		{"invalid level falls back to info", "loud", "", []string{"INFO", "WARN", "ERROR"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OTEL_LOG_LEVEL", tt.global)
+			t.Setenv("LOG_LEVEL_CART", tt.perService)
+			processor := &recordingProcessor{}
+			lp := sdklog.NewLoggerProvider(sdklog.WithProcessor(processor))
+			defer lp.Shutdown(context.Background())
+
+			logger := NewLogger("cart", lp)
+			logger.Debug("debug")
+			logger.Info("info")
+			logger.Warn("warn")
+			logger.Error("error")
+
+			var got []string
+			for _, r := range processor.records {
+				got = append(got, r.SeverityText())
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("emitted %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
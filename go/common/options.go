@@ -0,0 +1,60 @@
+package common
+
+import (
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+// Option customizes InitTelemetry
+type Option func(*telemetryOptions)
+
+type telemetryOptions struct {
+	views          []sdkmetric.View
+	spanAttributes []attribute.KeyValue
+}
+
+func newTelemetryOptions(opts []Option) *telemetryOptions {
+	o := &telemetryOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithViews registers metric views on the service's MeterProvider, e.g. to
+// drop or rename noisy instruments:
+//
+//	common.InitTelemetry(ctx, "cart",
+//		common.WithViews(common.DropInstrument("system.cpu.load_average.15m")))
+func WithViews(views ...sdkmetric.View) Option {
+	return func(o *telemetryOptions) {
+		o.views = append(o.views, views...)
+	}
+}
+
+// WithSpanAttributes sets attributes on every span the service starts, in
+// addition to the resource. Span attributes set later with the same key win.
+func WithSpanAttributes(attrs ...attribute.KeyValue) Option {
+	return func(o *telemetryOptions) {
+		o.spanAttributes = append(o.spanAttributes, attrs...)
+	}
+}
+
+// DropInstrument returns a view that discards all measurements from
+// instruments matching name. Name may use the * and ? wildcards, e.g.
+// "process.runtime.go.gc.*".
+func DropInstrument(name string) sdkmetric.View {
+	return sdkmetric.NewView(
+		sdkmetric.Instrument{Name: name},
+		sdkmetric.Stream{Aggregation: sdkmetric.AggregationDrop{}},
+	)
+}
+
+// RenameInstrument returns a view that exports the instrument named from
+// under the name to.
+func RenameInstrument(from, to string) sdkmetric.View {
+	return sdkmetric.NewView(
+		sdkmetric.Instrument{Name: from},
+		sdkmetric.Stream{Name: to},
+	)
+}
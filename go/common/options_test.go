@@ -0,0 +1,42 @@
+package common
+
+import (
+	"context"
+	"testing"
+
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+func TestInstrumentViews(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(reader),
+		sdkmetric.WithView(
+			DropInstrument("system.cpu.load_average.15m"),
+			DropInstrument("process.runtime.go.gc.*"),
+			RenameInstrument("app.orders", "shop.orders"),
+		),
+	)
+	defer mp.Shutdown(context.Background())
+
+	meter := mp.Meter("test")
+	for _, name := range []string{"system.cpu.load_average.15m", "process.runtime.go.gc.count", "app.orders", "app.carts"} {
+		counter, err := meter.Int64Counter(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counter.Add(context.Background(), 1)
+	}
+
+	metrics := collectMetrics(t, reader)
+	for _, name := range []string{"system.cpu.load_average.15m", "process.runtime.go.gc.count", "app.orders"} {
+		if _, ok := metrics[name]; ok {
+			t.Errorf("%s was exported, want it dropped or renamed", name)
+		}
+	}
+	for _, name := range []string{"shop.orders", "app.carts"} {
+		if _, ok := metrics[name]; !ok {
+			t.Errorf("%s was not exported", name)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package common
+
+import (
+	"context"
+	"log"
+	"slices"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// attributeProcessor stamps a fixed set of attributes onto every span when it
+// starts, for backends that don't index resource attributes
+type attributeProcessor struct {
+	attrs []attribute.KeyValue
+}
+
+var _ sdktrace.SpanProcessor = (*attributeProcessor)(nil)
+
+func (p *attributeProcessor) OnStart(_ context.Context, s sdktrace.ReadWriteSpan) {
+	s.SetAttributes(p.attrs...)
+}
+
+func (p *attributeProcessor) OnEnd(sdktrace.ReadOnlySpan)      {}
+func (p *attributeProcessor) Shutdown(context.Context) error   { return nil }
+func (p *attributeProcessor) ForceFlush(context.Context) error { return nil }
+
+// baggageProcessor copies allow-listed baggage members from the parent context
+// onto each span, so context set once upstream shows up on every hop
+type baggageProcessor struct {
+	keys []string
+}
+
+var _ sdktrace.SpanProcessor = (*baggageProcessor)(nil)
+
+func (p *baggageProcessor) OnStart(ctx context.Context, s sdktrace.ReadWriteSpan) {
+	bag := baggage.FromContext(ctx)
+	for _, key := range p.keys {
+		if m := bag.Member(key); m.Key() != "" {
+			s.SetAttributes(attribute.String(key, m.Value()))
+		}
+	}
+}
+
+func (p *baggageProcessor) OnEnd(sdktrace.ReadOnlySpan)      {}
+func (p *baggageProcessor) Shutdown(context.Context) error   { return nil }
+func (p *baggageProcessor) ForceFlush(context.Context) error { return nil }
+
+// SyntheticKey marks generated traffic: it is both the baggage key set to
+// "true" for the whole request and the boolean span attribute stamped from it
+const SyntheticKey = "synthetic"
+
+// syntheticProcessor marks every span started under synthetic=true baggage
+// with synthetic=true, so generated traffic can be filtered out of SLOs
+type syntheticProcessor struct{}
+
+var _ sdktrace.SpanProcessor = syntheticProcessor{}
+
+func (syntheticProcessor) OnStart(ctx context.Context, s sdktrace.ReadWriteSpan) {
+	if baggage.FromContext(ctx).Member(SyntheticKey).Value() == "true" {
+		s.SetAttributes(attribute.Bool(SyntheticKey, true))
+	}
+}
+
+func (syntheticProcessor) OnEnd(sdktrace.ReadOnlySpan)      {}
+func (syntheticProcessor) Shutdown(context.Context) error   { return nil }
+func (syntheticProcessor) ForceFlush(context.Context) error { return nil }
+
+// activeSpans counts spans that have started but not ended. The tracer
+// provider exists before the meter provider, so the count is kept atomically
+// from the first span and only exported as otel.active_spans once bind runs.
+type activeSpans struct {
+	n atomic.Int64
+}
+
+var _ sdktrace.SpanProcessor = (*activeSpans)(nil)
+
+func (p *activeSpans) OnStart(context.Context, sdktrace.ReadWriteSpan) { p.n.Add(1) }
+func (p *activeSpans) OnEnd(sdktrace.ReadOnlySpan)                     { p.n.Add(-1) }
+func (p *activeSpans) Shutdown(context.Context) error                  { return nil }
+func (p *activeSpans) ForceFlush(context.Context) error                { return nil }
+
+func (p *activeSpans) bind(mp metric.MeterProvider) {
+	_, err := mp.Meter("telemetry").Int64ObservableUpDownCounter("otel.active_spans",
+		metric.WithDescription("Spans started but not yet ended"),
+		metric.WithUnit("{span}"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			o.Observe(p.n.Load())
+			return nil
+		}))
+	if err != nil {
+		log.Printf("failed to create otel.active_spans: %v", err)
+	}
+}
+
+// errorSpanProcessor forwards sampled spans to the wrapped batcher as usual,
+// and also unsampled ones that ended with an error status, marked sampled so
+// the batcher keeps them. Together with recordDroppedSampler this samples
+// the happy path while keeping every error span.
+type errorSpanProcessor struct {
+	sdktrace.SpanProcessor
+}
+
+func (p *errorSpanProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	switch {
+	case s.SpanContext().IsSampled():
+		p.SpanProcessor.OnEnd(s)
+	case s.Status().Code == codes.Error:
+		p.SpanProcessor.OnEnd(keptErrorSpan{s})
+	}
+}
+
+// keptErrorSpan reports an unsampled error span as sampled and tags it, so
+// a downstream tail sampler can tell it was kept for its error
+type keptErrorSpan struct {
+	sdktrace.ReadOnlySpan
+}
+
+func (s keptErrorSpan) SpanContext() trace.SpanContext {
+	sc := s.ReadOnlySpan.SpanContext()
+	return sc.WithTraceFlags(sc.TraceFlags().WithSampled(true))
+}
+
+func (s keptErrorSpan) Attributes() []attribute.KeyValue {
+	return slices.Concat(s.ReadOnlySpan.Attributes(), []attribute.KeyValue{attribute.Bool("sampling.kept_error", true)})
+}
@@ -0,0 +1,190 @@
+package common
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// spanAttr returns the value of key on span and whether it was set
+func spanAttr(span tracetest.SpanStub, key attribute.Key) (attribute.Value, bool) {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+func TestSyntheticProcessor(t *testing.T) {
+	tests := []struct {
+		name    string
+		baggage []attribute.KeyValue
+		want    bool
+	}{
+		{"no baggage", nil, false},
+		{"synthetic=true", []attribute.KeyValue{attribute.Bool(SyntheticKey, true)}, true},
+		{"synthetic=false", []attribute.KeyValue{attribute.Bool(SyntheticKey, false)}, false},
+		{"other key", []attribute.KeyValue{attribute.Bool("synthetic_request", true)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter := tracetest.NewInMemoryExporter()
+			tp := sdktrace.NewTracerProvider(
+				sdktrace.WithSpanProcessor(syntheticProcessor{}),
+				sdktrace.WithSyncer(exporter),
+			)
+			defer tp.Shutdown(context.Background())
+
+			ctx, err := WithBaggage(context.Background(), tt.baggage...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, parent := tp.Tracer("test").Start(ctx, "parent")
+			_, child := tp.Tracer("test").Start(ctx, "child")
+			child.End()
+			parent.End()
+
+			for _, span := range exporter.GetSpans() {
+				v, ok := spanAttr(span, SyntheticKey)
+				if tt.want && (!ok || !v.AsBool()) {
+					t.Errorf("%s: synthetic attribute = %v (set %v), want true", span.Name, v.Emit(), ok)
+				}
+				if !tt.want && ok {
+					t.Errorf("%s: synthetic attribute set to %v, want unset", span.Name, v.Emit())
+				}
+			}
+		})
+	}
+}
+
+func TestAttributeProcessor(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(&attributeProcessor{attrs: []attribute.KeyValue{
+			attribute.String("deployment.environment", "demo"),
+			attribute.String("team", "checkout"),
+		}}),
+		sdktrace.WithSyncer(exporter),
+	)
+	defer tp.Shutdown(context.Background())
+
+	_, span := tp.Tracer("test").Start(context.Background(), "stamped")
+	span.End()
+	_, span = tp.Tracer("test").Start(context.Background(), "overridden")
+	span.SetAttributes(attribute.String("team", "payments"))
+	span.End()
+
+	want := map[string]string{"stamped": "checkout", "overridden": "payments"}
+	for _, s := range exporter.GetSpans() {
+		if v, ok := spanAttr(s, "deployment.environment"); !ok || v.AsString() != "demo" {
+			t.Errorf("%s: deployment.environment = %q (set %v), want demo", s.Name, v.AsString(), ok)
+		}
+		if v, _ := spanAttr(s, "team"); v.AsString() != want[s.Name] {
+			t.Errorf("%s: team = %q, want %q", s.Name, v.AsString(), want[s.Name])
+		}
+	}
+}
+
+func TestBaggageProcessor(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(&baggageProcessor{keys: []string{"session.id", "user.tier"}}),
+		sdktrace.WithSyncer(exporter),
+	)
+	defer tp.Shutdown(context.Background())
+
+	ctx, err := WithBaggage(context.Background(),
+		attribute.String("session.id", "abc123"),
+		attribute.String("user.tier", "gold"),
+		attribute.String("card.number", "4111"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, span := tp.Tracer("test").Start(ctx, "child")
+	span.End()
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	for key, want := range map[attribute.Key]string{"session.id": "abc123", "user.tier": "gold"} {
+		if v, ok := spanAttr(spans[0], key); !ok || v.AsString() != want {
+			t.Errorf("%s = %q (set %v), want %q", key, v.AsString(), ok, want)
+		}
+	}
+	if v, ok := spanAttr(spans[0], "card.number"); ok {
+		t.Errorf("card.number = %q was copied, want only allow-listed keys", v.AsString())
+	}
+}
+
+func TestErrorSpanProcessorKeepsUnsampledErrors(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithSampler(recordDroppedSampler{sdktrace.TraceIDRatioBased(0)}),
+		sdktrace.WithSpanProcessor(&errorSpanProcessor{sdktrace.NewSimpleSpanProcessor(exporter)}),
+	)
+	defer tp.Shutdown(context.Background())
+
+	_, ok := tp.Tracer("test").Start(context.Background(), "ok")
+	ok.End()
+	_, failed := tp.Tracer("test").Start(context.Background(), "failed")
+	failed.SetStatus(codes.Error, "boom")
+	failed.End()
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 || spans[0].Name != "failed" {
+		t.Fatalf("exported %d spans, want only the failed one", len(spans))
+	}
+	if v, set := spanAttr(spans[0], "sampling.kept_error"); !set || !v.AsBool() {
+		t.Errorf("kept error span has sampling.kept_error = %v (set %v), want true", v.Emit(), set)
+	}
+}
+
+func TestActiveSpans(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	defer mp.Shutdown(context.Background())
+	active := &activeSpans{}
+	active.bind(mp)
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(active))
+	defer tp.Shutdown(context.Background())
+	tracer := tp.Tracer("test")
+
+	const n = 50
+	spans := make(chan trace.Span, n)
+	var wg sync.WaitGroup
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, span := tracer.Start(context.Background(), "in-flight")
+			spans <- span
+		}()
+	}
+	wg.Wait()
+	close(spans)
+	if got := sumValue(t, reader, "otel.active_spans"); got != n {
+		t.Errorf("otel.active_spans with %d open spans = %d", n, got)
+	}
+
+	for span := range spans {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			span.End()
+		}()
+	}
+	wg.Wait()
+	if got := sumValue(t, reader, "otel.active_spans"); got != 0 {
+		t.Errorf("otel.active_spans after every span ended = %d, want 0", got)
+	}
+}
@@ -0,0 +1,53 @@
+package common
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"otel-mock/config"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	otelprom "go.opentelemetry.io/otel/exporters/prometheus"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+)
+
+// Every service in the process shares one registry and one /metrics
+// listener; series are told apart by their service_name label
+var (
+	promRegistry   = prometheus.NewRegistry()
+	promServerOnce sync.Once
+)
+
+// usePrometheusExporter reports whether metrics are pulled via /metrics
+// instead of pushed over OTLP
+func usePrometheusExporter() bool {
+	return config.MetricsExporter == "prometheus"
+}
+
+// newPrometheusReader returns a reader that serves the service's metrics on
+// the shared /metrics endpoint, starting the listener on first use
+func newPrometheusReader() (sdkmetric.Reader, error) {
+	promServerOnce.Do(servePrometheus)
+	return otelprom.New(
+		otelprom.WithRegisterer(promRegistry),
+		otelprom.WithResourceAsConstantLabels(attribute.NewAllowKeysFilter(semconv.ServiceNameKey)),
+	)
+}
+
+func servePrometheus() {
+	addr := net.JoinHostPort(config.PrometheusHost, config.PrometheusPort)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(promRegistry, promhttp.HandlerOpts{}))
+
+	log.Printf("serving Prometheus metrics on http://%s/metrics", addr)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Prometheus metrics server failed: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,80 @@
+package common
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"otel-mock/config"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tokenBucket allows rate events per second on average and up to burst at
+// once. It is safe for concurrent use.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// allow takes a token if one is available
+func (b *tokenBucket) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// RateLimit wraps next with the token bucket configured for service through
+// RATE_LIMIT_<SERVICE>_RPS and RATE_LIMIT_<SERVICE>_BURST. Requests over the
+// limit get a 429, a "rate_limited" event on the server span and a count in
+// <service>.rate_limited on mp. Like InjectFaults it must run inside the
+// otelhttp handler. Without a positive RPS, next is returned unchanged.
+func RateLimit(service string, mp metric.MeterProvider, next http.Handler) http.Handler {
+	rps := config.RateLimitRPS(service)
+	if rps <= 0 {
+		return next
+	}
+	burst := config.RateLimitBurst(service, int(math.Ceil(rps)))
+	log.Printf("%s: rate limiting to %.2f req/s (burst %d)", service, rps, burst)
+
+	limited, err := mp.Meter(service).Int64Counter(service+".rate_limited",
+		metric.WithDescription("Requests rejected by the rate limiter"),
+		metric.WithUnit("{requests}"))
+	if err != nil {
+		log.Printf("%s: failed to create rate_limited counter: %v", service, err)
+	}
+	bucket := newTokenBucket(rps, burst)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if bucket.allow() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		trace.SpanFromContext(r.Context()).AddEvent("rate_limited", trace.WithAttributes(
+			attribute.Float64("rate_limit.rps", rps),
+			attribute.Int("rate_limit.burst", burst),
+		))
+		if limited != nil {
+			limited.Add(r.Context(), 1)
+		}
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, `{"error":"rate limited"}`, http.StatusTooManyRequests)
+	})
+}
@@ -0,0 +1,102 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTokenBucketConcurrentBurst(t *testing.T) {
+	// A rate this low refills nothing during the test
+	bucket := newTokenBucket(0.001, 5)
+	var allowed atomic.Int64
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if bucket.allow() {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := allowed.Load(); got != 5 {
+		t.Errorf("%d of 50 concurrent requests allowed, want the burst of 5", got)
+	}
+}
+
+func TestTokenBucketRefills(t *testing.T) {
+	bucket := newTokenBucket(100, 1)
+	if !bucket.allow() {
+		t.Fatal("first request rejected")
+	}
+	if bucket.allow() {
+		t.Fatal("second request allowed with the bucket empty")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if !bucket.allow() {
+		t.Error("request rejected after the bucket had time to refill")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	t.Setenv("RATE_LIMIT_TEST_RPS", "0.001")
+	t.Setenv("RATE_LIMIT_TEST_BURST", "2")
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	defer mp.Shutdown(context.Background())
+	tp, exporter := NewInMemoryTracerProvider()
+	defer tp.Shutdown(context.Background())
+
+	limited := RateLimit("test", mp, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := tp.Tracer("test").Start(r.Context(), "request", trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+		limited.ServeHTTP(w, r.WithContext(ctx))
+	})
+
+	var codes []int
+	for range 4 {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/checkout", nil))
+		codes = append(codes, rec.Code)
+	}
+	want := []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests}
+	for i := range want {
+		if codes[i] != want[i] {
+			t.Fatalf("burst of 4 returned %v, want %v", codes, want)
+		}
+	}
+
+	if got := sumValue(t, reader, "test.rate_limited"); got != 2 {
+		t.Errorf("test.rate_limited = %d, want 2", got)
+	}
+	var events int
+	for _, s := range exporter.GetSpans() {
+		for _, e := range s.Events {
+			if e.Name == "rate_limited" {
+				events++
+			}
+		}
+	}
+	if events != 2 {
+		t.Errorf("%d rate_limited span events, want 2", events)
+	}
+}
+
+func TestRateLimitDisabled(t *testing.T) {
+	t.Setenv("RATE_LIMIT_TEST_RPS", "")
+	rec := httptest.NewRecorder()
+	RateLimit("test", nil, http.NotFoundHandler()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unlimited handler returned %d, want next's %d", rec.Code, http.StatusNotFound)
+	}
+}
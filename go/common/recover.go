@@ -0,0 +1,53 @@
+package common
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+
+	"go.opentelemetry.io/otel/codes"
+	otellog "go.opentelemetry.io/otel/log"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Recover wraps next so a panic in service's handler is recorded on the
+// server span, logged at ERROR with its trace ID, counted in panics.total
+// and answered with a 500 instead of dropping the connection. Like
+// InjectFaults it must run inside the otelhttp handler.
+func Recover(service string, mp metric.MeterProvider, lp otellog.LoggerProvider, next http.Handler) http.Handler {
+	panics, err := mp.Meter(service).Int64Counter("panics.total",
+		metric.WithDescription("Handler panics recovered by the server"),
+		metric.WithUnit("{panic}"))
+	if err != nil {
+		log.Printf("%s: failed to create panics.total counter: %v", service, err)
+	}
+	logger := NewLogger(service, lp)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				// Deliberate abort; let net/http close the connection quietly
+				panic(v)
+			}
+			ctx := r.Context()
+			err := fmt.Errorf("panic: %v", v)
+
+			span := trace.SpanFromContext(ctx)
+			span.RecordError(err, trace.WithStackTrace(true))
+			span.SetStatus(codes.Error, err.Error())
+			if panics != nil {
+				panics.Add(ctx, 1)
+			}
+			logger.ErrorContext(ctx, "Recovered from handler panic",
+				"path", r.URL.Path, "error", err, "stack", string(debug.Stack()))
+			http.Error(w, `{"error":"internal server error"}`, http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,82 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/codes"
+	otellog "go.opentelemetry.io/otel/log"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+)
+
+func TestRecover(t *testing.T) {
+	tp, exporter := NewInMemoryTracerProvider()
+	defer tp.Shutdown(context.Background())
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	defer mp.Shutdown(context.Background())
+	processor := &recordingProcessor{}
+	lp := sdklog.NewLoggerProvider(sdklog.WithProcessor(processor))
+	defer lp.Shutdown(context.Background())
+
+	mux := http.NewServeMux()
+	mux.Handle("/boom", Recover("test", mp, lp, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})))
+	ts := httptest.NewServer(NewServerHandler(mux, "test", tp, mp, nil))
+	t.Cleanup(ts.Close)
+
+	resp, err := http.Get(ts.URL + "/boom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", resp.StatusCode)
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	s := spans[0]
+	if s.Status.Code != codes.Error {
+		t.Errorf("span status = %v, want Error", s.Status.Code)
+	}
+	var recorded bool
+	for _, e := range s.Events {
+		if e.Name != semconv.ExceptionEventName {
+			continue
+		}
+		for _, kv := range e.Attributes {
+			if kv.Key == semconv.ExceptionMessageKey && kv.Value.AsString() == "panic: boom" {
+				recorded = true
+			}
+		}
+	}
+	if !recorded {
+		t.Errorf("span events = %+v, want an exception for the panic", s.Events)
+	}
+
+	if got := sumValue(t, reader, "panics.total"); got != 1 {
+		t.Errorf("panics.total = %d, want 1", got)
+	}
+
+	var logged bool
+	for _, r := range processor.records {
+		if r.Severity() == otellog.SeverityError && strings.Contains(r.Body().AsString(), "panic") {
+			logged = true
+			if r.TraceID() != s.SpanContext.TraceID() {
+				t.Errorf("log trace ID = %s, want %s", r.TraceID(), s.SpanContext.TraceID())
+			}
+		}
+	}
+	if !logged {
+		t.Error("no ERROR log was emitted for the panic")
+	}
+}
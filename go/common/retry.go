@@ -0,0 +1,62 @@
+package common
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RetryPolicy bounds DoWithRetry. Backoff doubles from InitialBackoff up to
+// MaxBackoff, with full jitter applied to each wait.
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// DefaultRetryPolicy suits the demo's in-cluster calls: three attempts
+// within roughly half a second
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 100 * time.Millisecond,
+	MaxBackoff:     time.Second,
+}
+
+// DoWithRetry runs op until it succeeds, policy.MaxAttempts is reached or ctx
+// is done, and returns op's last error. Each retry adds a "retry" event to
+// the span in ctx. The span's status is left to the caller: ctx may carry a
+// parent whose step tolerates the failure.
+func DoWithRetry(ctx context.Context, op func() error, policy RetryPolicy) error {
+	span := trace.SpanFromContext(ctx)
+	backoff := policy.InitialBackoff
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = op(); err == nil {
+			return nil
+		}
+		// A cancelled or expired ctx fails every later attempt the same way
+		if attempt >= policy.MaxAttempts || ctx.Err() != nil {
+			return err
+		}
+
+		wait := time.Duration(rand.Int63n(int64(backoff) + 1))
+		span.AddEvent("retry", trace.WithAttributes(
+			attribute.Int("retry.attempt", attempt),
+			attribute.String("retry.error", err.Error()),
+			attribute.Int64("retry.backoff_ms", wait.Milliseconds()),
+		))
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		backoff = min(backoff*2, policy.MaxBackoff)
+	}
+}
@@ -0,0 +1,71 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+)
+
+var testRetryPolicy = RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}
+
+func TestDoWithRetry(t *testing.T) {
+	failing := errors.New("unavailable")
+	tests := []struct {
+		name         string
+		failures     int
+		wantAttempts int
+		wantErr      bool
+	}{
+		{"first try", 0, 1, false},
+		{"succeeds on retry", 2, 3, false},
+		{"gives up after MaxAttempts", 5, 3, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tp, exporter := NewInMemoryTracerProvider()
+			defer tp.Shutdown(context.Background())
+			ctx, span := tp.Tracer("test").Start(context.Background(), "parent")
+
+			attempts := 0
+			err := DoWithRetry(ctx, func() error {
+				attempts++
+				if attempts <= tt.failures {
+					return failing
+				}
+				return nil
+			}, testRetryPolicy)
+			span.End()
+
+			if (err != nil) != tt.wantErr {
+				t.Errorf("DoWithRetry = %v, want error %v", err, tt.wantErr)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", attempts, tt.wantAttempts)
+			}
+			got := exporter.GetSpans()[0]
+			if len(got.Events) != tt.wantAttempts-1 {
+				t.Errorf("%d retry events, want %d", len(got.Events), tt.wantAttempts-1)
+			}
+			// The caller owns the span's status, even after giving up
+			if got.Status.Code != codes.Unset {
+				t.Errorf("parent span status = %v, want unset", got.Status.Code)
+			}
+		})
+	}
+}
+
+func TestDoWithRetryStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	err := DoWithRetry(ctx, func() error {
+		attempts++
+		cancel()
+		return errors.New("unavailable")
+	}, testRetryPolicy)
+	if err == nil || attempts != 1 {
+		t.Errorf("DoWithRetry = %v after %d attempts, want an error after 1", err, attempts)
+	}
+}
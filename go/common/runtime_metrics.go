@@ -0,0 +1,44 @@
+package common
+
+import (
+	"context"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+// goroutineBaselineDelay gives every service time to start its servers,
+// consumers and exporters before the goroutine baseline is taken
+const goroutineBaselineDelay = 10 * time.Second
+
+// startRuntimeExtras registers process.runtime.go.goroutines.leaked: the
+// goroutines running above the count seen goroutineBaselineDelay after
+// startup. Nothing is reported until the baseline is taken.
+func startRuntimeExtras(mp *sdkmetric.MeterProvider) error {
+	return startLeakedGoroutines(mp, goroutineBaselineDelay)
+}
+
+// startLeakedGoroutines is startRuntimeExtras with the baseline taken after
+// delay
+func startLeakedGoroutines(mp *sdkmetric.MeterProvider, delay time.Duration) error {
+	var baseline atomic.Int64
+	baseline.Store(-1)
+	time.AfterFunc(delay, func() {
+		// Not counting the timer's own goroutine, which exits right after
+		baseline.Store(int64(runtime.NumGoroutine()) - 1)
+	})
+
+	_, err := mp.Meter("runtime-extras").Int64ObservableGauge("process.runtime.go.goroutines.leaked",
+		metric.WithDescription("Goroutines running above the post-startup baseline"),
+		metric.WithUnit("{goroutine}"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			if base := baseline.Load(); base >= 0 {
+				o.Observe(max(int64(runtime.NumGoroutine())-base, 0))
+			}
+			return nil
+		}))
+	return err
+}
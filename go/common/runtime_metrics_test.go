@@ -0,0 +1,53 @@
+package common
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// leakedGoroutines returns the gauge's value, or -1 before the baseline
+func leakedGoroutines(t *testing.T, reader *sdkmetric.ManualReader) int64 {
+	t.Helper()
+	m, ok := collectMetrics(t, reader)["process.runtime.go.goroutines.leaked"]
+	if !ok {
+		return -1
+	}
+	points := m.Data.(metricdata.Gauge[int64]).DataPoints
+	if len(points) == 0 {
+		return -1
+	}
+	return points[0].Value
+}
+
+func TestLeakedGoroutines(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	defer mp.Shutdown(context.Background())
+	if err := startLeakedGoroutines(mp, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	before := leakedGoroutines(t, reader)
+	for before < 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no value reported after the baseline delay")
+		}
+		time.Sleep(10 * time.Millisecond)
+		before = leakedGoroutines(t, reader)
+	}
+
+	const leaks = 5
+	release := make(chan struct{})
+	defer close(release)
+	for range leaks {
+		go func() { <-release }()
+	}
+	if after := leakedGoroutines(t, reader); after < before+leaks {
+		t.Errorf("leaked goroutines = %d after starting %d, want at least %d", after, leaks, before+leaks)
+	}
+}
@@ -0,0 +1,211 @@
+package common
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"otel-mock/config"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	otellog "go.opentelemetry.io/otel/log"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// newSampler builds the sampler for serviceName. A ratio for it in
+// OTEL_TRACES_SAMPLER_PER_SERVICE replaces the global ratio, keeping the
+// parent-based wrapper when OTEL_TRACES_SAMPLER has one so traces entering
+// the service from sampled callers stay whole. Otherwise the sampler named by
+// OTEL_TRACES_SAMPLER is used; unknown names fall back to the SDK default of
+// parentbased_always_on.
+func newSampler(serviceName string) sdktrace.Sampler {
+	return chooseSampler(serviceName).sampler()
+}
+
+// samplerChoice is the sampler configured for a service, kept apart from the
+// SDK sampler it builds so debugSampler can explain its decisions
+type samplerChoice struct {
+	// root is "always_on", "always_off" or "traceidratio"
+	root        string
+	ratio       float64
+	parentBased bool
+	// perService is set when ratio came from OTEL_TRACES_SAMPLER_PER_SERVICE
+	perService bool
+}
+
+func chooseSampler(serviceName string) samplerChoice {
+	if ratio, ok := perServiceRatios()[serviceName]; ok {
+		return samplerChoice{
+			root:        "traceidratio",
+			ratio:       ratio,
+			parentBased: strings.HasPrefix(config.TracesSampler, "parentbased_"),
+			perService:  true,
+		}
+	}
+
+	switch config.TracesSampler {
+	case "always_on", "always_off":
+		return samplerChoice{root: config.TracesSampler}
+	case "traceidratio":
+		return samplerChoice{root: "traceidratio", ratio: samplerRatio()}
+	case "parentbased_always_on", "parentbased_always_off":
+		return samplerChoice{root: strings.TrimPrefix(config.TracesSampler, "parentbased_"), parentBased: true}
+	case "parentbased_traceidratio":
+		return samplerChoice{root: "traceidratio", ratio: samplerRatio(), parentBased: true}
+	default:
+		log.Printf("unsupported OTEL_TRACES_SAMPLER %q, using parentbased_always_on", config.TracesSampler)
+		return samplerChoice{root: "always_on", parentBased: true}
+	}
+}
+
+func (c samplerChoice) sampler() sdktrace.Sampler {
+	var root sdktrace.Sampler
+	switch c.root {
+	case "always_on":
+		root = sdktrace.AlwaysSample()
+	case "always_off":
+		root = sdktrace.NeverSample()
+	default:
+		root = sdktrace.TraceIDRatioBased(c.ratio)
+	}
+	if c.parentBased {
+		return sdktrace.ParentBased(root)
+	}
+	return root
+}
+
+// reason explains why the sampler made its decision for a span with the
+// given remote or missing parent
+func (c samplerChoice) reason(parent trace.SpanContext, sampled bool) string {
+	if parent.IsValid() && c.parentBased {
+		if parent.IsSampled() {
+			return "parent-based: remote parent sampled"
+		}
+		return "parent-based: remote parent not sampled"
+	}
+	switch c.root {
+	case "always_on":
+		return "always_on samples every trace"
+	case "always_off":
+		return "always_off drops every trace"
+	}
+	source := "OTEL_TRACES_SAMPLER_ARG"
+	if c.perService {
+		source = "OTEL_TRACES_SAMPLER_PER_SERVICE"
+	}
+	side := "inside"
+	if !sampled {
+		side = "outside"
+	}
+	return fmt.Sprintf("trace ID %s the traceidratio %v threshold from %s", side, c.ratio, source)
+}
+
+// samplerRatio parses OTEL_TRACES_SAMPLER_ARG as a ratio in [0, 1],
+// defaulting to 1.0 when it is unset or malformed.
+func samplerRatio() float64 {
+	if config.TracesSamplerArg == "" {
+		return 1.0
+	}
+	ratio, err := strconv.ParseFloat(config.TracesSamplerArg, 64)
+	if err != nil || ratio < 0 || ratio > 1 {
+		log.Printf("invalid OTEL_TRACES_SAMPLER_ARG %q, using 1.0", config.TracesSamplerArg)
+		return 1.0
+	}
+	return ratio
+}
+
+// perServiceRatios parses OTEL_TRACES_SAMPLER_PER_SERVICE, a comma-separated
+// list of service:ratio pairs. Malformed entries are logged and skipped.
+func perServiceRatios() map[string]float64 {
+	ratios := make(map[string]float64)
+	for _, entry := range strings.Split(config.TracesSamplerPerService, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(entry, ":")
+		ratio, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if name = strings.TrimSpace(name); !ok || name == "" || err != nil || ratio < 0 || ratio > 1 {
+			log.Printf("ignoring malformed OTEL_TRACES_SAMPLER_PER_SERVICE entry %q", entry)
+			continue
+		}
+		ratios[name] = ratio
+	}
+	return ratios
+}
+
+// recordDroppedSampler records the spans its sampler would drop instead of
+// discarding them, so errorSpanProcessor can still export the failed ones.
+// They stay unsampled, so the batcher ignores them otherwise.
+type recordDroppedSampler struct {
+	sdktrace.Sampler
+}
+
+func (s recordDroppedSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	res := s.Sampler.ShouldSample(p)
+	if res.Decision == sdktrace.Drop {
+		res.Decision = sdktrace.RecordOnly
+	}
+	return res
+}
+
+func (s recordDroppedSampler) Description() string {
+	return "RecordDropped{" + s.Sampler.Description() + "}"
+}
+
+// samplingLog hands debugSampler the service's logger. The logger provider
+// is built after the tracer provider, so decisions made before bind runs
+// aren't logged.
+type samplingLog struct {
+	logger atomic.Pointer[slog.Logger]
+}
+
+func (l *samplingLog) bind(service string, lp otellog.LoggerProvider) {
+	l.logger.Store(NewLogger(service, lp))
+}
+
+// debugSampler logs, at DEBUG, the decision its sampler makes for every span
+// that starts a trace or enters the service from a remote caller, and why
+type debugSampler struct {
+	sdktrace.Sampler
+	choice samplerChoice
+	log    *samplingLog
+}
+
+func (s debugSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	res := s.Sampler.ShouldSample(p)
+
+	parent := trace.SpanContextFromContext(p.ParentContext)
+	if parent.IsValid() && !parent.IsRemote() {
+		// Child spans of a local parent just repeat its decision
+		return res
+	}
+	logger := s.log.logger.Load()
+	if logger == nil {
+		return res
+	}
+	logger.DebugContext(p.ParentContext, "sampling decision",
+		"span", p.Name,
+		"trace_id", p.TraceID.String(),
+		"decision", decisionName(res.Decision),
+		"reason", s.choice.reason(parent, res.Decision == sdktrace.RecordAndSample),
+		"sampler", s.Sampler.Description(),
+	)
+	return res
+}
+
+func (s debugSampler) Description() string {
+	return "Debug{" + s.Sampler.Description() + "}"
+}
+
+func decisionName(d sdktrace.SamplingDecision) string {
+	switch d {
+	case sdktrace.RecordAndSample:
+		return "sampled"
+	case sdktrace.RecordOnly:
+		return "record_only"
+	default:
+		return "dropped"
+	}
+}
@@ -0,0 +1,139 @@
+package common
+
+import (
+	"context"
+	"maps"
+	"otel-mock/config"
+	"testing"
+
+	"go.opentelemetry.io/otel/log"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestPerServiceRatios(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want map[string]float64
+	}{
+		{"unset", "", map[string]float64{}},
+		{"several services", "product-catalog:0.1, checkout:1.0", map[string]float64{"product-catalog": 0.1, "checkout": 1}},
+		{"malformed entries are skipped", "cart,currency:x,ad:1.5,:0.5,email:-1,shipping:0", map[string]float64{"shipping": 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, &config.TracesSamplerPerService, tt.raw)
+			if got := perServiceRatios(); !maps.Equal(got, tt.want) {
+				t.Errorf("perServiceRatios(%q) = %v, want %v", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewSampler(t *testing.T) {
+	const perService = "product-catalog:0.1,checkout:1.0"
+	tests := []struct {
+		name    string
+		service string
+		global  string
+		arg     string
+		want    sdktrace.Sampler
+	}{
+		{"listed service keeps the parent-based wrapper", "product-catalog", "parentbased_always_on", "", sdktrace.ParentBased(sdktrace.TraceIDRatioBased(0.1))},
+		{"listed service without a wrapper", "checkout", "always_on", "", sdktrace.TraceIDRatioBased(1)},
+		{"unlisted service uses the global sampler", "cart", "traceidratio", "0.25", sdktrace.TraceIDRatioBased(0.25)},
+		{"unlisted service with the default", "cart", "parentbased_always_on", "", sdktrace.ParentBased(sdktrace.AlwaysSample())},
+		{"invalid global ratio", "cart", "traceidratio", "2", sdktrace.TraceIDRatioBased(1)},
+		{"unknown global sampler", "cart", "sometimes", "", sdktrace.ParentBased(sdktrace.AlwaysSample())},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, &config.TracesSamplerPerService, perService)
+			setConfig(t, &config.TracesSampler, tt.global)
+			setConfig(t, &config.TracesSamplerArg, tt.arg)
+			if got, want := newSampler(tt.service).Description(), tt.want.Description(); got != want {
+				t.Errorf("newSampler(%q) = %s, want %s", tt.service, got, want)
+			}
+		})
+	}
+}
+
+func TestDebugSampler(t *testing.T) {
+	setConfig(t, &config.TracesSamplerPerService, "")
+	setConfig(t, &config.TracesSampler, "parentbased_traceidratio")
+	setConfig(t, &config.TracesSamplerArg, "0")
+	t.Setenv("OTEL_LOG_LEVEL", "debug")
+
+	processor := &recordingProcessor{}
+	lp := sdklog.NewLoggerProvider(sdklog.WithProcessor(processor))
+	defer lp.Shutdown(context.Background())
+	sampling := &samplingLog{}
+	sampling.bind("test", lp)
+	choice := chooseSampler("test")
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSampler(debugSampler{Sampler: choice.sampler(), choice: choice, log: sampling}))
+	defer tp.Shutdown(context.Background())
+	tracer := tp.Tracer("test")
+
+	remote := func(flags trace.TraceFlags) context.Context {
+		return trace.ContextWithRemoteSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID:    trace.TraceID{1},
+			SpanID:     trace.SpanID{1},
+			TraceFlags: flags,
+			Remote:     true,
+		}))
+	}
+	_, root := tracer.Start(context.Background(), "root")
+	root.End()
+	ctx, sampledChild := tracer.Start(remote(trace.FlagsSampled), "remote sampled")
+	_, local := tracer.Start(ctx, "local child")
+	local.End()
+	sampledChild.End()
+	_, unsampledChild := tracer.Start(remote(0), "remote not sampled")
+	unsampledChild.End()
+
+	want := []struct {
+		span     string
+		decision string
+		reason   string
+	}{
+		{"root", "dropped", "trace ID outside the traceidratio 0 threshold from OTEL_TRACES_SAMPLER_ARG"},
+		{"remote sampled", "sampled", "parent-based: remote parent sampled"},
+		{"remote not sampled", "dropped", "parent-based: remote parent not sampled"},
+	}
+	if len(processor.records) != len(want) {
+		t.Fatalf("got %d sampling logs, want %d (the local child isn't logged)", len(processor.records), len(want))
+	}
+	for i, w := range want {
+		attrs := recordAttrs(processor.records[i])
+		if attrs["span"] != w.span || attrs["decision"] != w.decision || attrs["reason"] != w.reason {
+			t.Errorf("log %d = span %q, decision %q, reason %q; want %q, %q, %q",
+				i, attrs["span"], attrs["decision"], attrs["reason"], w.span, w.decision, w.reason)
+		}
+		if sev := processor.records[i].Severity(); sev != log.SeverityDebug {
+			t.Errorf("log %d severity = %v, want DEBUG", i, sev)
+		}
+	}
+}
+
+func TestDebugSamplerRespectsLogLevel(t *testing.T) {
+	setConfig(t, &config.TracesSamplerPerService, "")
+	setConfig(t, &config.TracesSampler, "always_on")
+	t.Setenv("OTEL_LOG_LEVEL", "info")
+
+	processor := &recordingProcessor{}
+	lp := sdklog.NewLoggerProvider(sdklog.WithProcessor(processor))
+	defer lp.Shutdown(context.Background())
+	sampling := &samplingLog{}
+	sampling.bind("test", lp)
+	choice := chooseSampler("test")
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSampler(debugSampler{Sampler: choice.sampler(), choice: choice, log: sampling}))
+	defer tp.Shutdown(context.Background())
+
+	_, span := tp.Tracer("test").Start(context.Background(), "root")
+	span.End()
+	if len(processor.records) != 0 {
+		t.Errorf("got %d sampling logs at info level, want none", len(processor.records))
+	}
+}
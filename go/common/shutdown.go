@@ -0,0 +1,38 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+var (
+	shutdownMu    sync.Mutex
+	shutdownFuncs = map[*http.Server][]func(){}
+)
+
+// OnShutdown registers fn to run when server is stopped through Shutdown.
+// Unlike http.Server.RegisterOnShutdown, which runs hooks in goroutines it
+// doesn't wait for, Shutdown returns only after fn does, so Kafka offsets are
+// committed and connections closed before the service's telemetry is flushed.
+func OnShutdown(server *http.Server, fn func()) {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+	shutdownFuncs[server] = append(shutdownFuncs[server], fn)
+}
+
+// Shutdown drains server's in-flight requests within ctx, then runs its
+// OnShutdown funcs in registration order
+func Shutdown(ctx context.Context, server *http.Server) error {
+	err := server.Shutdown(ctx)
+
+	shutdownMu.Lock()
+	fns := shutdownFuncs[server]
+	delete(shutdownFuncs, server)
+	shutdownMu.Unlock()
+
+	for _, fn := range fns {
+		fn()
+	}
+	return err
+}
@@ -0,0 +1,29 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestShutdownRunsHooksInOrder(t *testing.T) {
+	server := &http.Server{}
+	var calls []string
+	OnShutdown(server, func() { calls = append(calls, "first") })
+	OnShutdown(server, func() { calls = append(calls, "second") })
+
+	if err := Shutdown(context.Background(), server); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if want := []string{"first", "second"}; !slices.Equal(calls, want) {
+		t.Errorf("hooks ran as %v, want %v", calls, want)
+	}
+
+	// Hooks are dropped once run, so a second Shutdown doesn't repeat them
+	calls = nil
+	Shutdown(context.Background(), server)
+	if len(calls) != 0 {
+		t.Errorf("second Shutdown ran hooks %v again", calls)
+	}
+}
@@ -2,58 +2,152 @@ package common
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"otel-mock/config"
 	"runtime"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/shirou/gopsutil/v3/load"
 	"go.opentelemetry.io/contrib/instrumentation/host"
 	otelruntime "go.opentelemetry.io/contrib/instrumentation/runtime"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
-	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploggrpc"
-	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
-	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/propagation"
 	sdklog "go.opentelemetry.io/otel/sdk/log"
 	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/exemplar"
 	sdkresource "go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
 	"go.opentelemetry.io/otel/trace"
 )
 
+// serviceVersion is the fallback when no build version is available
 const serviceVersion = "1.0.0"
 
+var (
+	logExportSettingsOnce sync.Once
+	hostMetricsOnce       sync.Once
+	runtimeExtrasOnce     sync.Once
+	connectivityCheckOnce sync.Once
+)
+
 // TelemetryProviders holds all OTel providers for a service
 type TelemetryProviders struct {
 	TracerProvider *sdktrace.TracerProvider
 	MeterProvider  *sdkmetric.MeterProvider
 	LoggerProvider *sdklog.LoggerProvider
 	Tracer         trace.Tracer
+	// ServiceName is the service.name on the resource, after
+	// OTEL_SERVICE_NAME
+	ServiceName string
+	// ShutdownTimeout bounds each provider's Shutdown call
+	ShutdownTimeout time.Duration
 }
 
-// InitTelemetry initializes all OTel providers for a service
-func InitTelemetry(ctx context.Context, serviceName string) *TelemetryProviders {
-	res := initResource(serviceName)
+// InitTelemetry initializes all OTel providers for a service. On error any
+// providers already created are shut down and nothing is returned.
+func InitTelemetry(ctx context.Context, serviceName string, opts ...Option) (*TelemetryProviders, error) {
+	o := newTelemetryOptions(opts)
+	serviceName = resolveServiceName(serviceName)
+
+	if config.SDKDisabled {
+		log.Printf("%s: telemetry disabled by OTEL_SDK_DISABLED", serviceName)
+		return disabledTelemetry(serviceName), nil
+	}
+
+	timer := newInitTimer()
+	res, err := initResource(serviceName)
+	if err != nil {
+		return nil, err
+	}
+	detection := timer.step("resource")
+	log.Printf("%s: resource detection took %s", serviceName, detection.Round(time.Microsecond))
+
+	if useStdoutExporters() {
+		log.Printf("%s (instance %s): exporting telemetry to stdout", serviceName, config.ServiceInstanceID)
+	} else {
+		log.Printf("%s (instance %s): exporting OTLP over %s to %s", serviceName, config.ServiceInstanceID, otlpProtocol(), config.OTLPEndpoint)
+		logExportSettingsOnce.Do(logExportSettings)
+		if config.StartupConnectivityCheck {
+			connectivityCheckOnce.Do(func() { checkConnectivity(ctx) })
+		}
+	}
+
+	if disabled := disabledSignals(); len(disabled) > 0 {
+		log.Printf("%s: not exporting %s (exporter set to none)", serviceName, strings.Join(disabled, ", "))
+	}
 
-	tp := initTracerProvider(ctx, res)
-	mp := initMeterProvider(ctx, res)
-	lp := initLoggerProvider(ctx, res)
+	tel := &TelemetryProviders{ServiceName: serviceName, ShutdownTimeout: config.ShutdownTimeout}
+	failures := &exportFailures{}
+	active := &activeSpans{}
+	sampling := &samplingLog{}
 
-	if err := otelruntime.Start(otelruntime.WithMinimumReadMemStatsInterval(time.Second * 5)); err != nil {
-		log.Printf("failed to start runtime metrics: %v", err)
+	tel.TracerProvider, err = initTracerProvider(ctx, serviceName, res, o.spanAttributes, failures, active, sampling)
+	if err != nil {
+		return nil, err
 	}
+	timer.step("tracer")
+	tel.MeterProvider, err = initMeterProvider(ctx, res, o.views, failures)
+	if err != nil {
+		timer.end(tel.TracerProvider, err)
+		tel.Shutdown(ctx)
+		return nil, err
+	}
+	failures.bind(tel.MeterProvider)
+	active.bind(tel.MeterProvider)
+	recordResourceDetection(tel.MeterProvider, detection)
+	timer.step("meter")
+	tel.LoggerProvider, err = initLoggerProvider(ctx, res, failures)
+	if err != nil {
+		timer.end(tel.TracerProvider, err)
+		tel.Shutdown(ctx)
+		return nil, err
+	}
+	sampling.bind(serviceName, tel.LoggerProvider)
+	timer.step("logger")
+	timer.end(tel.TracerProvider, nil)
+	tel.Tracer = tel.TracerProvider.Tracer(serviceName)
+	mp := tel.MeterProvider
 
-	// Start standard host metrics for CPU (system.cpu.time)
-	if err := host.Start(host.WithMeterProvider(mp)); err != nil {
-		log.Printf("failed to start host metrics: %v", err)
+	if config.EnableRuntimeMetrics {
+		if err := otelruntime.Start(
+			otelruntime.WithMeterProvider(mp),
+			otelruntime.WithMinimumReadMemStatsInterval(config.RuntimeMetricsInterval),
+		); err != nil {
+			log.Printf("failed to start runtime metrics: %v", err)
+		}
+		// Goroutines are counted process-wide, so like host metrics this is
+		// reported once, by the first service
+		runtimeExtrasOnce.Do(func() {
+			if err := startRuntimeExtras(mp); err != nil {
+				log.Printf("failed to start goroutine leak metric: %v", err)
+			}
+		})
 	}
 
-	// Start custom metrics for load averages and memory
-	startHostMetrics(mp)
+	// Host metrics describe the machine, not the service, so they are
+	// registered once per process against the first service's meter provider
+	if config.EnableHostMetrics {
+		hostMetricsOnce.Do(func() {
+			log.Printf("%s: reporting host metrics for this process", serviceName)
+
+			// Start standard host metrics for CPU (system.cpu.time)
+			if err := host.Start(host.WithMeterProvider(mp)); err != nil {
+				log.Printf("failed to start host metrics: %v", err)
+			}
+
+			// Start custom metrics for load averages, memory, disk and network
+			if err := startHostMetrics(mp); err != nil {
+				log.Printf("failed to start custom host metrics: %v", err)
+			}
+		})
+	}
 
 	// Set global propagator for context propagation
 	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
@@ -61,22 +155,125 @@ func InitTelemetry(ctx context.Context, serviceName string) *TelemetryProviders
 		propagation.Baggage{},
 	))
 
+	return tel, nil
+}
+
+// exporterNone is the OTEL_*_EXPORTER value that disables a signal
+const exporterNone = "none"
+
+// disabledSignals lists the signals whose exporter is set to none
+func disabledSignals() []string {
+	var disabled []string
+	for _, s := range []struct{ name, exporter string }{
+		{"traces", config.TracesExporter},
+		{"metrics", config.MetricsExporter},
+		{"logs", config.LogsExporter},
+	} {
+		if s.exporter == exporterNone {
+			disabled = append(disabled, s.name)
+		}
+	}
+	return disabled
+}
+
+// initTimer records when each InitTelemetry step finished. The steps run
+// before any tracer provider exists, so the telemetry.init span is created
+// afterwards with the recorded timestamps.
+type initTimer struct {
+	start time.Time
+	last  time.Time
+	steps []initStep
+}
+
+type initStep struct {
+	name     string
+	at       time.Time
+	duration time.Duration
+}
+
+func newInitTimer() *initTimer {
+	now := time.Now()
+	return &initTimer{start: now, last: now}
+}
+
+// step records that name just finished and returns how long it took
+func (t *initTimer) step(name string) time.Duration {
+	now := time.Now()
+	d := now.Sub(t.last)
+	t.steps = append(t.steps, initStep{name, now, d})
+	t.last = now
+	return d
+}
+
+// end emits the telemetry.init span through tp, with one event per finished
+// step. It does nothing if the tracer provider never came up.
+func (t *initTimer) end(tp trace.TracerProvider, err error) {
+	if tp == nil {
+		return
+	}
+	_, span := tp.Tracer("telemetry").Start(context.Background(), "telemetry.init",
+		trace.WithTimestamp(t.start))
+	for _, s := range t.steps {
+		span.AddEvent(s.name, trace.WithTimestamp(s.at),
+			trace.WithAttributes(attribute.Float64("duration_ms", float64(s.duration.Microseconds())/1000)))
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End(trace.WithTimestamp(time.Now()))
+}
+
+// recordResourceDetection reports how long initResource took, which ran
+// before mp existed, as telemetry.resource_detection.duration
+func recordResourceDetection(mp metric.MeterProvider, d time.Duration) {
+	hist, err := mp.Meter("telemetry").Float64Histogram("telemetry.resource_detection.duration",
+		metric.WithDescription("Time spent detecting the service's resource attributes at startup"),
+		metric.WithUnit("s"))
+	if err != nil {
+		log.Printf("failed to create telemetry.resource_detection.duration: %v", err)
+		return
+	}
+	hist.Record(context.Background(), d.Seconds())
+}
+
+// disabledTelemetry returns SDK providers with no exporters, processors or
+// readers attached, so every signal is dropped at the API boundary and
+// Shutdown has nothing to flush. Concrete SDK types are kept so callers don't
+// need to special-case this mode.
+func disabledTelemetry(serviceName string) *TelemetryProviders {
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSampler(sdktrace.NeverSample()))
 	return &TelemetryProviders{
-		TracerProvider: tp,
-		MeterProvider:  mp,
-		LoggerProvider: lp,
-		Tracer:         tp.Tracer(serviceName),
+		TracerProvider:  tp,
+		MeterProvider:   sdkmetric.NewMeterProvider(),
+		LoggerProvider:  sdklog.NewLoggerProvider(),
+		Tracer:          tp.Tracer(serviceName),
+		ServiceName:     serviceName,
+		ShutdownTimeout: config.ShutdownTimeout,
 	}
 }
 
-func initResource(serviceName string) *sdkresource.Resource {
+// resolveServiceName returns OTEL_SERVICE_NAME when set, else serviceName,
+// so the resource, tracer and host name all agree on one name. main clears
+// config.ServiceName under -service all, where it would name every service
+// the same.
+func resolveServiceName(serviceName string) string {
+	if config.ServiceName != "" {
+		return config.ServiceName
+	}
+	return serviceName
+}
+
+func initResource(serviceName string) (*sdkresource.Resource, error) {
 	hostName := fmt.Sprintf("%s-host", serviceName)
 
 	res, err := sdkresource.New(
 		context.Background(),
 		sdkresource.WithAttributes(
 			semconv.ServiceName(serviceName),
-			semconv.ServiceVersion(serviceVersion),
+			semconv.ServiceVersion(resolveServiceVersion()),
+			attribute.String("service.commit", ResolveServiceCommit()),
+			semconv.ServiceInstanceID(config.ServiceInstanceID),
 			semconv.TelemetrySDKLanguageGo,
 			semconv.HostName(hostName),
 			attribute.String("os.type", runtime.GOOS),
@@ -85,88 +282,193 @@ func initResource(serviceName string) *sdkresource.Resource {
 		),
 		sdkresource.WithProcess(),
 		sdkresource.WithContainer(),
+		sdkresource.WithDetectors(cloudDetectors()...),
+		// Detectors merge in order with later ones winning, so values from
+		// OTEL_RESOURCE_ATTRIBUTES override the defaults above
+		sdkresource.WithFromEnv(),
 	)
-	if err != nil {
-		log.Fatalf("failed to create resource: %v", err)
+	if errors.Is(err, sdkresource.ErrPartialResource) {
+		// Some detectors (e.g. container) fail outside their environment;
+		// the attributes they did produce are still usable
+		log.Printf("partial resource for %s: %v", serviceName, err)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to create resource: %w", err)
 	}
-	return res
+	return res, nil
 }
 
-func initTracerProvider(ctx context.Context, res *sdkresource.Resource) *sdktrace.TracerProvider {
-	exporter, err := otlptracegrpc.New(ctx, otlptracegrpc.WithInsecure())
+func initTracerProvider(ctx context.Context, serviceName string, res *sdkresource.Resource, spanAttrs []attribute.KeyValue, failures *exportFailures, active *activeSpans, sampling *samplingLog) (*sdktrace.TracerProvider, error) {
+	if config.TracesExporter == exporterNone {
+		// Spans still get IDs, so trace context keeps propagating
+		return sdktrace.NewTracerProvider(sdktrace.WithSampler(sdktrace.NeverSample()), sdktrace.WithResource(res)), nil
+	}
+
+	exporters, err := newExporters(ctx, config.OTLPTracesEndpoint, newTraceExporter)
 	if err != nil {
-		log.Fatalf("failed to create trace exporter: %v", err)
+		return nil, fmt.Errorf("failed to create trace exporter: %w", err)
 	}
 
-	tp := sdktrace.NewTracerProvider(
-		sdktrace.WithBatcher(exporter),
+	choice := chooseSampler(serviceName)
+	sampler := choice.sampler()
+	if config.KeepErrorSpans {
+		sampler = recordDroppedSampler{sampler}
+	}
+	if config.SamplerDebug {
+		sampler = debugSampler{Sampler: sampler, choice: choice, log: sampling}
+	}
+	limits := sdktrace.NewSpanLimits()
+	limits.AttributeValueLengthLimit = config.SpanAttributeValueLengthLimit
+	limits.AttributeCountLimit = config.SpanAttributeCountLimit
+	tpOpts := []sdktrace.TracerProviderOption{
+		sdktrace.WithSampler(sampler),
 		sdktrace.WithResource(res),
-	)
-	return tp
+		sdktrace.WithSpanLimits(limits),
+	}
+	// Processors run in registration order, so attributes are stamped before
+	// the batcher sees the span
+	if len(spanAttrs) > 0 {
+		tpOpts = append(tpOpts, sdktrace.WithSpanProcessor(&attributeProcessor{attrs: spanAttrs}))
+	}
+	if len(config.BaggageSpanAttributes) > 0 {
+		tpOpts = append(tpOpts, sdktrace.WithSpanProcessor(&baggageProcessor{keys: config.BaggageSpanAttributes}))
+	}
+	tpOpts = append(tpOpts, sdktrace.WithSpanProcessor(syntheticProcessor{}), sdktrace.WithSpanProcessor(active))
+	// One batcher per collector, each with its own queue, so a slow or
+	// unreachable collector doesn't hold up exports to the others
+	for _, exporter := range exporters {
+		var batcher sdktrace.SpanProcessor = sdktrace.NewBatchSpanProcessor(countingSpanExporter{exporter, failures},
+			sdktrace.WithMaxQueueSize(config.BSPMaxQueueSize),
+			sdktrace.WithMaxExportBatchSize(config.BSPMaxExportBatchSize),
+			sdktrace.WithBatchTimeout(config.BSPScheduleDelay),
+		)
+		if config.KeepErrorSpans {
+			batcher = &errorSpanProcessor{SpanProcessor: batcher}
+		}
+		tpOpts = append(tpOpts, sdktrace.WithSpanProcessor(batcher))
+	}
+
+	return sdktrace.NewTracerProvider(tpOpts...), nil
+}
+
+// exponentialHistogramViews switches duration and latency histograms, e.g.
+// http.server.request.duration and app.checkout.latency, to base-2
+// exponential buckets for better tail-percentile resolution. Other
+// histograms such as cart.size keep explicit buckets.
+func exponentialHistogramViews() []sdkmetric.View {
+	exponential := sdkmetric.Stream{Aggregation: sdkmetric.AggregationBase2ExponentialHistogram{MaxSize: 160, MaxScale: 20}}
+	return []sdkmetric.View{
+		sdkmetric.NewView(sdkmetric.Instrument{Name: "*.duration", Kind: sdkmetric.InstrumentKindHistogram}, exponential),
+		sdkmetric.NewView(sdkmetric.Instrument{Name: "*.latency", Kind: sdkmetric.InstrumentKindHistogram}, exponential),
+	}
 }
 
-func initMeterProvider(ctx context.Context, res *sdkresource.Resource) *sdkmetric.MeterProvider {
-	exporter, err := otlpmetricgrpc.New(ctx, otlpmetricgrpc.WithInsecure())
+func initMeterProvider(ctx context.Context, res *sdkresource.Resource, views []sdkmetric.View, failures *exportFailures) (*sdkmetric.MeterProvider, error) {
+	readers, err := newMetricReaders(ctx, failures)
 	if err != nil {
-		log.Fatalf("failed to create metric exporter: %v", err)
+		return nil, err
 	}
 
-	mp := sdkmetric.NewMeterProvider(
-		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter)),
+	if config.ExponentialHistograms {
+		views = append(exponentialHistogramViews(), views...)
+	}
+	mpOpts := []sdkmetric.Option{
 		sdkmetric.WithResource(res),
-	)
-	return mp
+		sdkmetric.WithView(views...),
+		sdkmetric.WithExemplarFilter(exemplarFilter()),
+	}
+	for _, reader := range readers {
+		mpOpts = append(mpOpts, sdkmetric.WithReader(reader))
+	}
+	return sdkmetric.NewMeterProvider(mpOpts...), nil
 }
 
-func initLoggerProvider(ctx context.Context, res *sdkresource.Resource) *sdklog.LoggerProvider {
-	exporter, err := otlploggrpc.New(ctx, otlploggrpc.WithInsecure())
-	if err != nil {
-		log.Fatalf("failed to create log exporter: %v", err)
+// newMetricReaders returns a Prometheus pull reader when
+// OTEL_METRICS_EXPORTER=prometheus, otherwise one periodic reader per OTLP
+// endpoint (or a single stdout one)
+func newMetricReaders(ctx context.Context, failures *exportFailures) ([]sdkmetric.Reader, error) {
+	if config.MetricsExporter == exporterNone {
+		return nil, nil
+	}
+	if usePrometheusExporter() {
+		reader, err := newPrometheusReader()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create prometheus exporter: %w", err)
+		}
+		return []sdkmetric.Reader{reader}, nil
 	}
 
-	lp := sdklog.NewLoggerProvider(
-		sdklog.WithProcessor(sdklog.NewBatchProcessor(exporter)),
-		sdklog.WithResource(res),
-	)
-	return lp
-}
+	exporters, err := newExporters(ctx, config.OTLPMetricsEndpoint, newMetricExporter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric exporter: %w", err)
+	}
 
-// Shutdown gracefully shuts down all providers
-func (t *TelemetryProviders) Shutdown(ctx context.Context) {
-	if t.TracerProvider != nil {
-		t.TracerProvider.Shutdown(ctx)
+	var readerOpts []sdkmetric.PeriodicReaderOption
+	if config.MetricExportInterval > 0 {
+		readerOpts = append(readerOpts, sdkmetric.WithInterval(config.MetricExportInterval))
 	}
-	if t.MeterProvider != nil {
-		t.MeterProvider.Shutdown(ctx)
+	if config.MetricExportTimeout > 0 {
+		readerOpts = append(readerOpts, sdkmetric.WithTimeout(config.MetricExportTimeout))
 	}
-	if t.LoggerProvider != nil {
-		t.LoggerProvider.Shutdown(ctx)
+	readers := make([]sdkmetric.Reader, 0, len(exporters))
+	for _, exporter := range exporters {
+		readers = append(readers, sdkmetric.NewPeriodicReader(countingMetricExporter{exporter, failures}, readerOpts...))
 	}
+	return readers, nil
 }
 
-func startHostMetrics(mp *sdkmetric.MeterProvider) {
-	meter := mp.Meter("host-metrics")
+// exemplarFilter maps OTEL_METRICS_EXEMPLAR_FILTER to a filter. With
+// trace_based, histograms recorded inside a sampled span carry its trace ID.
+func exemplarFilter() exemplar.Filter {
+	switch config.MetricsExemplarFilter {
+	case "always_on":
+		return exemplar.AlwaysOnFilter
+	case "always_off":
+		return exemplar.AlwaysOffFilter
+	case "trace_based":
+		return exemplar.TraceBasedFilter
+	default:
+		log.Printf("unsupported OTEL_METRICS_EXEMPLAR_FILTER %q, using trace_based", config.MetricsExemplarFilter)
+		return exemplar.TraceBasedFilter
+	}
+}
 
-	loadAvg15m, _ := meter.Float64ObservableGauge("system.cpu.load_average.15m",
-		metric.WithDescription("15-minute CPU load average"), metric.WithUnit("1"))
-	loadAvg1m, _ := meter.Float64ObservableGauge("system.cpu.load_average.1m",
-		metric.WithDescription("1-minute CPU load average"), metric.WithUnit("1"))
-	loadAvg5m, _ := meter.Float64ObservableGauge("system.cpu.load_average.5m",
-		metric.WithDescription("5-minute CPU load average"), metric.WithUnit("1"))
+func initLoggerProvider(ctx context.Context, res *sdkresource.Resource, failures *exportFailures) (*sdklog.LoggerProvider, error) {
+	if config.LogsExporter == exporterNone {
+		return sdklog.NewLoggerProvider(sdklog.WithResource(res)), nil
+	}
 
-	// Register callback for load averages
-	_, err := meter.RegisterCallback(
-		func(ctx context.Context, observer metric.Observer) error {
-			if loadAvg, err := load.Avg(); err == nil {
-				observer.ObserveFloat64(loadAvg1m, loadAvg.Load1)
-				observer.ObserveFloat64(loadAvg5m, loadAvg.Load5)
-				observer.ObserveFloat64(loadAvg15m, loadAvg.Load15)
-			}
-			return nil
-		},
-		loadAvg1m, loadAvg5m, loadAvg15m,
-	)
+	exporters, err := newExporters(ctx, config.OTLPLogsEndpoint, newLogExporter)
 	if err != nil {
-		log.Printf("failed to register host metrics callback: %v", err)
+		return nil, fmt.Errorf("failed to create log exporter: %w", err)
+	}
+
+	lpOpts := []sdklog.LoggerProviderOption{sdklog.WithResource(res)}
+	for _, exporter := range exporters {
+		lpOpts = append(lpOpts, sdklog.WithProcessor(sdklog.NewBatchProcessor(countingLogExporter{exporter, failures})))
+	}
+	return sdklog.NewLoggerProvider(lpOpts...), nil
+}
+
+// Shutdown gracefully shuts down all providers, giving each at most
+// ShutdownTimeout, and returns any errors joined together
+func (t *TelemetryProviders) Shutdown(ctx context.Context) error {
+	var errs []error
+	shutdown := func(name string, fn func(context.Context) error) {
+		ctx, cancel := context.WithTimeout(ctx, t.ShutdownTimeout)
+		defer cancel()
+		if err := fn(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s provider: %w", name, err))
+		}
+	}
+
+	if t.TracerProvider != nil {
+		shutdown("tracer", t.TracerProvider.Shutdown)
+	}
+	if t.MeterProvider != nil {
+		shutdown("meter", t.MeterProvider.Shutdown)
+	}
+	if t.LoggerProvider != nil {
+		shutdown("logger", t.LoggerProvider.Shutdown)
 	}
+	return errors.Join(errs...)
 }
@@ -0,0 +1,380 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"otel-mock/config"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestInitTelemetryServiceName(t *testing.T) {
+	tests := []struct {
+		name     string
+		override string
+		want     string
+	}{
+		{"own name", "", "cart"},
+		{"OTEL_SERVICE_NAME", "renamed-cart", "renamed-cart"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, &config.SDKDisabled, true)
+			setConfig(t, &config.ServiceName, tt.override)
+
+			tel, err := InitTelemetry(context.Background(), "cart")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tel.Shutdown(context.Background())
+			if tel.ServiceName != tt.want {
+				t.Errorf("ServiceName = %q, want %q", tel.ServiceName, tt.want)
+			}
+		})
+	}
+}
+
+// With the SDK's 60s default nothing would be pushed within the test, so an
+// export arriving shows the reader uses the configured interval
+func TestMetricReaderInterval(t *testing.T) {
+	setConfig(t, &config.OTLPProtocol, protocolHTTPProtobuf)
+	setConfig(t, &config.OTLPCertificate, "")
+	setConfig(t, &config.DebugExporter, "")
+	setConfig(t, &config.MetricsExporter, "otlp")
+	setConfig(t, &config.MetricExportInterval, 50*time.Millisecond)
+	collector := startHTTPCollector(t)
+	setConfig(t, &config.OTLPMetricsEndpoint, collector.URL)
+
+	readers, err := newMetricReaders(context.Background(), &exportFailures{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(readers) != 1 {
+		t.Fatalf("newMetricReaders returned %d readers, want 1", len(readers))
+	}
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(readers[0]))
+	defer mp.Shutdown(context.Background())
+	counter, err := mp.Meter("test").Int64Counter("test.counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter.Add(context.Background(), 1)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(collector.received()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no metrics exported within 2s at a 50ms export interval")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := collector.received()[0].path; got != "/v1/metrics" {
+		t.Errorf("metrics exported to %s, want /v1/metrics", got)
+	}
+}
+
+func TestInitResourceFromEnv(t *testing.T) {
+	setConfig(t, &config.EnableCloudDetectors, false)
+	t.Setenv("OTEL_RESOURCE_ATTRIBUTES", "deployment.environment=staging,team=payments")
+
+	res, err := initResource("cart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[attribute.Key]string{
+		// OTEL_RESOURCE_ATTRIBUTES wins over the hard-coded default
+		"deployment.environment": "staging",
+		"team":                   "payments",
+		// Keys the variable doesn't mention keep their defaults
+		"service.name":      "cart",
+		"container.runtime": "docker",
+	}
+	for key, value := range want {
+		got, ok := res.Set().Value(key)
+		if !ok || got.AsString() != value {
+			t.Errorf("resource %s = %q, want %q", key, got.AsString(), value)
+		}
+	}
+}
+
+// exportedMetricNames decodes the OTLP/HTTP metric requests c received
+func exportedMetricNames(t *testing.T, c *fakeHTTPCollector) map[string]bool {
+	t.Helper()
+	names := make(map[string]bool)
+	for _, r := range c.received() {
+		var req colmetricpb.ExportMetricsServiceRequest
+		if err := proto.Unmarshal(r.body, &req); err != nil {
+			t.Fatalf("decoding metrics request: %v", err)
+		}
+		for _, rm := range req.ResourceMetrics {
+			for _, sm := range rm.ScopeMetrics {
+				for _, m := range sm.Metrics {
+					names[m.Name] = true
+				}
+			}
+		}
+	}
+	return names
+}
+
+func TestInitMeterProviderAppliesViews(t *testing.T) {
+	setConfig(t, &config.OTLPProtocol, protocolHTTPProtobuf)
+	setConfig(t, &config.OTLPCertificate, "")
+	setConfig(t, &config.OTLPCompression, "none")
+	setConfig(t, &config.DebugExporter, "")
+	setConfig(t, &config.MetricsExporter, "otlp")
+	collector := startHTTPCollector(t)
+	setConfig(t, &config.OTLPMetricsEndpoint, collector.URL)
+
+	views := []sdkmetric.View{DropInstrument("system.cpu.load_average.15m")}
+	mp, err := initMeterProvider(context.Background(), sdkresource.Empty(), views, &exportFailures{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp.Shutdown(context.Background())
+	for _, name := range []string{"system.cpu.load_average.15m", "system.cpu.load_average.1m"} {
+		gauge, err := mp.Meter("test").Float64Gauge(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gauge.Record(context.Background(), 1)
+	}
+	if err := mp.ForceFlush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	names := exportedMetricNames(t, collector)
+	if names["system.cpu.load_average.15m"] {
+		t.Error("system.cpu.load_average.15m was exported despite the drop view")
+	}
+	if !names["system.cpu.load_average.1m"] {
+		t.Errorf("system.cpu.load_average.1m was not exported (got %v)", names)
+	}
+}
+
+func TestExemplarFilter(t *testing.T) {
+	tests := []struct {
+		filter        string
+		wantInSpan    bool
+		wantOutOfSpan bool
+	}{
+		{"trace_based", true, false},
+		{"always_on", true, true},
+		{"always_off", false, false},
+		{"unknown", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			setConfig(t, &config.MetricsExemplarFilter, tt.filter)
+			reader := sdkmetric.NewManualReader()
+			mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader), sdkmetric.WithExemplarFilter(exemplarFilter()))
+			defer mp.Shutdown(context.Background())
+			tp, _ := NewInMemoryTracerProvider()
+			defer tp.Shutdown(context.Background())
+
+			latency, err := mp.Meter("test").Float64Histogram("app.latency")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, span := tp.Tracer("test").Start(context.Background(), "request")
+			latency.Record(ctx, 1, metric.WithAttributes(attribute.Bool("in_span", true)))
+			span.End()
+			latency.Record(context.Background(), 1, metric.WithAttributes(attribute.Bool("in_span", false)))
+
+			hist := collectMetrics(t, reader)["app.latency"].Data.(metricdata.Histogram[float64])
+			if len(hist.DataPoints) != 2 {
+				t.Fatalf("app.latency has %d data points, want 2", len(hist.DataPoints))
+			}
+			for _, dp := range hist.DataPoints {
+				inSpan, _ := dp.Attributes.Value("in_span")
+				want := tt.wantOutOfSpan
+				if inSpan.AsBool() {
+					want = tt.wantInSpan
+				}
+				if got := len(dp.Exemplars) > 0; got != want {
+					t.Errorf("in_span=%v: has exemplar = %v, want %v", inSpan.AsBool(), got, want)
+				}
+			}
+		})
+	}
+}
+
+// Each endpoint gets its own batcher, so spans reach one collector while the
+// other is still stuck on its first export
+func TestInitTracerProviderFansOut(t *testing.T) {
+	setConfig(t, &config.OTLPProtocol, protocolHTTPProtobuf)
+	setConfig(t, &config.OTLPCertificate, "")
+	setConfig(t, &config.DebugExporter, "")
+	setConfig(t, &config.TracesExporter, "otlp")
+	setConfig(t, &config.TracesSampler, "always_on")
+	setConfig(t, &config.BSPScheduleDelay, 20*time.Millisecond)
+
+	fast := startHTTPCollector(t)
+	stuck := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-stuck }))
+	t.Cleanup(slow.Close)
+	t.Cleanup(func() { close(stuck) })
+	setConfig(t, &config.OTLPTracesEndpoint, slow.URL+","+fast.URL)
+
+	tp, err := initTracerProvider(context.Background(), "test", sdkresource.Empty(), nil, &exportFailures{}, &activeSpans{}, &samplingLog{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		tp.Shutdown(ctx)
+	}()
+	_, span := tp.Tracer("test").Start(context.Background(), "fan-out")
+	span.End()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(fast.received()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the responsive collector received nothing while the other was stuck")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := fast.received()[0].path; got != "/v1/traces" {
+		t.Errorf("spans exported to %s, want /v1/traces", got)
+	}
+}
+
+// A signal set to none builds no exporter, so an empty endpoint for it
+// (which would fail exporter creation) is never looked at
+func TestInitTelemetrySignalNone(t *testing.T) {
+	tests := []struct {
+		signal   string
+		exporter *string
+		endpoint *string
+	}{
+		{"traces", &config.TracesExporter, &config.OTLPTracesEndpoint},
+		{"metrics", &config.MetricsExporter, &config.OTLPMetricsEndpoint},
+		{"logs", &config.LogsExporter, &config.OTLPLogsEndpoint},
+	}
+	for _, tt := range tests {
+		t.Run(tt.signal, func(t *testing.T) {
+			setConfig(t, &config.SDKDisabled, false)
+			setConfig(t, &config.OTLPProtocol, protocolHTTPProtobuf)
+			setConfig(t, &config.OTLPCertificate, "")
+			setConfig(t, &config.DebugExporter, "")
+			setConfig(t, &config.EnableHostMetrics, false)
+			setConfig(t, &config.EnableRuntimeMetrics, false)
+			setConfig(t, &config.EnableCloudDetectors, false)
+			collector := startHTTPCollector(t)
+			for _, e := range []*string{&config.OTLPTracesEndpoint, &config.OTLPMetricsEndpoint, &config.OTLPLogsEndpoint} {
+				setConfig(t, e, collector.URL)
+			}
+			for _, e := range []*string{&config.TracesExporter, &config.MetricsExporter, &config.LogsExporter} {
+				setConfig(t, e, "otlp")
+			}
+			setConfig(t, tt.exporter, exporterNone)
+			setConfig(t, tt.endpoint, "")
+
+			tel, err := InitTelemetry(context.Background(), "cart")
+			if err != nil {
+				t.Fatalf("InitTelemetry with %s=none: %v", tt.signal, err)
+			}
+			if got := disabledSignals(); len(got) != 1 || got[0] != tt.signal {
+				t.Errorf("disabledSignals() = %v, want [%s]", got, tt.signal)
+			}
+			if err := tel.Shutdown(context.Background()); err != nil {
+				t.Errorf("Shutdown: %v", err)
+			}
+		})
+	}
+}
+
+func TestInitTracerProviderSpanLimits(t *testing.T) {
+	setConfig(t, &config.OTLPProtocol, protocolHTTPProtobuf)
+	setConfig(t, &config.OTLPCertificate, "")
+	setConfig(t, &config.DebugExporter, "")
+	setConfig(t, &config.TracesExporter, "otlp")
+	setConfig(t, &config.TracesSampler, "always_on")
+	setConfig(t, &config.SpanAttributeValueLengthLimit, 8)
+	setConfig(t, &config.SpanAttributeCountLimit, 2)
+
+	collector := startHTTPCollector(t)
+	setConfig(t, &config.OTLPTracesEndpoint, collector.URL)
+
+	tp, err := initTracerProvider(context.Background(), "test", sdkresource.Empty(), nil, &exportFailures{}, &activeSpans{}, &samplingLog{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tp.Shutdown(context.Background())
+	_, span := tp.Tracer("test").Start(context.Background(), "checkout")
+	span.SetAttributes(
+		attribute.String("app.cart.items", `[{"sku":"OLJCESPC7Z","qty":3}]`),
+		attribute.Int("app.cart.size", 1),
+		attribute.String("app.user.id", "u-1"),
+	)
+	span.End()
+	if err := tp.ForceFlush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	got := collector.received()
+	if len(got) != 1 {
+		t.Fatalf("collector received %d requests, want 1", len(got))
+	}
+	var req coltracepb.ExportTraceServiceRequest
+	if err := proto.Unmarshal(got[0].body, &req); err != nil {
+		t.Fatal(err)
+	}
+	exported := req.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if n := len(exported.Attributes); n != 2 {
+		t.Errorf("span has %d attributes, want 2", n)
+	}
+	if exported.DroppedAttributesCount != 1 {
+		t.Errorf("DroppedAttributesCount = %d, want 1", exported.DroppedAttributesCount)
+	}
+	for _, kv := range exported.Attributes {
+		if kv.Key == "app.cart.items" {
+			if v := kv.Value.GetStringValue(); v != `[{"sku":` {
+				t.Errorf("app.cart.items = %q, want it truncated to 8 characters", v)
+			}
+			return
+		}
+	}
+	t.Error("app.cart.items was not exported")
+}
+
+func TestExponentialHistogramViews(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader), sdkmetric.WithView(exponentialHistogramViews()...))
+	defer mp.Shutdown(context.Background())
+	meter := mp.Meter("test")
+
+	tests := []struct {
+		name        string
+		exponential bool
+	}{
+		{"http.server.request.duration", true},
+		{"app.checkout.latency", true},
+		{"cart.size", false},
+	}
+	for _, tt := range tests {
+		h, err := meter.Float64Histogram(tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.Record(context.Background(), 0.25)
+	}
+
+	metrics := collectMetrics(t, reader)
+	for _, tt := range tests {
+		_, exponential := metrics[tt.name].Data.(metricdata.ExponentialHistogram[float64])
+		if exponential != tt.exponential {
+			t.Errorf("%s aggregated as %T, want exponential: %v", tt.name, metrics[tt.name].Data, tt.exponential)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package common
+
+import "runtime/debug"
+
+// Version is the build version, set at link time with
+// -ldflags "-X otel-mock/common.Version=1.2.3".
+var Version = "dev"
+
+// Commit is the short git SHA of the build, set at link time with
+// -ldflags "-X otel-mock/common.Commit=$(git rev-parse --short HEAD)".
+var Commit = "unknown"
+
+// shortSHALength matches git's default abbreviation
+const shortSHALength = 7
+
+// resolveServiceVersion picks the version reported as service.version: the
+// link-time Version, then the main module version from build info, then the
+// serviceVersion constant.
+func resolveServiceVersion() string {
+	if Version != "dev" && Version != "" {
+		return Version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if v := info.Main.Version; v != "" && v != "(devel)" {
+			return v
+		}
+	}
+	return serviceVersion
+}
+
+// ResolveServiceCommit picks the commit reported as service.commit: the
+// link-time Commit, then the VCS revision go build stamped into build info.
+func ResolveServiceCommit() string {
+	if Commit != "unknown" && Commit != "" {
+		return Commit
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" && setting.Value != "" {
+				return setting.Value[:min(len(setting.Value), shortSHALength)]
+			}
+		}
+	}
+	return "unknown"
+}
@@ -1,6 +1,14 @@
 package config
 
-import "os"
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
 
 func getEnv(key, fallback string) string {
 	if v := os.Getenv(key); v != "" {
@@ -9,6 +17,100 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
+func getEnvBool(key string, fallback bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("invalid %s=%q, using %v", key, v, fallback)
+		return fallback
+	}
+	return b
+}
+
+// getEnvOptionalBool is getEnvBool returning nil when key is unset or invalid
+func getEnvOptionalBool(key string) *bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("invalid %s=%q, ignoring it", key, v)
+		return nil
+	}
+	return &b
+}
+
+func getEnvInt(key string, fallback int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		log.Printf("invalid %s=%q, using %d", key, v, fallback)
+		return fallback
+	}
+	return n
+}
+
+// getEnvOptionalInt is getEnvInt for settings that 0 turns off
+func getEnvOptionalInt(key string, fallback int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		log.Printf("invalid %s=%q, using %d", key, v, fallback)
+		return fallback
+	}
+	return n
+}
+
+func getEnvFloat(key string, fallback float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 {
+		log.Printf("invalid %s=%q, using %v", key, v, fallback)
+		return fallback
+	}
+	return f
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("invalid %s=%q, using %v", key, v, fallback)
+		return fallback
+	}
+	return d
+}
+
+// getEnvOptionalDuration is getEnvDuration for settings that 0 turns off
+func getEnvOptionalDuration(key string, fallback time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Printf("invalid %s=%q, using %v", key, v, fallback)
+		return fallback
+	}
+	return d
+}
+
 var (
 	FrontendURL       = getEnv("FRONTEND_URL", "http://localhost:8080")
 	PaymentURL        = getEnv("PAYMENT_URL", "http://localhost:8081")
@@ -24,3 +126,271 @@ var (
 	FraudDetectionURL = getEnv("FRAUD_DETECTION_URL", "http://localhost:8092")
 	QuoteURL          = getEnv("QUOTE_URL", "http://localhost:8094")
 )
+
+func defaultOTLPEndpoint(protocol string) string {
+	if protocol == "http/protobuf" {
+		return "localhost:4318"
+	}
+	return "localhost:4317"
+}
+
+// getEnvMillis reads an integer number of milliseconds, as used by the OTel
+// SDK environment variables.
+func getEnvMillis(key string, fallback time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	ms, err := strconv.Atoi(v)
+	if err != nil || ms <= 0 {
+		log.Printf("invalid %s=%q, using default", key, v)
+		return fallback
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// getEnvRatio reads a float in [0, 1]
+func getEnvRatio(key string, fallback float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 || f > 1 {
+		log.Printf("invalid %s=%q, want a ratio between 0 and 1, using default", key, v)
+		return fallback
+	}
+	return f
+}
+
+// getEnvList reads a comma-separated list, trimming blanks. Setting the
+// variable to an empty string yields an empty list.
+func getEnvList(key string, fallback []string) []string {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// KafkaBrokers lists the brokers (host:port, comma-separated) for order
+// events. When empty, checkout hands orders to the consumers over HTTP.
+var KafkaBrokers = getEnvList("KAFKA_ADDR", nil)
+
+// FraudScoreThreshold is the fraud score (0-1) above which fraud detection
+// flags an order
+var FraudScoreThreshold = getEnvRatio("FRAUD_SCORE_THRESHOLD", 0.75)
+
+// Cart storage: CART_STORE is "memory" (default) or "redis"
+var (
+	CartStore = getEnv("CART_STORE", "memory")
+	RedisAddr = getEnv("REDIS_ADDR", "localhost:6379")
+)
+
+// SDKDisabled turns every signal into a no-op (OTEL_SDK_DISABLED=true)
+var SDKDisabled = getEnvBool("OTEL_SDK_DISABLED", false)
+
+// OTLP exporter settings. Per-signal endpoints fall back to OTLPEndpoint.
+var (
+	// "grpc" or "http/protobuf"
+	OTLPProtocol        = getEnv("OTEL_EXPORTER_OTLP_PROTOCOL", "grpc")
+	OTLPEndpoint        = getEnv("OTEL_EXPORTER_OTLP_ENDPOINT", defaultOTLPEndpoint(OTLPProtocol))
+	OTLPTracesEndpoint  = getEnv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", OTLPEndpoint)
+	OTLPMetricsEndpoint = getEnv("OTEL_EXPORTER_OTLP_METRICS_ENDPOINT", OTLPEndpoint)
+	OTLPLogsEndpoint    = getEnv("OTEL_EXPORTER_OTLP_LOGS_ENDPOINT", OTLPEndpoint)
+	// TLS follows each endpoint's own scheme; when set,
+	// OTEL_EXPORTER_OTLP_INSECURE overrides that for every endpoint
+	OTLPInsecure = getEnvOptionalBool("OTEL_EXPORTER_OTLP_INSECURE")
+	// CA certificate for TLS endpoints; also makes bare host:port endpoints
+	// use TLS
+	OTLPCertificate = getEnv("OTEL_EXPORTER_OTLP_CERTIFICATE", "")
+	// Comma-separated key=value pairs; per-signal values override the shared ones
+	OTLPHeaders        = getEnv("OTEL_EXPORTER_OTLP_HEADERS", "")
+	OTLPTracesHeaders  = getEnv("OTEL_EXPORTER_OTLP_TRACES_HEADERS", "")
+	OTLPMetricsHeaders = getEnv("OTEL_EXPORTER_OTLP_METRICS_HEADERS", "")
+	OTLPLogsHeaders    = getEnv("OTEL_EXPORTER_OTLP_LOGS_HEADERS", "")
+	// "cumulative", "delta" or "lowmemory"
+	MetricsTemporality = getEnv("OTEL_EXPORTER_OTLP_METRICS_TEMPORALITY_PREFERENCE", "cumulative")
+	// "gzip" or "none"
+	OTLPCompression = getEnv("OTEL_EXPORTER_OTLP_COMPRESSION", "none")
+	// "stdout" prints all signals to the console instead of using OTLP
+	DebugExporter = getEnv("OTEL_DEBUG_EXPORTER", "")
+)
+
+// OTLP export timeout and retry policy; defaults match the SDK
+var (
+	OTLPTimeout              = getEnvMillis("OTEL_EXPORTER_OTLP_TIMEOUT", 10*time.Second)
+	OTLPRetryEnabled         = getEnvBool("OTLP_RETRY_ENABLED", true)
+	OTLPRetryInitialInterval = getEnvDuration("OTLP_RETRY_INITIAL_INTERVAL", 5*time.Second)
+	OTLPRetryMaxInterval     = getEnvDuration("OTLP_RETRY_MAX_INTERVAL", 30*time.Second)
+	OTLPRetryMaxElapsedTime  = getEnvDuration("OTLP_RETRY_MAX_ELAPSED_TIME", time.Minute)
+)
+
+// gRPC keepalive pings on the OTLP connections, so NAT and firewall idle
+// timeouts don't silently drop them; off unless OTLP_GRPC_KEEPALIVE_TIME is
+// set
+var (
+	OTLPGRPCKeepaliveTime    = getEnvDuration("OTLP_GRPC_KEEPALIVE_TIME", 0)
+	OTLPGRPCKeepaliveTimeout = getEnvDuration("OTLP_GRPC_KEEPALIVE_TIMEOUT", 20*time.Second)
+)
+
+// Optional TCP dial of every OTLP endpoint at startup, logging a warning for
+// unreachable ones
+var (
+	StartupConnectivityCheck   = getEnvBool("OTEL_STARTUP_CONNECTIVITY_CHECK", false)
+	StartupConnectivityTimeout = getEnvMillis("OTEL_STARTUP_CONNECTIVITY_TIMEOUT", 2*time.Second)
+)
+
+// Batch span processor tuning; defaults match the SDK
+var (
+	BSPMaxQueueSize       = getEnvInt("OTEL_BSP_MAX_QUEUE_SIZE", 2048)
+	BSPMaxExportBatchSize = getEnvInt("OTEL_BSP_MAX_EXPORT_BATCH_SIZE", 512)
+	BSPScheduleDelay      = getEnvMillis("OTEL_BSP_SCHEDULE_DELAY", 5*time.Second)
+)
+
+// Span attribute limits; defaults match the SDK, with -1 leaving values
+// untruncated
+var (
+	SpanAttributeValueLengthLimit = getEnvInt("OTEL_SPAN_ATTRIBUTE_VALUE_LENGTH_LIMIT", -1)
+	SpanAttributeCountLimit       = getEnvInt("OTEL_SPAN_ATTRIBUTE_COUNT_LIMIT", 128)
+)
+
+// Trace sampling, following the OTel SDK environment variable spec
+var (
+	TracesSampler    = getEnv("OTEL_TRACES_SAMPLER", "parentbased_always_on")
+	TracesSamplerArg = getEnv("OTEL_TRACES_SAMPLER_ARG", "")
+	// Comma-separated service:ratio pairs overriding the ratio per service
+	TracesSamplerPerService = getEnv("OTEL_TRACES_SAMPLER_PER_SERVICE", "")
+	// Export spans that end with an error status even when the sampler
+	// dropped their trace
+	KeepErrorSpans = getEnvBool("KEEP_ERROR_SPANS", false)
+	// Log the sampling decision for every root and remote-parent span
+	SamplerDebug = getEnvBool("OTEL_SAMPLER_DEBUG", false)
+)
+
+// BaggageSpanAttributes lists the baggage keys copied onto every span
+var BaggageSpanAttributes = getEnvList("BAGGAGE_SPAN_ATTRIBUTES", []string{"session.id", "user.tier", "user.id"})
+
+// Periodic metric reader settings; zero keeps the SDK defaults (60s / 30s)
+var (
+	MetricExportInterval = getEnvMillis("OTEL_METRIC_EXPORT_INTERVAL", 0)
+	MetricExportTimeout  = getEnvMillis("OTEL_METRIC_EXPORT_TIMEOUT", 0)
+	// "trace_based", "always_on" or "always_off"
+	MetricsExemplarFilter = getEnv("OTEL_METRICS_EXEMPLAR_FILTER", "trace_based")
+	// ExponentialHistograms aggregates duration and latency histograms as
+	// base-2 exponential histograms instead of explicit buckets
+	ExponentialHistograms = getEnvBool("OTEL_GO_EXPONENTIAL_HISTOGRAMS", false)
+)
+
+// Exporter selection per signal. "none" turns that signal's provider into a
+// no-op. For metrics, "otlp" pushes to the collector and "prometheus" serves
+// /metrics on PrometheusHost:PrometheusPort for scraping.
+var (
+	TracesExporter  = getEnv("OTEL_TRACES_EXPORTER", "otlp")
+	LogsExporter    = getEnv("OTEL_LOGS_EXPORTER", "otlp")
+	MetricsExporter = getEnv("OTEL_METRICS_EXPORTER", "otlp")
+	PrometheusHost  = getEnv("OTEL_EXPORTER_PROMETHEUS_HOST", "localhost")
+	PrometheusPort  = getEnv("OTEL_EXPORTER_PROMETHEUS_PORT", "9464")
+)
+
+// Built-in instrumentation toggles
+var (
+	EnableHostMetrics    = getEnvBool("ENABLE_HOST_METRICS", true)
+	EnableRuntimeMetrics = getEnvBool("ENABLE_RUNTIME_METRICS", true)
+	// RuntimeMetricsInterval is the minimum time between runtime.ReadMemStats
+	// calls; lower is finer-grained but costs more
+	RuntimeMetricsInterval = getEnvDuration("RUNTIME_METRICS_INTERVAL", 5*time.Second)
+	// EnableCloudDetectors probes the GCP, EC2 and Azure metadata servers
+	// for cloud.* and host.* resource attributes
+	EnableCloudDetectors = getEnvBool("ENABLE_CLOUD_DETECTORS", false)
+)
+
+// /debug/config exposes the resolved telemetry settings (header values
+// redacted); off by default
+var (
+	EnableDebugConfig = getEnvBool("ENABLE_DEBUG_CONFIG", false)
+	DebugConfigAddr   = getEnv("DEBUG_CONFIG_ADDR", "localhost:9465")
+)
+
+// /flags lists and toggles the demo's runtime feature flags; off by default
+var (
+	EnableFlags = getEnvBool("ENABLE_FLAGS", false)
+	FlagsAddr   = getEnv("FLAGS_ADDR", "localhost:9466")
+)
+
+// ServiceName, when set, replaces the service.name a Go service reports
+var ServiceName = os.Getenv("OTEL_SERVICE_NAME")
+
+// ServiceInstanceID identifies this process; generated once at startup
+// unless OTEL_SERVICE_INSTANCE_ID pins it
+var ServiceInstanceID = getEnv("OTEL_SERVICE_INSTANCE_ID", uuid.NewString())
+
+// CurrencyRatesRefreshInterval is how often the currency service refreshes
+// its exchange rates in the background; off (zero, keeping the base rates)
+// by default
+var CurrencyRatesRefreshInterval = getEnvOptionalDuration("CURRENCY_RATES_REFRESH_INTERVAL", 0)
+
+// HeartbeatInterval is how often every Go service logs a heartbeat and
+// increments service.heartbeat
+var HeartbeatInterval = getEnvDuration("SERVICE_HEARTBEAT_INTERVAL", 30*time.Second)
+
+// CheckoutTimeout is the deadline for placing one order, shared by all of
+// checkout's downstream calls
+var CheckoutTimeout = getEnvMillis("CHECKOUT_TIMEOUT_MS", 5*time.Second)
+
+// ShutdownTimeout bounds each telemetry provider's flush on shutdown
+var ShutdownTimeout = getEnvDuration("TELEMETRY_SHUTDOWN_TIMEOUT", 10*time.Second)
+
+// SlowSearchDelay makes every product-catalog search sleep this long; off
+// by default
+var SlowSearchDelay = getEnvMillis("PRODUCT_CATALOG_SLOW_SEARCH_MS", 0)
+
+// SimulateCPUWorkers is how many CPU-burning goroutines the process starts
+// for CPU saturation demos; off by default
+var SimulateCPUWorkers = getEnvInt("SIMULATE_CPU_WORKERS", 0)
+
+// ProductCacheSize is how many products product-catalog keeps in its
+// GetProduct LRU cache; zero turns the cache off
+var ProductCacheSize = getEnvOptionalInt("PRODUCT_CATALOG_CACHE_SIZE", 100)
+
+// LogLevel is the minimum log severity for a service: LOG_LEVEL_<SERVICE>
+// (e.g. LOG_LEVEL_CART), else OTEL_LOG_LEVEL, else info
+func LogLevel(service string) string {
+	return getEnv("LOG_LEVEL_"+serviceEnvName(service), getEnv("OTEL_LOG_LEVEL", "info"))
+}
+
+// FaultDelay and FaultErrorRate read the fault injection settings for a
+// service, e.g. FAULT_PRODUCT_CATALOG_DELAY_MS and FAULT_CART_ERROR_RATE
+func FaultDelay(service string) time.Duration {
+	return getEnvMillis("FAULT_"+serviceEnvName(service)+"_DELAY_MS", 0)
+}
+
+func FaultErrorRate(service string) float64 {
+	return getEnvRatio("FAULT_"+serviceEnvName(service)+"_ERROR_RATE", 0)
+}
+
+// FaultLeakKB is how many KiB service deliberately leaks per request
+// (FAULT_<SERVICE>_LEAK_KB), for watching heap metrics grow. Zero disables it.
+func FaultLeakKB(service string) int {
+	return getEnvInt("FAULT_"+serviceEnvName(service)+"_LEAK_KB", 0)
+}
+
+// RateLimitRPS and RateLimitBurst read a service's token bucket settings,
+// e.g. RATE_LIMIT_CHECKOUT_RPS=5. Zero RPS turns the limiter off.
+func RateLimitRPS(service string) float64 {
+	return getEnvFloat("RATE_LIMIT_"+serviceEnvName(service)+"_RPS", 0)
+}
+
+func RateLimitBurst(service string, fallback int) int {
+	return getEnvInt("RATE_LIMIT_"+serviceEnvName(service)+"_BURST", fallback)
+}
+
+func serviceEnvName(service string) string {
+	return strings.ToUpper(strings.ReplaceAll(service, "-", "_"))
+}
@@ -0,0 +1,144 @@
+package config
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureLog redirects the standard logger into the returned buffer for the
+// length of the test
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buf
+}
+
+func TestDefaultOTLPEndpoint(t *testing.T) {
+	tests := []struct {
+		protocol string
+		want     string
+	}{
+		{"grpc", "localhost:4317"},
+		{"http/protobuf", "localhost:4318"},
+		{"", "localhost:4317"},
+	}
+	for _, tt := range tests {
+		if got := defaultOTLPEndpoint(tt.protocol); got != tt.want {
+			t.Errorf("defaultOTLPEndpoint(%q) = %q, want %q", tt.protocol, got, tt.want)
+		}
+	}
+}
+
+func TestGetEnvMillis(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  time.Duration
+	}{
+		{"unset keeps the default", "", 0},
+		{"milliseconds", "10000", 10 * time.Second},
+		{"not a number", "10s", 0},
+		{"non-positive", "-5", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OTEL_METRIC_EXPORT_INTERVAL", tt.value)
+			if got := getEnvMillis("OTEL_METRIC_EXPORT_INTERVAL", 0); got != tt.want {
+				t.Errorf("getEnvMillis(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBSPEnvParsing(t *testing.T) {
+	queueSize := func() any { return getEnvInt("OTEL_BSP_MAX_QUEUE_SIZE", 2048) }
+	scheduleDelay := func() any { return getEnvMillis("OTEL_BSP_SCHEDULE_DELAY", 5*time.Second) }
+	tests := []struct {
+		name     string
+		key      string
+		value    string
+		get      func() any
+		want     any
+		wantWarn bool
+	}{
+		{"queue size unset", "OTEL_BSP_MAX_QUEUE_SIZE", "", queueSize, 2048, false},
+		{"queue size", "OTEL_BSP_MAX_QUEUE_SIZE", "8192", queueSize, 8192, false},
+		{"queue size not a number", "OTEL_BSP_MAX_QUEUE_SIZE", "lots", queueSize, 2048, true},
+		{"queue size zero", "OTEL_BSP_MAX_QUEUE_SIZE", "0", queueSize, 2048, true},
+		{"schedule delay", "OTEL_BSP_SCHEDULE_DELAY", "1000", scheduleDelay, time.Second, false},
+		{"schedule delay with a unit", "OTEL_BSP_SCHEDULE_DELAY", "1s", scheduleDelay, 5 * time.Second, true},
+		{"schedule delay negative", "OTEL_BSP_SCHEDULE_DELAY", "-1", scheduleDelay, 5 * time.Second, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(tt.key, tt.value)
+			logs := captureLog(t)
+			if got := tt.get(); got != tt.want {
+				t.Errorf("%s=%q parsed as %v, want %v", tt.key, tt.value, got, tt.want)
+			}
+			if warned := strings.Contains(logs.String(), "invalid "+tt.key); warned != tt.wantWarn {
+				t.Errorf("%s=%q warned = %v, want %v (log %q)", tt.key, tt.value, warned, tt.wantWarn, logs.String())
+			}
+		})
+	}
+}
+
+func TestGetEnvOptionalDuration(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		want     time.Duration
+		wantWarn bool
+	}{
+		{"unset keeps the default", "", time.Minute, false},
+		{"zero turns it off", "0", 0, false},
+		{"duration", "30s", 30 * time.Second, false},
+		{"negative", "-1s", time.Minute, true},
+		{"not a duration", "soon", time.Minute, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CURRENCY_RATES_REFRESH_INTERVAL", tt.value)
+			logs := captureLog(t)
+			if got := getEnvOptionalDuration("CURRENCY_RATES_REFRESH_INTERVAL", time.Minute); got != tt.want {
+				t.Errorf("getEnvOptionalDuration(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+			if warned := logs.Len() > 0; warned != tt.wantWarn {
+				t.Errorf("%q warned = %v, want %v (log %q)", tt.value, warned, tt.wantWarn, logs.String())
+			}
+		})
+	}
+}
+
+func TestGetEnvOptionalInt(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		want     int
+		wantWarn bool
+	}{
+		{"unset keeps the default", "", 100, false},
+		{"zero turns it off", "0", 0, false},
+		{"size", "500", 500, false},
+		{"negative", "-1", 100, true},
+		{"not a number", "lots", 100, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PRODUCT_CATALOG_CACHE_SIZE", tt.value)
+			logs := captureLog(t)
+			if got := getEnvOptionalInt("PRODUCT_CATALOG_CACHE_SIZE", 100); got != tt.want {
+				t.Errorf("getEnvOptionalInt(%q) = %d, want %d", tt.value, got, tt.want)
+			}
+			if warned := logs.Len() > 0; warned != tt.wantWarn {
+				t.Errorf("%q warned = %v, want %v (log %q)", tt.value, warned, tt.wantWarn, logs.String())
+			}
+		})
+	}
+}
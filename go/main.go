@@ -2,97 +2,263 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"otel-mock/common"
+	"otel-mock/config"
 	"otel-mock/services"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
+// shutdownTimeout bounds how long each server gets to drain in-flight
+// requests once a shutdown signal arrives.
+const shutdownTimeout = 5 * time.Second
+
+// goService describes how to start one of the Go services. run blocks until
+// ctx is cancelled and calls ready once the service is accepting requests.
+type goService struct {
+	name string
+	run  func(ctx context.Context, tel *common.TelemetryProviders, ready func())
+}
+
+// httpService adapts a service built as an *http.Server
+func httpService(name string, newServer func(ctx context.Context, tel *common.TelemetryProviders) *http.Server) goService {
+	return goService{name, func(ctx context.Context, tel *common.TelemetryProviders, ready func()) {
+		server := newServer(ctx, tel)
+		logStartup(tel, server.Addr)
+		serveUntilDone(ctx, server, ready)
+	}}
+}
+
+// goServices lists every service in start order: servers first, then the
+// Kafka consumers, then checkout which calls into the others.
+var goServices = []goService{
+	httpService("shipping", func(ctx context.Context, tel *common.TelemetryProviders) *http.Server {
+		return services.InitShippingService(ctx, ":8082", tel.TracerProvider, tel.MeterProvider, tel.LoggerProvider)
+	}),
+	httpService("product-catalog", func(ctx context.Context, tel *common.TelemetryProviders) *http.Server {
+		return services.InitProductCatalogService(ctx, ":8085", tel.TracerProvider, tel.MeterProvider, tel.LoggerProvider)
+	}),
+	httpService("cart", func(ctx context.Context, tel *common.TelemetryProviders) *http.Server {
+		return services.InitCartService(ctx, ":8084", tel.TracerProvider, tel.MeterProvider, tel.LoggerProvider)
+	}),
+	httpService("currency", func(ctx context.Context, tel *common.TelemetryProviders) *http.Server {
+		return services.InitCurrencyService(ctx, ":8089", tel.TracerProvider, tel.MeterProvider, tel.LoggerProvider)
+	}),
+	httpService("accounting", func(ctx context.Context, tel *common.TelemetryProviders) *http.Server {
+		return services.InitAccountingService(ctx, ":8091", tel.TracerProvider, tel.MeterProvider, tel.LoggerProvider)
+	}),
+	httpService("fraud-detection", func(ctx context.Context, tel *common.TelemetryProviders) *http.Server {
+		return services.InitFraudDetectionService(ctx, ":8092", tel.TracerProvider, tel.MeterProvider, tel.LoggerProvider)
+	}),
+	httpService("checkout", func(ctx context.Context, tel *common.TelemetryProviders) *http.Server {
+		return services.InitCheckoutServer(ctx, ":8083", tel.TracerProvider, tel.MeterProvider, tel.LoggerProvider)
+	}),
+}
+
 func main() {
-	service := flag.String("service", "all", "Service to run: all, checkout, shipping, product-catalog, cart, currency")
+	service := flag.String("service", "all", "Service to run: all, checkout, shipping, product-catalog, cart, currency, accounting, fraud-detection, loadgen")
+	rps := flag.Float64("rps", 2, "loadgen: shopping sessions started per second")
+	concurrency := flag.Int("concurrency", 4, "loadgen: maximum sessions in flight")
+	configPath := flag.String("config", "", "YAML or JSON config file; flags and env vars override it")
 	flag.Parse()
 
-	ctx := context.Background()
+	var fileConfig *common.Config
+	if *configPath != "" {
+		var err error
+		if fileConfig, err = common.LoadConfig(*configPath); err != nil {
+			log.Fatalf("%v", err)
+		}
+		fileConfig.Apply()
+	}
+	ignoreSharedServiceName(*service)
+	common.ServeDebugConfig()
+	common.ServeFlags()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	common.StartCPUWorkers(ctx, config.SimulateCPUWorkers)
 
-	switch *service {
-	case "all":
-		runAllServices(ctx)
-	default:
-		log.Fatalf("Unknown service: %s", *service)
+	if *service == "loadgen" {
+		if *rps <= 0 || *concurrency <= 0 {
+			log.Fatalf("-rps and -concurrency must be positive")
+		}
+		runService(ctx, goService{"loadgen", func(ctx context.Context, tel *common.TelemetryProviders, ready func()) {
+			ready()
+			services.RunLoadGenerator(ctx, tel.TracerProvider, tel.MeterProvider, tel.LoggerProvider, *rps, *concurrency)
+		}}, func() {})
+		return
+	}
+	svcs, err := servicesFor(*service, fileConfig)
+	if err != nil {
+		log.Fatalf("%v", err)
 	}
+	if *service == "all" {
+		runAllServices(ctx, svcs)
+		return
+	}
+	runService(ctx, svcs[0], func() {})
 }
 
-func runAllServices(ctx context.Context) {
+// servicesFor returns the services -service=name starts. Only "all" consults
+// the config file's services section; a service named on the command line
+// runs even if the file disables it.
+func servicesFor(name string, fileConfig *common.Config) ([]goService, error) {
+	if name != "all" {
+		for _, svc := range goServices {
+			if svc.name == name {
+				return []goService{svc}, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown service: %s", name)
+	}
+
+	var svcs []goService
+	for _, svc := range goServices {
+		if !fileConfig.ServiceEnabled(svc.name) {
+			log.Printf("%s: disabled by config file", svc.name)
+			continue
+		}
+		svcs = append(svcs, svc)
+	}
+	return svcs, nil
+}
+
+// ignoreSharedServiceName drops OTEL_SERVICE_NAME when several services
+// share the process: it would give them all one service.name.
+func ignoreSharedServiceName(service string) {
+	if service == "all" && config.ServiceName != "" {
+		log.Printf("WARNING: ignoring OTEL_SERVICE_NAME=%q with -service all; it only applies when running a single service", config.ServiceName)
+		config.ServiceName = ""
+	}
+}
+
+// runAllServices starts svcs one at a time in order, waiting for each to be
+// ready so nothing is called before it's listening. A service that fails to
+// start is skipped rather than waited on forever.
+func runAllServices(ctx context.Context, svcs []goService) {
 	var wg sync.WaitGroup
+	var names []string
 
-	// Start servers first
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		tel := common.InitTelemetry(ctx, "shipping")
-		defer tel.Shutdown(ctx)
-		services.RunShippingService(tel.TracerProvider, tel.LoggerProvider)
-	}()
+	for _, svc := range svcs {
+		names = append(names, svc.name)
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		tel := common.InitTelemetry(ctx, "product-catalog")
-		defer tel.Shutdown(ctx)
-		services.RunProductCatalogService(tel.TracerProvider, tel.LoggerProvider)
-	}()
+		ready := make(chan struct{})
+		var once sync.Once
+		markReady := func() { once.Do(func() { close(ready) }) }
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		tel := common.InitTelemetry(ctx, "cart")
-		defer tel.Shutdown(ctx)
-		services.RunCartService(tel.TracerProvider, tel.LoggerProvider)
-	}()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer markReady()
+			runService(ctx, svc, markReady)
+		}()
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		tel := common.InitTelemetry(ctx, "currency")
-		defer tel.Shutdown(ctx)
-		services.RunCurrencyService(tel.TracerProvider, tel.LoggerProvider)
-	}()
+		select {
+		case <-ready:
+		case <-ctx.Done():
+		}
+	}
+	// The summary covers the whole process rather than one service.name, so
+	// it only goes to stderr; the per-service lines are exported too
+	startupLog.Info("Go services started", append([]any{"services", strings.Join(names, ",")}, telemetrySettings()...)...)
 
-	// Kafka consumer services (accounting and fraud-detection)
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		tel := common.InitTelemetry(ctx, "accounting")
-		defer tel.Shutdown(ctx)
-		server := services.InitAccountingService(":8091", tel.TracerProvider, tel.MeterProvider, tel.LoggerProvider)
-		server.ListenAndServe()
-	}()
+	wg.Wait()
+	log.Println("All Go services stopped")
+}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		tel := common.InitTelemetry(ctx, "fraud-detection")
-		defer tel.Shutdown(ctx)
-		server := services.InitFraudDetectionService(":8092", tel.TracerProvider, tel.MeterProvider, tel.LoggerProvider)
-		server.ListenAndServe()
-	}()
+// runService initializes telemetry for svc, runs it until ctx is cancelled
+// and then flushes its telemetry.
+func runService(ctx context.Context, svc goService, ready func()) {
+	tel, ok := initTelemetry(ctx, svc.name)
+	if !ok {
+		return
+	}
+	defer shutdownTelemetry(tel)
+	common.StartHeartbeat(ctx, tel.ServiceName, tel.MeterProvider, tel.LoggerProvider)
+	svc.run(ctx, tel, ready)
+}
+
+// initTelemetry sets up telemetry for one service. A failure is logged and
+// only that service is skipped, so one bad exporter config doesn't take down
+// the rest of the demo.
+func initTelemetry(ctx context.Context, serviceName string) (*common.TelemetryProviders, bool) {
+	tel, err := common.InitTelemetry(ctx, serviceName,
+		// Also kept at span level for backends that only index span attributes
+		common.WithSpanAttributes(attribute.String("deployment.environment", "demo")),
+	)
+	if err != nil {
+		log.Printf("%s: telemetry init failed, not starting service: %v", serviceName, err)
+		return nil, false
+	}
+	return tel, true
+}
+
+// startupLog prints startup lines as key=value on stderr
+var startupLog = slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+// logStartup records the configuration a service picked up, once on stderr
+// and once through its OTLP logger
+func logStartup(tel *common.TelemetryProviders, addr string) {
+	args := append([]any{"service", tel.ServiceName, "addr", addr}, telemetrySettings()...)
+	startupLog.Info("Service starting", args...)
+	common.NewLogger(tel.ServiceName, tel.LoggerProvider).Info("Service starting", args...)
+}
+
+func telemetrySettings() []any {
+	return []any{
+		"commit", common.ResolveServiceCommit(),
+		"otlp_endpoint", config.OTLPEndpoint,
+		"sampler", config.TracesSampler,
+		"sampler_arg", config.TracesSamplerArg,
+		"host_metrics", config.EnableHostMetrics,
+		"runtime_metrics", config.EnableRuntimeMetrics,
+	}
+}
+
+// serveUntilDone binds server's address, calls ready, and serves until ctx is
+// cancelled, then shuts it down within shutdownTimeout and runs its
+// common.OnShutdown hooks.
+func serveUntilDone(ctx context.Context, server *http.Server, ready func()) {
+	ln, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		log.Printf("server on %s failed: %v", server.Addr, err)
+		return
+	}
+	ready()
 
-	// Checkout HTTP server
-	wg.Add(1)
 	go func() {
-		defer wg.Done()
-		tel := common.InitTelemetry(ctx, "checkout")
-		defer tel.Shutdown(ctx)
-		server := services.InitCheckoutServer(":8083", tel.TracerProvider, tel.LoggerProvider)
-		server.ListenAndServe()
+		if err := server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("server on %s failed: %v", server.Addr, err)
+		}
 	}()
 
-	// Wait for servers to start
-	log.Println("Waiting for Go services to start...")
-	time.Sleep(2 * time.Second)
+	<-ctx.Done()
 
-	wg.Wait()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := common.Shutdown(shutdownCtx, server); err != nil {
+		log.Printf("server on %s did not shut down cleanly: %v", server.Addr, err)
+	}
+}
+
+// shutdownTelemetry flushes tel. The root context is already cancelled at
+// this point, so a fresh one is used; tel applies its own per-provider timeout.
+func shutdownTelemetry(tel *common.TelemetryProviders) {
+	if err := tel.Shutdown(context.Background()); err != nil {
+		log.Printf("telemetry shutdown: %v", err)
+	}
 }
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"otel-mock/common"
+	"otel-mock/config"
+	"testing"
+	"time"
+)
+
+// The -service flag outranks the config file's services section
+func TestServicesForFlagOverridesFile(t *testing.T) {
+	file := &common.Config{Services: map[string]bool{"cart": false}}
+
+	svcs, err := servicesFor("cart", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(svcs) != 1 || svcs[0].name != "cart" {
+		t.Errorf("servicesFor(cart) = %v, want just cart", serviceNames(svcs))
+	}
+
+	svcs, err = servicesFor("all", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range serviceNames(svcs) {
+		if name == "cart" {
+			t.Errorf("servicesFor(all) started cart, which the file disables")
+		}
+	}
+	if len(svcs) != len(goServices)-1 {
+		t.Errorf("servicesFor(all) = %v, want every service but cart", serviceNames(svcs))
+	}
+
+	if _, err := servicesFor("nope", file); err == nil {
+		t.Error("servicesFor(nope) succeeded, want an unknown service error")
+	}
+}
+
+func serviceNames(svcs []goService) []string {
+	names := make([]string, len(svcs))
+	for i, svc := range svcs {
+		names[i] = svc.name
+	}
+	return names
+}
+
+func TestIgnoreSharedServiceName(t *testing.T) {
+	tests := []struct {
+		service string
+		want    string
+	}{
+		{"all", ""},
+		{"cart", "renamed"},
+		{"loadgen", "renamed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.service, func(t *testing.T) {
+			old := config.ServiceName
+			t.Cleanup(func() { config.ServiceName = old })
+			config.ServiceName = "renamed"
+
+			ignoreSharedServiceName(tt.service)
+			if config.ServiceName != tt.want {
+				t.Errorf("ServiceName after -service %s = %q, want %q", tt.service, config.ServiceName, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeUntilDoneShutsDownOnCancel(t *testing.T) {
+	server := &http.Server{Addr: "127.0.0.1:0", Handler: http.NotFoundHandler()}
+	stopped := make(chan struct{})
+	server.RegisterOnShutdown(func() { close(stopped) })
+	hookRan := false
+	common.OnShutdown(server, func() { hookRan = true })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ready := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		serveUntilDone(ctx, server, func() { close(ready) })
+		close(done)
+	}()
+
+	select {
+	case <-ready:
+	case <-done:
+		t.Fatal("serveUntilDone returned before the server was ready")
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(shutdownTimeout + time.Second):
+		t.Fatal("serveUntilDone did not return after the context was cancelled")
+	}
+
+	// http.Server runs its own shutdown hooks in goroutines
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Error("server.Shutdown was not called")
+	}
+	if !hookRan {
+		t.Error("OnShutdown hook did not run before serveUntilDone returned")
+	}
+}
+
+// freeAddr returns a loopback address nothing is listening on
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// Each service starts only once the ones before it are listening, which the
+// last one checks by dialing them all
+func TestRunAllServicesWaitsForReady(t *testing.T) {
+	old := config.SDKDisabled
+	t.Cleanup(func() { config.SDKDisabled = old })
+	config.SDKDisabled = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var addrs []string
+	var svcs []goService
+	for _, name := range []string{"first", "second", "third"} {
+		addr := freeAddr(t)
+		svcs = append(svcs, httpService(name, func(context.Context, *common.TelemetryProviders) *http.Server {
+			return &http.Server{Addr: addr, Handler: http.NotFoundHandler()}
+		}))
+		addrs = append(addrs, addr)
+	}
+	svcs = append(svcs, goService{"checker", func(ctx context.Context, _ *common.TelemetryProviders, ready func()) {
+		defer cancel()
+		for _, addr := range addrs {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Errorf("%s not listening when the next service started: %v", addr, err)
+				continue
+			}
+			conn.Close()
+		}
+		ready()
+	}})
+
+	done := make(chan struct{})
+	go func() {
+		runAllServices(ctx, svcs)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(shutdownTimeout + time.Second):
+		t.Fatal("runAllServices did not return after the context was cancelled")
+	}
+}
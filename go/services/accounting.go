@@ -6,9 +6,11 @@ import (
 	"log/slog"
 	"math/rand"
 	"net/http"
+	"otel-mock/common"
+	"otel-mock/config"
+	"time"
 
-	"go.opentelemetry.io/contrib/bridges/otelslog"
-	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"github.com/segmentio/kafka-go"
 	"go.opentelemetry.io/otel/attribute"
 	otellog "go.opentelemetry.io/otel/log"
 	"go.opentelemetry.io/otel/metric"
@@ -21,82 +23,100 @@ var (
 	accountingLogger *slog.Logger
 )
 
+// accountingConsumerGroup is the Kafka consumer group, also reported on mocked deliveries
+const accountingConsumerGroup = "accountingservice"
+
 var (
-	ordersProcessed metric.Int64Counter
-	revenueTotal    metric.Float64Counter
+	ordersProcessed           metric.Int64Counter
+	revenueTotal              metric.Float64Counter
+	accountingProcessDuration metric.Float64Histogram
 )
 
-func InitAccountingService(port string, tp trace.TracerProvider, mp metric.MeterProvider, lp otellog.LoggerProvider) *http.Server {
+func InitAccountingService(ctx context.Context, port string, tp trace.TracerProvider, mp metric.MeterProvider, lp otellog.LoggerProvider) *http.Server {
 	accountingTracer = tp.Tracer("accounting")
 	accountingMeter = mp.Meter("accounting")
+	accountingLogger = common.NewLogger("accounting", lp)
 
 	var err error
-	ordersProcessed, err = accountingMeter.Int64Counter("app.accounting.orders_processed",
+	ordersProcessed, err = accountingMeter.Int64Counter("accounting.orders.processed",
 		metric.WithDescription("Total orders processed by accounting"),
 		metric.WithUnit("{orders}"))
 	if err != nil {
-		slog.Error("Failed to create orders_processed counter", "error", err)
+		accountingLogger.Error("Failed to create accounting.orders.processed counter", "error", err)
 	}
 
-	revenueTotal, err = accountingMeter.Float64Counter("app.accounting.revenue_total",
-		metric.WithDescription("Total revenue processed"),
-		metric.WithUnit("USD"))
+	// Orders arrive in several currencies, so the unit is carried by the
+	// currency attribute; only sum series that share it
+	revenueTotal, err = accountingMeter.Float64Counter("accounting.revenue.total",
+		metric.WithDescription("Revenue from processed orders, per currency"),
+		metric.WithUnit("{amount}"))
 	if err != nil {
-		slog.Error("Failed to create revenue_total counter", "error", err)
+		accountingLogger.Error("Failed to create accounting.revenue.total counter", "error", err)
+	}
+
+	accountingProcessDuration, err = newProcessDuration(accountingMeter)
+	if err != nil {
+		accountingLogger.Error("Failed to create messaging.process.duration histogram", "error", err)
 	}
 
 	mux := http.NewServeMux()
-	// Wrap with otelhttp to extract trace context from incoming requests
-	mux.Handle("/consume", otelhttp.NewHandler(
-		http.HandlerFunc(handleAccountingConsume),
-		"orders receive",
-		otelhttp.WithTracerProvider(tp),
-	))
+	mux.Handle("/consume", common.Recover("accounting", mp, lp, common.InjectFaults("accounting", http.HandlerFunc(handleAccountingConsume))))
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(`{"status":"ok"}`))
 	})
+	health := common.NewHealth()
+	health.AddCheck("collector", common.CollectorCheck())
+	health.Register(mux)
 
+	// The server span extracts trace context from the mocked Kafka message
 	server := &http.Server{
 		Addr:    port,
-		Handler: mux,
+		Handler: common.NewServerHandler(mux, "accounting", tp, mp, map[string]string{"/consume": "orders receive"}),
+	}
+
+	if len(config.KafkaBrokers) > 0 {
+		health.AddCheck("kafka", common.KafkaCheck(config.KafkaBrokers, ordersTopic))
+		startOrdersConsumer(ctx, server, tp, accountingMeter, accountingConsumerGroup, accountingLogger, consumeAccountingMessage)
 	}
 
-	accountingLogger = otelslog.NewLogger("accounting", otelslog.WithLoggerProvider(lp))
 	accountingLogger.Info("Accounting Service starting", "port", port)
+	// Telemetry is initialized before any service starts, so startup is done
+	health.MarkReady()
 	return server
 }
 
 func handleAccountingConsume(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
-	// Get span from otelhttp handler (already creates "orders receive" span)
+	// Get span from the server handler (already named "orders receive")
 	span := trace.SpanFromContext(ctx)
+	linkProducer(r)
 
 	// Add Kafka messaging attributes to the existing span
 	span.SetAttributes(
 		attribute.String("messaging.system", "kafka"),
 		attribute.String("messaging.destination.name", "orders"),
 		attribute.String("messaging.operation.type", "receive"),
-		attribute.String("messaging.consumer.group.name", "accountingservice"),
+		attribute.String("messaging.consumer.group.name", accountingConsumerGroup),
 	)
 
-	accountingLogger.InfoContext(ctx, "Received order from Kafka", "topic", "orders", "consumer_group", "accountingservice")
+	accountingLogger.InfoContext(ctx, "Received order from Kafka", "topic", "orders", "consumer_group", accountingConsumerGroup)
 
 	// Simulate processing order for accounting
-	processOrder(ctx)
+	start := time.Now()
+	processOrder(ctx, orderFromRequest(r))
+	recordProcessDuration(ctx, accountingProcessDuration, accountingConsumerGroup, start)
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"status": "processed"})
 }
 
-func processOrder(ctx context.Context) {
+func processOrder(ctx context.Context, order orderEvent) {
 	ctx, span := accountingTracer.Start(ctx, "processOrder")
 	defer span.End()
 
-	orderID := "order-" + randomString(8)
-	amount := float64(rand.Intn(50000)+1000) / 100.0
-	currency := []string{"USD", "EUR", "GBP", "JPY"}[rand.Intn(4)]
+	orderID, amount, currency := order.OrderID, order.Amount, order.Currency
 
 	accountingLogger.InfoContext(ctx, "ProcessOrder started", "order_id", orderID, "amount", amount, "currency", currency)
 
@@ -132,3 +152,14 @@ func randomString(n int) string {
 	}
 	return string(b)
 }
+
+// consumeAccountingMessage handles an order delivered through Kafka. The
+// CONSUMER span is already started, and undecodable messages were already
+// dead-lettered.
+func consumeAccountingMessage(ctx context.Context, msg kafka.Message, order orderEvent) error {
+	accountingLogger.InfoContext(ctx, "Received order from Kafka", "topic", msg.Topic, "consumer_group", accountingConsumerGroup, "offset", msg.Offset, "order_id", order.OrderID)
+	start := time.Now()
+	processOrder(ctx, order)
+	recordProcessDuration(ctx, accountingProcessDuration, accountingConsumerGroup, start)
+	return nil
+}
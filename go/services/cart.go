@@ -2,24 +2,18 @@ package services
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"log"
 	"log/slog"
 	"math/rand"
 	"net/http"
-	"os"
+	"otel-mock/common"
+	"otel-mock/config"
 	"time"
 
-	"github.com/redis/go-redis/extra/redisotel/v9"
-	"github.com/redis/go-redis/v9"
-	"go.opentelemetry.io/contrib/bridges/otelslog"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
-	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	otellog "go.opentelemetry.io/otel/log"
 	"go.opentelemetry.io/otel/metric"
-	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	"go.opentelemetry.io/otel/trace"
 )
 
@@ -29,7 +23,9 @@ var (
 	addItemLatency metric.Float64Histogram
 	getCartLatency metric.Float64Histogram
 	cartOperations metric.Int64Counter
-	redisClient    *redis.Client
+	cartItems      metric.Int64UpDownCounter
+	cartSize       metric.Int64Histogram
+	cartStore      CartStore
 )
 
 type CartItem struct {
@@ -37,8 +33,8 @@ type CartItem struct {
 	Quantity  int    `json:"quantity"`
 }
 
-func initCartMetrics() {
-	cartMeter = otel.Meter("cart")
+func initCartMetrics(mp metric.MeterProvider) {
+	cartMeter = mp.Meter("cart")
 	var err error
 
 	addItemLatency, err = cartMeter.Float64Histogram("app.cart.add_item.latency",
@@ -61,60 +57,75 @@ func initCartMetrics() {
 	if err != nil {
 		panic(err)
 	}
+
+	cartItems, err = cartMeter.Int64UpDownCounter("cart.items",
+		metric.WithDescription("Items currently held in carts"),
+		metric.WithUnit("{items}"))
+	if err != nil {
+		panic(err)
+	}
+
+	// Checkout empties the cart once the order is prepared, so the size at
+	// empty time is the size at checkout
+	cartSize, err = cartMeter.Int64Histogram("cart.size",
+		metric.WithDescription("Items in a cart when it is emptied at checkout"),
+		metric.WithUnit("{items}"),
+		metric.WithExplicitBucketBoundaries(1, 2, 3, 5, 10, 20, 50))
+	if err != nil {
+		panic(err)
+	}
 }
 
-func initRedisClient(tp *sdktrace.TracerProvider) {
-	redisAddr := os.Getenv("REDIS_ADDR")
-	if redisAddr == "" {
-		redisAddr = "localhost:6379"
+// initCartStore picks the cart backend from CART_STORE. An unreachable Redis
+// is only logged so the service still starts; requests will fail until it's up.
+func initCartStore(ctx context.Context, tp trace.TracerProvider) {
+	if config.CartStore != "redis" {
+		if config.CartStore != "memory" {
+			cartLogger.Warn("Unknown CART_STORE, using memory", "cart_store", config.CartStore)
+		}
+		cartStore = newMemoryCartStore()
+		return
 	}
 
-	redisClient = redis.NewClient(&redis.Options{
-		Addr:     redisAddr,
-		Password: "",
-		DB:       0,
-	})
-
-	if err := redisotel.InstrumentTracing(redisClient,
-		redisotel.WithTracerProvider(tp),
-		redisotel.WithAttributes(
-			attribute.String("db.system", "redis"),
-			attribute.String("db.name", "cart"),
-		),
-	); err != nil {
-		log.Printf("Failed to instrument Redis: %v", err)
+	store, err := newRedisCartStore(config.RedisAddr, tp)
+	if err != nil {
+		cartLogger.Error("Failed to instrument Redis", "error", err)
+		cartStore = newMemoryCartStore()
+		return
 	}
+	cartStore = store
 
 	// Test connection
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	if err := redisClient.Ping(ctx).Err(); err != nil {
-		log.Printf("Warning: Redis not available at %s: %v", redisAddr, err)
+	if err := store.client.Ping(ctx).Err(); err != nil {
+		cartLogger.Warn("Redis not available", "addr", config.RedisAddr, "error", err)
 	} else {
-		log.Printf("Connected to Redis at %s", redisAddr)
+		cartLogger.Info("Connected to Redis", "addr", config.RedisAddr)
 	}
 }
 
-func RunCartService(tp *sdktrace.TracerProvider, lp otellog.LoggerProvider) {
-	cartLogger = otelslog.NewLogger("cart", otelslog.WithLoggerProvider(lp))
-	initCartMetrics()
-	initRedisClient(tp)
+// InitCartService creates the cart HTTP server on port; the caller starts it
+func InitCartService(ctx context.Context, port string, tp trace.TracerProvider, mp metric.MeterProvider, lp otellog.LoggerProvider) *http.Server {
+	cartLogger = common.NewLogger("cart", lp)
+	initCartMetrics(mp)
+	initCartStore(ctx, tp)
 
 	addHandler := otelhttp.NewHandler(
-		http.HandlerFunc(addItemHandler),
+		common.Recover("cart", mp, lp, common.InjectFaults("cart", http.HandlerFunc(addItemHandler))),
 		"AddItem",
 		otelhttp.WithTracerProvider(tp),
 	)
 
 	getHandler := otelhttp.NewHandler(
-		http.HandlerFunc(getCartHandler),
+		common.Recover("cart", mp, lp, common.InjectFaults("cart", http.HandlerFunc(getCartHandler))),
 		"GetCart",
 		otelhttp.WithTracerProvider(tp),
 	)
 
 	emptyHandler := otelhttp.NewHandler(
-		http.HandlerFunc(emptyCartHandler),
+		common.Recover("cart", mp, lp, common.InjectFaults("cart", http.HandlerFunc(emptyCartHandler))),
 		"EmptyCart",
 		otelhttp.WithTracerProvider(tp),
 	)
@@ -124,11 +135,8 @@ func RunCartService(tp *sdktrace.TracerProvider, lp otellog.LoggerProvider) {
 	mux.Handle("/cart", getHandler)
 	mux.Handle("/cart/empty", emptyHandler)
 
-	port := ":8084"
 	cartLogger.Info("Cart Service starting", "port", port)
-	if err := http.ListenAndServe(port, mux); err != nil {
-		cartLogger.Error("Cart Service failed", "error", err)
-	}
+	return &http.Server{Addr: port, Handler: mux}
 }
 
 func addItemHandler(w http.ResponseWriter, r *http.Request) {
@@ -152,23 +160,17 @@ func addItemHandler(w http.ResponseWriter, r *http.Request) {
 		attribute.Int("app.product.quantity", quantity),
 	)
 
-	// Create cart item
 	item := CartItem{ProductID: productID, Quantity: quantity}
-	itemJSON, _ := json.Marshal(item)
-
-	cartKey := fmt.Sprintf("cart:%s", userID)
-	err := redisClient.HSet(ctx, cartKey, productID, itemJSON).Err()
-	if err != nil {
+	if err := cartStore.AddItem(ctx, userID, item); err != nil {
 		span.RecordError(err)
 		cartLogger.ErrorContext(ctx, "Failed to add item to cart", "error", err)
 		http.Error(w, "Failed to add item", http.StatusInternalServerError)
 		return
 	}
 
-	redisClient.Expire(ctx, cartKey, time.Hour)
-
 	duration := float64(time.Since(start).Milliseconds())
 	addItemLatency.Record(ctx, duration)
+	cartItems.Add(ctx, int64(quantity))
 	cartOperations.Add(ctx, 1, metric.WithAttributes(
 		attribute.String("operation", "add_item"),
 	))
@@ -196,8 +198,7 @@ func getCartHandler(w http.ResponseWriter, r *http.Request) {
 	span.SetAttributes(attribute.String("app.user.id", userID))
 	span.AddEvent("Fetch cart")
 
-	cartKey := fmt.Sprintf("cart:%s", userID)
-	items, err := redisClient.HGetAll(ctx, cartKey).Result()
+	items, err := cartStore.Get(ctx, userID)
 	if err != nil {
 		span.RecordError(err)
 		cartLogger.ErrorContext(ctx, "Failed to get cart", "error", err)
@@ -205,13 +206,7 @@ func getCartHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	totalItems := 0
-	for _, itemJSON := range items {
-		var item CartItem
-		if json.Unmarshal([]byte(itemJSON), &item) == nil {
-			totalItems += item.Quantity
-		}
-	}
+	totalItems := countItems(items)
 
 	span.SetAttributes(attribute.Int("app.cart.items.count", totalItems))
 
@@ -242,21 +237,39 @@ func emptyCartHandler(w http.ResponseWriter, r *http.Request) {
 	span.SetAttributes(attribute.String("app.user.id", userID))
 	span.AddEvent("Empty cart")
 
-	cartKey := fmt.Sprintf("cart:%s", userID)
-	err := redisClient.Del(ctx, cartKey).Err()
+	items, err := cartStore.Get(ctx, userID)
 	if err != nil {
 		span.RecordError(err)
 		cartLogger.ErrorContext(ctx, "Failed to empty cart", "error", err)
 		http.Error(w, "Failed to empty cart", http.StatusInternalServerError)
 		return
 	}
+	totalItems := countItems(items)
+
+	if err := cartStore.Empty(ctx, userID); err != nil {
+		span.RecordError(err)
+		cartLogger.ErrorContext(ctx, "Failed to empty cart", "error", err)
+		http.Error(w, "Failed to empty cart", http.StatusInternalServerError)
+		return
+	}
 
 	cartOperations.Add(ctx, 1, metric.WithAttributes(
 		attribute.String("operation", "empty_cart"),
 	))
+	cartItems.Add(ctx, -int64(totalItems))
+	cartSize.Record(ctx, int64(totalItems))
 
 	cartLogger.InfoContext(ctx, "EmptyCart", "user_id", userID)
 
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintf(w, `{"status": "emptied", "user_id": "%s"}`, userID)
 }
+
+// countItems sums the quantities in a cart
+func countItems(items []CartItem) int {
+	total := 0
+	for _, item := range items {
+		total += item.Quantity
+	}
+	return total
+}
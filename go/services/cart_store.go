@@ -0,0 +1,165 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/extra/redisotel/v9"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// cartTTL is how long an untouched Redis cart is kept
+const cartTTL = time.Hour
+
+// CartStore holds each user's cart. Adding a product that's already in the
+// cart increases its quantity.
+type CartStore interface {
+	Get(ctx context.Context, userID string) ([]CartItem, error)
+	AddItem(ctx context.Context, userID string, item CartItem) error
+	Empty(ctx context.Context, userID string) error
+}
+
+// memoryCartStore keeps carts in process; they're lost on restart
+type memoryCartStore struct {
+	mu    sync.Mutex
+	carts map[string]map[string]CartItem
+}
+
+func newMemoryCartStore() *memoryCartStore {
+	return &memoryCartStore{carts: make(map[string]map[string]CartItem)}
+}
+
+func (s *memoryCartStore) Get(_ context.Context, userID string) ([]CartItem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	items := make([]CartItem, 0, len(s.carts[userID]))
+	for _, item := range s.carts[userID] {
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func (s *memoryCartStore) AddItem(_ context.Context, userID string, item CartItem) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.carts[userID] == nil {
+		s.carts[userID] = make(map[string]CartItem)
+	}
+	existing := s.carts[userID][item.ProductID]
+	item.Quantity += existing.Quantity
+	s.carts[userID][item.ProductID] = item
+	return nil
+}
+
+func (s *memoryCartStore) Empty(_ context.Context, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.carts, userID)
+	return nil
+}
+
+// redisCartStore keeps each cart in a Redis hash of product ID to the item
+// as JSON. Every command shows up as a span through redisotel.
+type redisCartStore struct {
+	client *redis.Client
+}
+
+func newRedisCartStore(addr string, tp trace.TracerProvider) (*redisCartStore, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     addr,
+		Password: "",
+		DB:       0,
+	})
+
+	if err := redisotel.InstrumentTracing(client,
+		redisotel.WithTracerProvider(tp),
+		redisotel.WithAttributes(
+			attribute.String("db.system", "redis"),
+			attribute.String("db.name", "cart"),
+		),
+	); err != nil {
+		return nil, fmt.Errorf("instrumenting Redis: %w", err)
+	}
+	return &redisCartStore{client: client}, nil
+}
+
+func cartKey(userID string) string {
+	return fmt.Sprintf("cart:%s", userID)
+}
+
+func (s *redisCartStore) Get(ctx context.Context, userID string) ([]CartItem, error) {
+	fields, err := s.client.HGetAll(ctx, cartKey(userID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	items := make([]CartItem, 0, len(fields))
+	for productID, value := range fields {
+		if item, ok := decodeCartItem(productID, value); ok {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+// decodeCartItem parses one cart hash value. Items are stored as JSON; a
+// bare quantity is also accepted, since for a while carts were written that
+// way and they live for up to cartTTL.
+func decodeCartItem(productID, value string) (CartItem, bool) {
+	var item CartItem
+	if json.Unmarshal([]byte(value), &item) == nil {
+		return item, true
+	}
+	if n, err := strconv.Atoi(value); err == nil {
+		return CartItem{ProductID: productID, Quantity: n}, true
+	}
+	return CartItem{}, false
+}
+
+// maxAddAttempts bounds how often AddItem retries when another add to the
+// same cart lands between its read and its write
+const maxAddAttempts = 3
+
+func (s *redisCartStore) AddItem(ctx context.Context, userID string, item CartItem) error {
+	key := cartKey(userID)
+	// The quantity accumulates inside the item's JSON, so the read and the
+	// write run under WATCH and are retried if the cart changed in between
+	add := func(tx *redis.Tx) error {
+		added := item
+		existing, err := tx.HGet(ctx, key, item.ProductID).Result()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return err
+		}
+		if prev, ok := decodeCartItem(item.ProductID, existing); ok {
+			added.Quantity += prev.Quantity
+		}
+		itemJSON, err := json.Marshal(added)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, key, item.ProductID, itemJSON)
+			pipe.Expire(ctx, key, cartTTL)
+			return nil
+		})
+		return err
+	}
+
+	var err error
+	for range maxAddAttempts {
+		if err = s.client.Watch(ctx, add, key); !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+	return err
+}
+
+func (s *redisCartStore) Empty(ctx context.Context, userID string) error {
+	return s.client.Del(ctx, cartKey(userID)).Err()
+}
@@ -0,0 +1,49 @@
+package services
+
+import (
+	"context"
+	"testing"
+)
+
+func TestDecodeCartItem(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  string
+		want   CartItem
+		wantOK bool
+	}{
+		{"JSON item", `{"product_id":"OLJCESPC7Z","quantity":3}`, CartItem{ProductID: "OLJCESPC7Z", Quantity: 3}, true},
+		{"bare quantity", "2", CartItem{ProductID: "OLJCESPC7Z", Quantity: 2}, true},
+		{"missing", "", CartItem{}, false},
+		{"garbage", "not an item", CartItem{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := decodeCartItem("OLJCESPC7Z", tt.value)
+			if ok != tt.wantOK || got != tt.want {
+				t.Errorf("decodeCartItem(%q) = %+v, %v; want %+v, %v", tt.value, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestMemoryCartStoreAccumulates(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryCartStore()
+	store.AddItem(ctx, "u1", CartItem{ProductID: "p1", Quantity: 2})
+	store.AddItem(ctx, "u1", CartItem{ProductID: "p1", Quantity: 1})
+	store.AddItem(ctx, "u1", CartItem{ProductID: "p2", Quantity: 4})
+
+	items, err := store.Get(ctx, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := countItems(items); got != 7 {
+		t.Errorf("cart holds %d items, want 7: %+v", got, items)
+	}
+
+	store.Empty(ctx, "u1")
+	if items, _ := store.Get(ctx, "u1"); len(items) != 0 {
+		t.Errorf("cart after Empty = %+v, want empty", items)
+	}
+}
@@ -1,22 +1,25 @@
 package services
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"math/rand"
 	"net/http"
+	"net/url"
+	"otel-mock/common"
 	"otel-mock/config"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
-	"go.opentelemetry.io/contrib/bridges/otelslog"
-	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
-	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/codes"
 	otellog "go.opentelemetry.io/otel/log"
 	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/trace"
@@ -28,10 +31,14 @@ var (
 	checkoutMeter   metric.Meter
 	ordersCounter   metric.Int64Counter
 	checkoutLatency metric.Float64Histogram
+	checkoutOrders  metric.Int64Counter
+	checkoutAmount  metric.Float64Histogram
+	currencyBreaker *common.CircuitBreaker
+	orderProducer   *common.KafkaProducer
 )
 
-func initCheckoutMetrics() {
-	checkoutMeter = otel.Meter("checkout")
+func initCheckoutMetrics(mp metric.MeterProvider) {
+	checkoutMeter = mp.Meter("checkout")
 	var err error
 	ordersCounter, err = checkoutMeter.Int64Counter("app.checkout.orders_total",
 		metric.WithDescription("Total number of orders placed"),
@@ -46,46 +53,88 @@ func initCheckoutMetrics() {
 	if err != nil {
 		panic(err)
 	}
+
+	checkoutOrders, err = checkoutMeter.Int64Counter("checkout.orders",
+		metric.WithDescription("Checkout attempts by outcome"),
+		metric.WithUnit("{orders}"))
+	if err != nil {
+		panic(err)
+	}
+
+	checkoutAmount, err = checkoutMeter.Float64Histogram("checkout.total_amount",
+		metric.WithDescription("Total charged per successful order, in the order currency"),
+		metric.WithUnit("{amount}"))
+	if err != nil {
+		panic(err)
+	}
+
+	currencyBreaker, err = common.NewCircuitBreaker("currency", checkoutMeter, common.DefaultBreakerSettings)
+	if err != nil {
+		panic(err)
+	}
 }
 
 // InitCheckoutServer creates an HTTP server for checkout (receives requests from frontend)
-func InitCheckoutServer(port string, tp trace.TracerProvider, lp otellog.LoggerProvider) *http.Server {
-	checkoutLogger = otelslog.NewLogger("checkout", otelslog.WithLoggerProvider(lp))
+func InitCheckoutServer(ctx context.Context, port string, tp trace.TracerProvider, mp metric.MeterProvider, lp otellog.LoggerProvider) *http.Server {
+	checkoutLogger = common.NewLogger("checkout", lp)
 	checkoutTracer = tp.Tracer("checkout")
-	initCheckoutMetrics()
+	initCheckoutMetrics(mp)
 
 	// HTTP client for calling downstream services
-	httpClient := &http.Client{
-		Transport: otelhttp.NewTransport(
-			http.DefaultTransport,
-			otelhttp.WithTracerProvider(tp),
-		),
-	}
-
-	handler := otelhttp.NewHandler(
-		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			placeOrder(r.Context(), httpClient)
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusOK)
-			fmt.Fprintf(w, `{"status": "order_placed"}`)
-		}),
-		"PlaceOrder",
-		otelhttp.WithTracerProvider(tp),
-	)
+	httpClient := common.NewHTTPClient(tp, mp, 0)
+
+	handler := common.RateLimit("checkout", mp, common.InjectFaults("checkout", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Every downstream call shares this deadline, so each gets only
+		// what the earlier steps left over
+		ctx, cancel := context.WithTimeout(r.Context(), config.CheckoutTimeout)
+		defer cancel()
+		span := trace.SpanFromContext(ctx)
+		span.SetAttributes(attribute.Int64("app.checkout.timeout_ms", config.CheckoutTimeout.Milliseconds()))
+
+		placeOrder(ctx, httpClient)
+		w.Header().Set("Content-Type", "application/json")
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			// otelhttp resets the description when it sees the 504, so the
+			// cause is also kept as an exception event
+			span.RecordError(ctx.Err())
+			span.SetStatus(codes.Error, "checkout deadline exceeded")
+			checkoutLogger.ErrorContext(ctx, "PlaceOrder timed out", "timeout", config.CheckoutTimeout)
+			w.WriteHeader(http.StatusGatewayTimeout)
+			fmt.Fprintf(w, `{"status": "timeout"}`)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{"status": "order_placed"}`)
+	})))
 
 	mux := http.NewServeMux()
-	mux.Handle("/checkout", handler)
+	mux.Handle("/checkout", common.Recover("checkout", mp, lp, handler))
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(`{"status":"ok"}`))
 	})
+	health := common.NewHealth()
+	health.AddCheck("collector", common.CollectorCheck())
+	health.Register(mux)
 
 	server := &http.Server{
 		Addr:    port,
-		Handler: mux,
+		Handler: common.NewServerHandler(mux, "checkout", tp, mp, map[string]string{"/checkout": "PlaceOrder"}),
+	}
+
+	if len(config.KafkaBrokers) > 0 {
+		orderProducer = common.NewKafkaProducer(config.KafkaBrokers)
+		common.OnShutdown(server, func() {
+			if err := orderProducer.Close(); err != nil {
+				checkoutLogger.Error("Closing Kafka producer failed", "error", err)
+			}
+		})
+		checkoutLogger.Info("Publishing orders to Kafka", "brokers", config.KafkaBrokers, "topic", ordersTopic)
 	}
 
 	checkoutLogger.Info("Checkout HTTP Server starting", "port", port)
+	// Telemetry is initialized before any service starts, so startup is done
+	health.MarkReady()
 	return server
 }
 
@@ -104,6 +153,7 @@ func placeOrder(ctx context.Context, client *http.Client) {
 
 	userID := fmt.Sprintf("user-%d", rand.Intn(10000))
 	currency := randomCurrency()
+	address := randomAddress()
 	orderID := uuid.New().String()
 
 	// Set main span attributes (like real checkout service)
@@ -112,22 +162,27 @@ func placeOrder(ctx context.Context, client *http.Client) {
 		attribute.String("app.user.currency", currency),
 	)
 
-	// Check for synthetic request baggage
 	bag := baggage.FromContext(ctx)
-	if m := bag.Member("synthetic_request"); m.Value() == "true" {
-		span.SetAttributes(attribute.Bool("app.synthetic", true))
-	}
 	if m := bag.Member("session.id"); m.Value() != "" {
 		span.SetAttributes(attribute.String("session.id", m.Value()))
 	}
 
+	// Carry the order's user to every downstream call and span. Incoming
+	// members are kept, so a synthetic=true request stays marked downstream;
+	// real traffic carries no marker at all.
+	ctx, err := common.WithBaggage(ctx, attribute.String("user.id", userID))
+	if err != nil {
+		checkoutLogger.WarnContext(ctx, "Setting baggage failed", "error", err)
+	}
+
 	checkoutLogger.InfoContext(ctx, "PlaceOrder started", "user_id", userID, "currency", currency)
 
 	// Step 1: Prepare order items (calls cart service with Redis)
-	prep, err := prepareOrderItems(ctx, client, userID, currency)
+	prep, err := prepareOrderItems(ctx, client, userID, currency, address)
 	if err != nil {
 		span.RecordError(err)
 		checkoutLogger.ErrorContext(ctx, "Prepare failed", "error", err)
+		checkoutOrders.Add(ctx, 1, metric.WithAttributes(attribute.String("status", "failure")))
 		return
 	}
 	span.AddEvent("prepared", trace.WithAttributes(
@@ -138,9 +193,18 @@ func placeOrder(ctx context.Context, client *http.Client) {
 	getProductDetails(ctx, client, prep.productIDs)
 	span.AddEvent("product_details_fetched")
 
-	// Step 1c: Convert currency
-	getCurrencyConversion(ctx, client, currency, prep.total)
+	// Step 1c: Convert currency. If currency is down the order is charged in
+	// USD rather than failed.
+	total, totalCurrency := prep.total, "USD"
+	if converted, err := getCurrencyConversion(ctx, client, currency, prep.total); err == nil {
+		total, totalCurrency = converted, currency
+	}
 	span.AddEvent("currency_converted")
+	span.SetAttributes(
+		attribute.Float64("order.total", total),
+		attribute.Int("order.item_count", prep.itemCount),
+		attribute.String("currency.code", totalCurrency),
+	)
 
 	// Step 1d: Get recommendations (like real demo)
 	getRecommendations(ctx, client, userID, prep.productIDs)
@@ -151,10 +215,11 @@ func placeOrder(ctx context.Context, client *http.Client) {
 	span.AddEvent("ads_fetched")
 
 	// Step 2: Charge payment
-	txID, err := chargeCard(ctx, client, prep.total, currency)
+	txID, err := chargeCard(ctx, client, total, totalCurrency)
 	if err != nil {
 		span.RecordError(err)
 		checkoutLogger.ErrorContext(ctx, "Payment failed", "error", err)
+		checkoutOrders.Add(ctx, 1, metric.WithAttributes(attribute.String("status", "failure")))
 		return
 	}
 	span.AddEvent("charged", trace.WithAttributes(
@@ -162,10 +227,11 @@ func placeOrder(ctx context.Context, client *http.Client) {
 	))
 
 	// Step 3: Ship order
-	trackingID, err := shipOrder(ctx, client, prep.itemCount)
+	trackingID, err := shipOrder(ctx, client, address, prep.productIDs)
 	if err != nil {
 		span.RecordError(err)
 		checkoutLogger.ErrorContext(ctx, "Shipping failed", "error", err)
+		checkoutOrders.Add(ctx, 1, metric.WithAttributes(attribute.String("status", "failure")))
 		return
 	}
 	span.AddEvent("shipped", trace.WithAttributes(
@@ -179,16 +245,22 @@ func placeOrder(ctx context.Context, client *http.Client) {
 	}
 	span.AddEvent("email_sent")
 
-	// Step 5: Mock Kafka publish (orders topic)
-	publishToKafka(ctx, client, orderID)
+	// Step 5: Publish to Kafka (orders topic)
+	publishToKafka(ctx, client, orderEvent{
+		OrderID:   orderID,
+		UserID:    userID,
+		Amount:    total,
+		Currency:  totalCurrency,
+		ItemCount: prep.itemCount,
+	})
 	span.AddEvent("published_to_kafka", trace.WithAttributes(
-		attribute.String("messaging.destination.name", "orders"),
+		attribute.String("messaging.destination.name", ordersTopic),
 	))
 
 	// Final attributes
 	span.SetAttributes(
 		attribute.String("app.order.id", orderID),
-		attribute.Float64("app.order.amount", prep.total),
+		attribute.Float64("app.order.amount", total),
 		attribute.Float64("app.shipping.amount", prep.shippingCost),
 		attribute.Int("app.order.items.count", prep.itemCount),
 		attribute.String("app.shipping.tracking.id", trackingID),
@@ -203,6 +275,10 @@ func placeOrder(ctx context.Context, client *http.Client) {
 	checkoutLatency.Record(ctx, duration, metric.WithAttributes(
 		attribute.String("currency", currency),
 	))
+	checkoutOrders.Add(ctx, 1, metric.WithAttributes(attribute.String("status", "success")))
+	checkoutAmount.Record(ctx, total, metric.WithAttributes(
+		attribute.String("currency", totalCurrency),
+	))
 
 	checkoutLogger.InfoContext(ctx, "Order placed successfully",
 		"order_id", orderID,
@@ -219,7 +295,7 @@ type orderPrep struct {
 	productIDs   []string
 }
 
-func prepareOrderItems(ctx context.Context, client *http.Client, userID, currency string) (*orderPrep, error) {
+func prepareOrderItems(ctx context.Context, client *http.Client, userID, currency string, address Address) (*orderPrep, error) {
 	ctx, span := checkoutTracer.Start(ctx, "prepareOrderItemsAndShippingQuoteFromCart")
 	defer span.End()
 
@@ -256,7 +332,15 @@ func prepareOrderItems(ctx context.Context, client *http.Client, userID, currenc
 	))
 
 	total := float64(rand.Intn(50000)+1000) / 100.0
-	shippingCost := float64(rand.Intn(1000)+100) / 100.0
+
+	shippingCost, err := getShippingQuote(ctx, client, address, productIDs)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	span.AddEvent("shipping_quoted", trace.WithAttributes(
+		attribute.Float64("app.shipping.amount", shippingCost),
+	))
 
 	// Step 3: Empty cart after checkout (calls Redis via cart service)
 	if err := emptyCart(ctx, client, userID); err != nil {
@@ -275,8 +359,7 @@ func prepareOrderItems(ctx context.Context, client *http.Client, userID, currenc
 func addToCart(ctx context.Context, client *http.Client, userID, productID string) error {
 	checkoutLogger.InfoContext(ctx, "AddItem", "user_id", userID, "product_id", productID)
 	url := fmt.Sprintf("%s/cart/add?user_id=%s&product_id=%s", config.CartURL, userID, productID)
-	req, _ := http.NewRequestWithContext(ctx, "POST", url, nil)
-	resp, err := client.Do(req)
+	resp, err := doWithRetry(ctx, client, "POST", url)
 	if err != nil {
 		checkoutLogger.ErrorContext(ctx, "AddItem failed", "error", err)
 		return err
@@ -286,21 +369,27 @@ func addToCart(ctx context.Context, client *http.Client, userID, productID strin
 }
 
 func getCart(ctx context.Context, client *http.Client, userID string) (int, error) {
+	ctx, span := checkoutTracer.Start(ctx, "GetCart", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	span.SetAttributes(attribute.String("app.user.id", userID))
+
 	checkoutLogger.InfoContext(ctx, "GetCart", "user_id", userID)
 	url := fmt.Sprintf("%s/cart?user_id=%s", config.CartURL, userID)
-	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
-	resp, err := client.Do(req)
+	resp, err := doWithRetry(ctx, client, "GET", url)
 	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
 		checkoutLogger.ErrorContext(ctx, "GetCart failed", "error", err)
 		return 0, err
 	}
 	defer resp.Body.Close()
+	common.SetSpanStatusFromHTTP(span, resp.StatusCode)
 
 	body, _ := io.ReadAll(resp.Body)
 	var res struct {
 		ItemsCount int `json:"items_count"`
 	}
 	json.Unmarshal(body, &res)
+	span.SetAttributes(attribute.Int("app.cart.items.count", res.ItemsCount))
 	checkoutLogger.InfoContext(ctx, "GetCart result", "items_count", res.ItemsCount)
 	return res.ItemsCount, nil
 }
@@ -308,8 +397,7 @@ func getCart(ctx context.Context, client *http.Client, userID string) (int, erro
 func emptyCart(ctx context.Context, client *http.Client, userID string) error {
 	checkoutLogger.InfoContext(ctx, "EmptyCart", "user_id", userID)
 	url := fmt.Sprintf("%s/cart/empty?user_id=%s", config.CartURL, userID)
-	req, _ := http.NewRequestWithContext(ctx, "POST", url, nil)
-	resp, err := client.Do(req)
+	resp, err := doWithRetry(ctx, client, "POST", url)
 	if err != nil {
 		checkoutLogger.ErrorContext(ctx, "EmptyCart failed", "error", err)
 		return err
@@ -337,6 +425,7 @@ func chargeCard(ctx context.Context, client *http.Client, amount float64, curren
 		return "", err
 	}
 	defer resp.Body.Close()
+	common.SetSpanStatusFromHTTP(span, resp.StatusCode)
 
 	if resp.StatusCode != http.StatusOK {
 		err := fmt.Errorf("payment service returned %d", resp.StatusCode)
@@ -355,24 +444,75 @@ func chargeCard(ctx context.Context, client *http.Client, amount float64, curren
 	return res.TransactionID, nil
 }
 
-func shipOrder(ctx context.Context, client *http.Client, itemCount int) (string, error) {
-	ctx, span := checkoutTracer.Start(ctx, "shipOrder", trace.WithSpanKind(trace.SpanKindInternal))
+// shippingQuery encodes address and items the way the shipping service
+// expects them
+func shippingQuery(address Address, productIDs []string) string {
+	q := url.Values{}
+	q.Set("street", address.StreetAddress)
+	q.Set("city", address.City)
+	q.Set("state", address.State)
+	q.Set("country", address.Country)
+	q.Set("zip", address.ZipCode)
+	q.Set("items", strings.Join(productIDs, ","))
+	return q.Encode()
+}
+
+func getShippingQuote(ctx context.Context, client *http.Client, address Address, productIDs []string) (float64, error) {
+	ctx, span := checkoutTracer.Start(ctx, "GetShippingQuote", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("app.shipping.address.country", address.Country),
+		attribute.Int("shipping.items.count", len(productIDs)),
+	)
+
+	checkoutLogger.InfoContext(ctx, "GetShippingQuote", "country", address.Country, "items", len(productIDs))
+
+	resp, err := doWithRetry(ctx, client, "GET", config.ShippingURL+"/get-quote?"+shippingQuery(address, productIDs))
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		checkoutLogger.ErrorContext(ctx, "GetShippingQuote failed", "error", err)
+		return 0, err
+	}
+	defer resp.Body.Close()
+	common.SetSpanStatusFromHTTP(span, resp.StatusCode)
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("shipping service returned %d", resp.StatusCode)
+		checkoutLogger.ErrorContext(ctx, "GetShippingQuote failed", "error", err)
+		return 0, err
+	}
+
+	var res struct {
+		Quote float64 `json:"quote"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		err = fmt.Errorf("decoding shipping quote: %w", err)
+		span.SetStatus(codes.Error, err.Error())
+		return 0, err
+	}
+	span.SetAttributes(attribute.Float64("app.shipping.amount", res.Quote))
+	return res.Quote, nil
+}
+
+func shipOrder(ctx context.Context, client *http.Client, address Address, productIDs []string) (string, error) {
+	ctx, span := checkoutTracer.Start(ctx, "ShipOrder", trace.WithSpanKind(trace.SpanKindInternal))
 	defer span.End()
 
-	checkoutLogger.InfoContext(ctx, "ShipOrder", "items", itemCount)
+	checkoutLogger.InfoContext(ctx, "ShipOrder", "items", len(productIDs))
 
 	span.SetAttributes(
 		attribute.String("saga.step", "shipping"),
-		attribute.Int("shipping.items.count", itemCount),
+		attribute.Int("shipping.items.count", len(productIDs)),
+		attribute.String("app.shipping.address.country", address.Country),
 	)
 
-	req, _ := http.NewRequestWithContext(ctx, "POST", config.ShippingURL+"/ship", nil)
-	resp, err := client.Do(req)
+	resp, err := doWithRetry(ctx, client, "POST", config.ShippingURL+"/ship?"+shippingQuery(address, productIDs))
 	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
 		checkoutLogger.ErrorContext(ctx, "ShipOrder failed", "error", err)
 		return "", err
 	}
 	defer resp.Body.Close()
+	common.SetSpanStatusFromHTTP(span, resp.StatusCode)
 
 	if resp.StatusCode != http.StatusOK {
 		err := fmt.Errorf("shipping service returned %d", resp.StatusCode)
@@ -410,6 +550,7 @@ func sendOrderConfirmation(ctx context.Context, client *http.Client, orderID, us
 		return err
 	}
 	defer resp.Body.Close()
+	common.SetSpanStatusFromHTTP(span, resp.StatusCode)
 
 	if resp.StatusCode != http.StatusOK {
 		err := fmt.Errorf("email service returned %d", resp.StatusCode)
@@ -421,31 +562,101 @@ func sendOrderConfirmation(ctx context.Context, client *http.Client, orderID, us
 	return nil
 }
 
-func publishToKafka(ctx context.Context, client *http.Client, orderID string) {
-	ctx, span := checkoutTracer.Start(ctx, "orders publish",
+// publishToKafka sends order to the consumers: through Kafka when KAFKA_ADDR
+// is set, otherwise mocked by POSTing to their /consume endpoints
+func publishToKafka(ctx context.Context, client *http.Client, order orderEvent) {
+	// The order itself is the PlaceOrder span; the producer span links to it
+	// so the message can be tied back to the order from either side
+	orderLink := trace.LinkFromContext(ctx, attribute.String("app.link.type", "order"))
+
+	// PublishOrder is the checkout step; the producer span under it keeps the
+	// messaging semantic convention name
+	ctx, step := checkoutTracer.Start(ctx, "PublishOrder", trace.WithAttributes(
+		attribute.String("app.order.id", order.OrderID),
+	))
+	defer step.End()
+
+	ctx, span := checkoutTracer.Start(ctx, ordersTopic+" publish",
 		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithLinks(orderLink),
 		trace.WithAttributes(
 			attribute.String("messaging.system", "kafka"),
-			attribute.String("messaging.destination.name", "orders"),
+			attribute.String("messaging.destination.name", ordersTopic),
 			attribute.String("messaging.operation.type", "publish"),
 			attribute.String("messaging.kafka.destination.partition", "0"),
-			attribute.String("app.order.id", orderID),
+			attribute.String("app.order.id", order.OrderID),
 		))
 	defer span.End()
 
-	checkoutLogger.InfoContext(ctx, "PublishToKafka", "order_id", orderID, "topic", "orders")
+	checkoutLogger.InfoContext(ctx, "PublishToKafka", "order_id", order.OrderID, "topic", ordersTopic)
+
+	if orderProducer != nil {
+		value, err := json.Marshal(order)
+		if err == nil {
+			err = orderProducer.Publish(ctx, ordersTopic, []byte(order.OrderID), value)
+		}
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			checkoutLogger.ErrorContext(ctx, "PublishToKafka failed", "order_id", order.OrderID, "error", err)
+		}
+		return
+	}
 
 	time.Sleep(time.Duration(rand.Intn(10)+5) * time.Millisecond)
 
-	req, _ := http.NewRequestWithContext(ctx, "POST", config.AccountingURL+"/consume", nil)
-	if resp, err := client.Do(req); err == nil {
-		resp.Body.Close()
+	value, _ := json.Marshal(order)
+	for _, consumerURL := range []string{config.AccountingURL, config.FraudDetectionURL} {
+		req, _ := http.NewRequestWithContext(ctx, "POST", consumerURL+"/consume", bytes.NewReader(value))
+		req.Header.Set("Content-Type", "application/json")
+		if resp, err := client.Do(req); err == nil {
+			resp.Body.Close()
+		}
 	}
+}
+
+// doWithRetry sends a body-less request, retrying transport errors and 5xx
+// responses under common.DefaultRetryPolicy. Payment isn't idempotent, so
+// chargeCard doesn't use it.
+func doWithRetry(ctx context.Context, client *http.Client, method, url string) (*http.Response, error) {
+	var resp *http.Response
+	err := common.DoWithRetry(ctx, func() error {
+		var err error
+		resp, err = doOnce(ctx, client, method, url)
+		return err
+	}, common.DefaultRetryPolicy)
+	return resp, err
+}
 
-	req, _ = http.NewRequestWithContext(ctx, "POST", config.FraudDetectionURL+"/consume", nil)
-	if resp, err := client.Do(req); err == nil {
+// doOnce sends a body-less request, turning a 5xx response into an error
+func doOnce(ctx context.Context, client *http.Client, method, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusInternalServerError {
 		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s returned %d", method, url, resp.StatusCode)
 	}
+	return resp, nil
+}
+
+// demoAddresses spans the shipping cost zones: domestic, neighbouring and
+// international
+var demoAddresses = []Address{
+	{StreetAddress: "1600 Amphitheatre Parkway", City: "Mountain View", State: "CA", Country: "US", ZipCode: "94043"},
+	{StreetAddress: "350 Fifth Avenue", City: "New York", State: "NY", Country: "US", ZipCode: "10118"},
+	{StreetAddress: "290 Bremner Blvd", City: "Toronto", State: "ON", Country: "CA", ZipCode: "M5V 3L9"},
+	{StreetAddress: "Platz der Republik 1", City: "Berlin", State: "BE", Country: "DE", ZipCode: "11011"},
+	{StreetAddress: "1-1 Chiyoda", City: "Tokyo", State: "13", Country: "JP", ZipCode: "100-8111"},
+}
+
+func randomAddress() Address {
+	return demoAddresses[rand.Intn(len(demoAddresses))]
 }
 
 func randomCurrency() string {
@@ -468,9 +679,9 @@ func getProductDetails(ctx context.Context, client *http.Client, productIDs []st
 	for _, productID := range productIDs {
 		checkoutLogger.InfoContext(ctx, "FetchProduct", "product_id", productID)
 		url := fmt.Sprintf("%s/products/%s", config.ProductCatalogURL, productID)
-		req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
-		resp, err := client.Do(req)
+		resp, err := doWithRetry(ctx, client, "GET", url)
 		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
 			checkoutLogger.WarnContext(ctx, "FetchProduct failed", "product_id", productID, "error", err)
 			continue
 		}
@@ -478,8 +689,9 @@ func getProductDetails(ctx context.Context, client *http.Client, productIDs []st
 	}
 }
 
-func getCurrencyConversion(ctx context.Context, client *http.Client, currency string, amount float64) {
-	ctx, span := checkoutTracer.Start(ctx, "getCurrencyConversion",
+// getCurrencyConversion converts a USD amount into currency
+func getCurrencyConversion(ctx context.Context, client *http.Client, currency string, amount float64) (float64, error) {
+	ctx, span := checkoutTracer.Start(ctx, "ConvertCurrency",
 		trace.WithSpanKind(trace.SpanKindClient))
 	defer span.End()
 
@@ -491,14 +703,39 @@ func getCurrencyConversion(ctx context.Context, client *http.Client, currency st
 		attribute.Float64("app.currency.amount", amount),
 	)
 
+	// Currency is on the hot path, so it gets one attempt per checkout,
+	// through the breaker, rather than retries that would pile up behind a
+	// degraded service
 	url := fmt.Sprintf("%s/convert?from=USD&to=%s&amount=%.2f", config.CurrencyURL, currency, amount)
-	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
-	resp, err := client.Do(req)
+	var resp *http.Response
+	err := currencyBreaker.Do(ctx, func() error {
+		var err error
+		resp, err = doOnce(ctx, client, http.MethodGet, url)
+		return err
+	})
 	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
 		checkoutLogger.WarnContext(ctx, "GetCurrencyConversion failed", "currency", currency, "error", err)
-		return
+		return 0, err
 	}
-	resp.Body.Close()
+	defer resp.Body.Close()
+	common.SetSpanStatusFromHTTP(span, resp.StatusCode)
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("currency service returned %d", resp.StatusCode)
+		checkoutLogger.WarnContext(ctx, "GetCurrencyConversion failed", "currency", currency, "error", err)
+		return 0, err
+	}
+
+	var res struct {
+		ConvertedAmount float64 `json:"converted_amount"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		err = fmt.Errorf("decoding currency conversion: %w", err)
+		span.SetStatus(codes.Error, err.Error())
+		return 0, err
+	}
+	span.SetAttributes(attribute.Float64("app.currency.converted_amount", res.ConvertedAmount))
+	return res.ConvertedAmount, nil
 }
 
 func getRecommendations(ctx context.Context, client *http.Client, userID string, productIDs []string) {
@@ -521,6 +758,7 @@ func getRecommendations(ctx context.Context, client *http.Client, userID string,
 		return
 	}
 	resp.Body.Close()
+	common.SetSpanStatusFromHTTP(span, resp.StatusCode)
 }
 
 func getAds(ctx context.Context, client *http.Client) {
@@ -542,4 +780,5 @@ func getAds(ctx context.Context, client *http.Client) {
 		return
 	}
 	resp.Body.Close()
+	common.SetSpanStatusFromHTTP(span, resp.StatusCode)
 }
@@ -0,0 +1,500 @@
+package services
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"otel-mock/common"
+	"otel-mock/config"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/codes"
+	lognoop "go.opentelemetry.io/otel/log/noop"
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// setConfig overrides a package config value for the length of the test
+func setConfig[T any](t *testing.T, v *T, value T) {
+	t.Helper()
+	old := *v
+	*v = value
+	t.Cleanup(func() { *v = old })
+}
+
+// usePropagator installs the propagator InitTelemetry sets, which the
+// services' clients and handlers pick up when they're built
+func usePropagator(t *testing.T) {
+	t.Helper()
+	old := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+	t.Cleanup(func() { otel.SetTextMapPropagator(old) })
+}
+
+// stubDownstreams points every checkout dependency at a server answering
+// 200 with an empty JSON object, so an order goes through without them
+func stubDownstreams(t *testing.T) {
+	t.Helper()
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(stub.Close)
+	for _, u := range []*string{
+		&config.CartURL, &config.PaymentURL, &config.ShippingURL, &config.ProductCatalogURL,
+		&config.RecommendationURL, &config.AdURL, &config.EmailURL, &config.CurrencyURL,
+		&config.AccountingURL, &config.FraudDetectionURL,
+	} {
+		setConfig(t, u, stub.URL)
+	}
+	setConfig(t, &config.KafkaBrokers, nil)
+}
+
+// startCheckout serves checkout on an httptest server recording into a
+// fresh in-memory tracer provider
+func startCheckout(t *testing.T) (*httptest.Server, *tracetest.InMemoryExporter) {
+	t.Helper()
+	tp, exporter := common.NewInMemoryTracerProvider()
+	t.Cleanup(func() { tp.Shutdown(context.Background()) })
+	server := InitCheckoutServer(context.Background(), ":0", tp, metricnoop.NewMeterProvider(), lognoop.NewLoggerProvider())
+	ts := httptest.NewServer(server.Handler)
+	t.Cleanup(ts.Close)
+	return ts, exporter
+}
+
+// placeTestOrder sends one checkout request and fails the test unless it
+// succeeds
+func placeTestOrder(t *testing.T, checkoutURL string) {
+	t.Helper()
+	resp, err := http.Post(checkoutURL+"/checkout", "application/json", nil)
+	if err != nil {
+		t.Fatalf("POST /checkout: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /checkout returned %d", resp.StatusCode)
+	}
+}
+
+func TestCheckoutPropagatesToCart(t *testing.T) {
+	usePropagator(t)
+	stubDownstreams(t)
+
+	cartTP, cartSpans := common.NewInMemoryTracerProvider()
+	t.Cleanup(func() { cartTP.Shutdown(context.Background()) })
+	setConfig(t, &config.CartStore, "memory")
+	cart := httptest.NewServer(InitCartService(context.Background(), ":0", cartTP, metricnoop.NewMeterProvider(), lognoop.NewLoggerProvider()).Handler)
+	t.Cleanup(cart.Close)
+	setConfig(t, &config.CartURL, cart.URL)
+
+	checkout, checkoutSpans := startCheckout(t)
+	placeTestOrder(t, checkout.URL)
+
+	clientSpans := make(map[trace.SpanID]tracetest.SpanStub)
+	var traceID trace.TraceID
+	for _, s := range checkoutSpans.GetSpans() {
+		if s.Name == "PlaceOrder" {
+			traceID = s.SpanContext.TraceID()
+		}
+		if s.SpanKind == trace.SpanKindClient {
+			clientSpans[s.SpanContext.SpanID()] = s
+		}
+	}
+	if !traceID.IsValid() {
+		t.Fatal("checkout recorded no PlaceOrder span")
+	}
+
+	got := cartSpans.GetSpans()
+	if len(got) == 0 {
+		t.Fatal("cart recorded no spans")
+	}
+	for _, s := range got {
+		if s.SpanContext.TraceID() != traceID {
+			t.Errorf("cart span %s has trace ID %s, want checkout's %s", s.Name, s.SpanContext.TraceID(), traceID)
+		}
+		if !s.Parent.IsRemote() {
+			t.Errorf("cart span %s parent is not remote", s.Name)
+		}
+		if _, ok := clientSpans[s.Parent.SpanID()]; !ok {
+			t.Errorf("cart span %s parent %s is not one of checkout's client spans", s.Name, s.Parent.SpanID())
+		}
+	}
+}
+
+func TestCheckoutHandlerSpans(t *testing.T) {
+	usePropagator(t)
+	stubDownstreams(t)
+	checkout, exporter := startCheckout(t)
+
+	resp, err := http.Post(checkout.URL+"/checkout", "application/json", nil)
+	if err != nil {
+		t.Fatalf("POST /checkout: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /checkout returned %d", resp.StatusCode)
+	}
+
+	spans := exporter.GetSpans()
+	var root tracetest.SpanStub
+	byName := make(map[string]tracetest.SpanStub)
+	for _, s := range spans {
+		byName[s.Name] = s
+		if s.Name == "PlaceOrder" {
+			root = s
+		}
+	}
+	if root.Name == "" {
+		t.Fatalf("no PlaceOrder span among %d spans", len(spans))
+	}
+	if root.SpanKind != trace.SpanKindServer {
+		t.Errorf("PlaceOrder kind = %v, want server", root.SpanKind)
+	}
+	if root.Status.Code == codes.Error {
+		t.Errorf("PlaceOrder status = error: %s", root.Status.Description)
+	}
+	if got := resp.Header.Get("X-Trace-Id"); got != root.SpanContext.TraceID().String() {
+		t.Errorf("X-Trace-Id = %q, want PlaceOrder's trace ID %s", got, root.SpanContext.TraceID())
+	}
+
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range root.Attributes {
+		attrs[kv.Key] = kv.Value
+	}
+	for _, key := range []attribute.Key{"app.user.id", "app.order.id", "app.order.amount", "http.route"} {
+		if _, ok := attrs[key]; !ok {
+			t.Errorf("PlaceOrder is missing attribute %s", key)
+		}
+	}
+
+	for _, name := range []string{"prepareOrderItemsAndShippingQuoteFromCart", "chargeCard", "ShipOrder", "PublishOrder"} {
+		s, ok := byName[name]
+		if !ok {
+			t.Errorf("no %s span", name)
+			continue
+		}
+		if s.SpanContext.TraceID() != root.SpanContext.TraceID() {
+			t.Errorf("%s is in trace %s, want %s", name, s.SpanContext.TraceID(), root.SpanContext.TraceID())
+		}
+		if s.Parent.SpanID() != root.SpanContext.SpanID() {
+			t.Errorf("%s parent = %s, want PlaceOrder %s", name, s.Parent.SpanID(), root.SpanContext.SpanID())
+		}
+	}
+}
+
+func TestCheckoutSyntheticBaggage(t *testing.T) {
+	tests := []struct {
+		name    string
+		baggage string
+		want    string
+	}{
+		{"real traffic carries no marker", "", ""},
+		{"existing synthetic=true is kept", "synthetic=true", "true"},
+		{"synthetic_request is not a marker", "synthetic_request=true", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			usePropagator(t)
+			stubDownstreams(t)
+
+			var mu sync.Mutex
+			var got baggage.Baggage
+			shipping := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				got = baggage.FromContext(otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header)))
+				mu.Unlock()
+				w.Write([]byte(`{}`))
+			}))
+			t.Cleanup(shipping.Close)
+			setConfig(t, &config.ShippingURL, shipping.URL)
+
+			checkout, _ := startCheckout(t)
+			req, _ := http.NewRequest(http.MethodPost, checkout.URL+"/checkout", nil)
+			if tt.baggage != "" {
+				req.Header.Set("baggage", tt.baggage)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("POST /checkout: %v", err)
+			}
+			resp.Body.Close()
+
+			mu.Lock()
+			defer mu.Unlock()
+			if got.Member("user.id").Value() == "" {
+				t.Errorf("downstream baggage %q has no user.id", got.String())
+			}
+			m := got.Member("synthetic")
+			if m.Value() != tt.want {
+				t.Errorf("downstream synthetic = %q, want %q (baggage %q)", m.Value(), tt.want, got.String())
+			}
+			if tt.want == "" && m.Key() != "" {
+				t.Errorf("downstream baggage %q carries a synthetic member for real traffic", got.String())
+			}
+		})
+	}
+}
+
+// A cart outage is tolerated while preparing the order, so it mustn't mark
+// the preparation step as failed
+func TestCheckoutCartFailureLeavesParentStatus(t *testing.T) {
+	usePropagator(t)
+	stubDownstreams(t)
+	cart := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "cart down", http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(cart.Close)
+	setConfig(t, &config.CartURL, cart.URL)
+
+	checkout, exporter := startCheckout(t)
+	placeTestOrder(t, checkout.URL)
+
+	for _, s := range exporter.GetSpans() {
+		switch s.Name {
+		case "prepareOrderItemsAndShippingQuoteFromCart", "PlaceOrder":
+			if s.Status.Code == codes.Error {
+				t.Errorf("%s status = error (%s), want unset", s.Name, s.Status.Description)
+			}
+		case "GetCart":
+			if s.Status.Code != codes.Error {
+				t.Errorf("GetCart status = %v, want error", s.Status.Code)
+			}
+		}
+	}
+}
+
+func TestCheckoutInjectsTraceparent(t *testing.T) {
+	usePropagator(t)
+	stubDownstreams(t)
+
+	var mu sync.Mutex
+	traceIDs := make(map[string]trace.TraceID)
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := propagation.TraceContext{}.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		mu.Lock()
+		traceIDs[r.URL.Path] = trace.SpanContextFromContext(ctx).TraceID()
+		mu.Unlock()
+		w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(downstream.Close)
+	setConfig(t, &config.CartURL, downstream.URL)
+	setConfig(t, &config.ShippingURL, downstream.URL)
+	setConfig(t, &config.PaymentURL, downstream.URL)
+
+	checkout, exporter := startCheckout(t)
+	placeTestOrder(t, checkout.URL)
+
+	var want trace.TraceID
+	for _, s := range exporter.GetSpans() {
+		if s.Name == "PlaceOrder" {
+			want = s.SpanContext.TraceID()
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(traceIDs) == 0 {
+		t.Fatal("no downstream requests were made")
+	}
+	for path, got := range traceIDs {
+		if !got.IsValid() {
+			t.Errorf("%s: request carried no valid traceparent", path)
+		} else if got != want {
+			t.Errorf("%s: traceparent trace ID = %s, want PlaceOrder's %s", path, got, want)
+		}
+	}
+}
+
+func TestCheckoutOrchestrationTrace(t *testing.T) {
+	usePropagator(t)
+	stubDownstreams(t)
+	checkout, exporter := startCheckout(t)
+	placeTestOrder(t, checkout.URL)
+
+	byID := make(map[trace.SpanID]tracetest.SpanStub)
+	byName := make(map[string]tracetest.SpanStub)
+	for _, s := range exporter.GetSpans() {
+		byID[s.SpanContext.SpanID()] = s
+		byName[s.Name] = s
+	}
+	root, ok := byName["PlaceOrder"]
+	if !ok {
+		t.Fatal("no PlaceOrder span")
+	}
+	for _, key := range []attribute.Key{"order.total", "order.item_count", "currency.code"} {
+		found := false
+		for _, kv := range root.Attributes {
+			found = found || kv.Key == key
+		}
+		if !found {
+			t.Errorf("PlaceOrder is missing attribute %s", key)
+		}
+	}
+
+	// Dependency calls may sit under an intermediate step, so walk up to the
+	// root rather than requiring PlaceOrder as the direct parent
+	underRoot := func(s tracetest.SpanStub) bool {
+		for s.Parent.IsValid() {
+			if s.Parent.SpanID() == root.SpanContext.SpanID() {
+				return true
+			}
+			var ok bool
+			if s, ok = byID[s.Parent.SpanID()]; !ok {
+				return false
+			}
+		}
+		return false
+	}
+	for _, name := range []string{"GetCart", "ConvertCurrency", "GetShippingQuote", "ShipOrder", "PublishOrder"} {
+		s, ok := byName[name]
+		if !ok {
+			t.Errorf("no %s span", name)
+			continue
+		}
+		if s.SpanContext.TraceID() != root.SpanContext.TraceID() {
+			t.Errorf("%s is in trace %s, want PlaceOrder's %s", name, s.SpanContext.TraceID(), root.SpanContext.TraceID())
+		}
+		if !underRoot(s) {
+			t.Errorf("%s is not nested under PlaceOrder", name)
+		}
+	}
+}
+
+// The producer span links to the order (PlaceOrder) and the consumer's
+// server span links back to the request that delivered the message
+func TestCheckoutPublishLinks(t *testing.T) {
+	usePropagator(t)
+	stubDownstreams(t)
+	accountingTP, accountingSpans := common.NewInMemoryTracerProvider()
+	t.Cleanup(func() { accountingTP.Shutdown(context.Background()) })
+	accounting := httptest.NewServer(InitAccountingService(context.Background(), ":0", accountingTP, metricnoop.NewMeterProvider(), lognoop.NewLoggerProvider()).Handler)
+	t.Cleanup(accounting.Close)
+	setConfig(t, &config.AccountingURL, accounting.URL)
+
+	checkout, checkoutSpans := startCheckout(t)
+	placeTestOrder(t, checkout.URL)
+
+	var root, producer tracetest.SpanStub
+	for _, s := range checkoutSpans.GetSpans() {
+		switch s.Name {
+		case "PlaceOrder":
+			root = s
+		case "orders publish":
+			producer = s
+		}
+	}
+	if producer.Name == "" {
+		t.Fatal("no orders publish span")
+	}
+	if len(producer.Links) != 1 || !producer.Links[0].SpanContext.Equal(root.SpanContext) {
+		t.Errorf("orders publish links = %+v, want one link to PlaceOrder %s", producer.Links, root.SpanContext.SpanID())
+	}
+
+	// The mocked delivery is an HTTP request, so the link points at the
+	// client span checkout opened under orders publish
+	delivered := make(map[trace.SpanID]bool)
+	for _, s := range checkoutSpans.GetSpans() {
+		if s.SpanKind == trace.SpanKindClient && s.Parent.SpanID() == producer.SpanContext.SpanID() {
+			delivered[s.SpanContext.SpanID()] = true
+		}
+	}
+	for _, s := range accountingSpans.GetSpans() {
+		if s.Name != "orders receive" {
+			continue
+		}
+		if len(s.Links) != 1 || !delivered[s.Links[0].SpanContext.SpanID()] {
+			t.Errorf("orders receive links = %+v, want one link to a delivery under orders publish", s.Links)
+		}
+		return
+	}
+	t.Error("accounting recorded no orders receive span")
+}
+
+func TestCheckoutDeadline(t *testing.T) {
+	usePropagator(t)
+	stubDownstreams(t)
+	setConfig(t, &config.CheckoutTimeout, 100*time.Millisecond)
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	t.Cleanup(slow.Close)
+	t.Cleanup(func() { close(release) })
+	setConfig(t, &config.CartURL, slow.URL)
+
+	checkout, exporter := startCheckout(t)
+	start := time.Now()
+	resp, err := http.Post(checkout.URL+"/checkout", "application/json", nil)
+	if err != nil {
+		t.Fatalf("POST /checkout: %v", err)
+	}
+	resp.Body.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("checkout took %v against a hung cart, want it cut off near the 100ms deadline", elapsed)
+	}
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("POST /checkout returned %d, want %d", resp.StatusCode, http.StatusGatewayTimeout)
+	}
+
+	for _, s := range exporter.GetSpans() {
+		switch s.Name {
+		case "PlaceOrder":
+			if s.Status.Code != codes.Error {
+				t.Errorf("PlaceOrder status = %v, want error", s.Status.Code)
+			}
+			recorded := false
+			for _, e := range s.Events {
+				for _, kv := range e.Attributes {
+					recorded = recorded || (kv.Key == "exception.message" && kv.Value.AsString() == context.DeadlineExceeded.Error())
+				}
+			}
+			if !recorded {
+				t.Errorf("PlaceOrder events %+v carry no deadline exceeded exception", s.Events)
+			}
+		case "GetCart":
+			if s.Status.Code != codes.Error || !strings.Contains(s.Status.Description, "deadline exceeded") {
+				t.Errorf("GetCart status = %v %q, want deadline exceeded", s.Status.Code, s.Status.Description)
+			}
+		}
+	}
+}
+
+// A failing currency service gets one call per order, not a retry loop,
+// and the order still goes through in USD
+func TestCheckoutCurrencyNotRetried(t *testing.T) {
+	usePropagator(t)
+	stubDownstreams(t)
+	var mu sync.Mutex
+	calls := 0
+	currency := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(currency.Close)
+	setConfig(t, &config.CurrencyURL, currency.URL)
+
+	checkout, _ := startCheckout(t)
+	placeTestOrder(t, checkout.URL)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 1 {
+		t.Errorf("currency called %d times for one order, want 1", calls)
+	}
+}
@@ -1,27 +1,42 @@
 package services
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
+	"math"
+	"math/rand"
 	"net/http"
+	"otel-mock/common"
+	"otel-mock/config"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
-	"go.opentelemetry.io/contrib/bridges/otelslog"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
-	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 	otellog "go.opentelemetry.io/otel/log"
 	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/trace"
 )
 
 var (
-	currencyLogger  *slog.Logger
-	currencyMeter   metric.Meter
-	currencyCounter metric.Int64Counter
+	currencyTracer    trace.Tracer
+	currencyLogger    *slog.Logger
+	currencyMeter     metric.Meter
+	currencyCounter   metric.Int64Counter
+	supportedRequests metric.Int64Counter
 )
 
-// Exchange rates from USD
-var exchangeRates = map[string]float64{
+// baseExchangeRates are the rates from USD the currency service starts
+// with; each refresh drifts the live rates around them
+var baseExchangeRates = map[string]float64{
 	"USD": 1.0,
 	"EUR": 0.85,
 	"GBP": 0.73,
@@ -32,8 +47,27 @@ var exchangeRates = map[string]float64{
 	"INR": 83.0,
 }
 
-func initCurrencyMetrics() {
-	currencyMeter = otel.Meter("currency")
+// rateDrift is the largest relative move a refresh applies to a base rate
+const rateDrift = 0.02
+
+// exchangeRates holds the live rates from USD; read them through
+// exchangeRate so refreshes don't race with conversions
+var (
+	ratesMu          sync.RWMutex
+	exchangeRates    = maps.Clone(baseExchangeRates)
+	ratesLastRefresh = time.Now()
+)
+
+// exchangeRate returns the live USD rate for code
+func exchangeRate(code string) (float64, bool) {
+	ratesMu.RLock()
+	defer ratesMu.RUnlock()
+	rate, ok := exchangeRates[code]
+	return rate, ok
+}
+
+func initCurrencyMetrics(mp metric.MeterProvider) {
+	currencyMeter = mp.Meter("currency")
 	var err error
 
 	currencyCounter, err = currencyMeter.Int64Counter("app.currency_counter",
@@ -42,20 +76,42 @@ func initCurrencyMetrics() {
 	if err != nil {
 		panic(err)
 	}
+
+	supportedRequests, err = currencyMeter.Int64Counter("currency.supported_requests",
+		metric.WithDescription("Supported currency list requests"),
+		metric.WithUnit("{requests}"))
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = currencyMeter.Float64ObservableGauge("currency.rates.last_refresh",
+		metric.WithDescription("Unix time the exchange rates were last refreshed"),
+		metric.WithUnit("s"),
+		metric.WithFloat64Callback(func(_ context.Context, o metric.Float64Observer) error {
+			ratesMu.RLock()
+			defer ratesMu.RUnlock()
+			o.Observe(float64(ratesLastRefresh.UnixMilli()) / 1000)
+			return nil
+		}))
+	if err != nil {
+		panic(err)
+	}
 }
 
-func RunCurrencyService(tp trace.TracerProvider, lp otellog.LoggerProvider) {
-	currencyLogger = otelslog.NewLogger("currency", otelslog.WithLoggerProvider(lp))
-	initCurrencyMetrics()
+// InitCurrencyService creates the currency HTTP server on port; the caller starts it
+func InitCurrencyService(ctx context.Context, port string, tp trace.TracerProvider, mp metric.MeterProvider, lp otellog.LoggerProvider) *http.Server {
+	currencyLogger = common.NewLogger("currency", lp)
+	currencyTracer = tp.Tracer("currency")
+	initCurrencyMetrics(mp)
 
 	convertHandler := otelhttp.NewHandler(
-		http.HandlerFunc(convertHandler),
+		common.Recover("currency", mp, lp, common.InjectFaults("currency", http.HandlerFunc(convertHandler))),
 		"Convert",
 		otelhttp.WithTracerProvider(tp),
 	)
 
 	supportedHandler := otelhttp.NewHandler(
-		http.HandlerFunc(getSupportedCurrenciesHandler),
+		common.Recover("currency", mp, lp, common.InjectFaults("currency", http.HandlerFunc(getSupportedCurrenciesHandler))),
 		"GetSupportedCurrencies",
 		otelhttp.WithTracerProvider(tp),
 	)
@@ -64,22 +120,64 @@ func RunCurrencyService(tp trace.TracerProvider, lp otellog.LoggerProvider) {
 	mux.Handle("/convert", convertHandler)
 	mux.Handle("/currencies", supportedHandler)
 
-	port := ":8089"
+	startRatesRefresh(ctx, config.CurrencyRatesRefreshInterval)
+
 	currencyLogger.Info("Currency Service starting", "port", port)
-	if err := http.ListenAndServe(port, mux); err != nil {
-		currencyLogger.Error("Currency Service failed", "error", err)
+	return &http.Server{Addr: port, Handler: mux}
+}
+
+// startRatesRefresh refreshes the exchange rates every interval until ctx is
+// cancelled. A zero interval keeps the base rates.
+func startRatesRefresh(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
 	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				refreshRates(ctx)
+			}
+		}
+	}()
+}
+
+// refreshRates stands in for fetching rates from a remote feed: every rate
+// moves up to rateDrift away from its base. Each refresh is its own trace.
+func refreshRates(ctx context.Context) {
+	ctx, span := currencyTracer.Start(ctx, "refreshRates", trace.WithNewRoot())
+	defer span.End()
+
+	rates := make(map[string]float64, len(baseExchangeRates))
+	for code, base := range baseExchangeRates {
+		rates[code] = base
+		if code != "USD" {
+			rates[code] = base * (1 + (rand.Float64()*2-1)*rateDrift)
+		}
+	}
+
+	ratesMu.Lock()
+	exchangeRates = rates
+	ratesLastRefresh = time.Now()
+	ratesMu.Unlock()
+
+	span.SetAttributes(attribute.Int("app.currency.rates.count", len(rates)))
+	currencyLogger.InfoContext(ctx, "Exchange rates refreshed", "count", len(rates))
 }
 
 func convertHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	span := trace.SpanFromContext(ctx)
 
-	from := r.URL.Query().Get("from")
+	from := strings.ToUpper(r.URL.Query().Get("from"))
 	if from == "" {
 		from = "USD"
 	}
-	to := r.URL.Query().Get("to")
+	to := strings.ToUpper(r.URL.Query().Get("to"))
 	if to == "" {
 		to = "EUR"
 	}
@@ -93,17 +191,35 @@ func convertHandler(w http.ResponseWriter, r *http.Request) {
 		attribute.String("rpc.method", "Convert"),
 	)
 
-	// Simulate conversion calculation
-	fromRate, ok := exchangeRates[from]
-	if !ok {
-		fromRate = 1.0
+	amount := 1.0
+	if raw := r.URL.Query().Get("amount"); raw != "" {
+		var err error
+		if amount, err = strconv.ParseFloat(raw, 64); err != nil || amount < 0 {
+			err = fmt.Errorf("invalid amount %q", raw)
+			span.SetStatus(codes.Error, err.Error())
+			writeCurrencyError(w, err)
+			return
+		}
 	}
-	toRate, ok := exchangeRates[to]
-	if !ok {
-		toRate = 1.0
+
+	if common.Flags.Enabled(common.FlagFailCurrency) {
+		err := errors.New("currency conversion disabled by failCurrency flag")
+		span.AddEvent("flag.enabled", trace.WithAttributes(attribute.String("flag.name", common.FlagFailCurrency)))
+		span.SetStatus(codes.Error, err.Error())
+		currencyLogger.ErrorContext(ctx, "Convert failed", "from", from, "to", to, "error", err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
 	}
 
-	rate := toRate / fromRate
+	converted, rate, err := convert(ctx, from, to, amount)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		currencyLogger.WarnContext(ctx, "Convert failed", "from", from, "to", to, "error", err)
+		writeCurrencyError(w, err)
+		return
+	}
 
 	currencyCounter.Add(ctx, 1, metric.WithAttributes(
 		attribute.String("currency_code", to),
@@ -114,11 +230,57 @@ func convertHandler(w http.ResponseWriter, r *http.Request) {
 		"from", from,
 		"to", to,
 		"rate", rate,
+		"amount", amount,
+		"converted", converted,
 	)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, `{"from": "%s", "to": "%s", "rate": %.4f}`, from, to, rate)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"from":             from,
+		"to":               to,
+		"rate":             rate,
+		"amount":           amount,
+		"converted_amount": converted,
+	})
+}
+
+// convert converts amount between two codes at the live rates, rounding to
+// cents. Unknown codes are an error.
+func convert(ctx context.Context, from, to string, amount float64) (converted, rate float64, err error) {
+	_, span := currencyTracer.Start(ctx, "convert", trace.WithAttributes(
+		attribute.String("app.currency.conversion.from", from),
+		attribute.String("app.currency.conversion.to", to),
+		attribute.Float64("app.currency.conversion.amount", amount),
+	))
+	defer span.End()
+
+	fromRate, ok := exchangeRate(from)
+	toRate, toOK := exchangeRate(to)
+	if !ok {
+		err = fmt.Errorf("unsupported currency code %q", from)
+	} else if !toOK {
+		err = fmt.Errorf("unsupported currency code %q", to)
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return 0, 0, err
+	}
+
+	rate = toRate / fromRate
+	converted = math.Round(amount*rate*100) / 100
+	span.SetAttributes(
+		attribute.Float64("app.currency.conversion.rate", rate),
+		attribute.Float64("app.currency.conversion.result", converted),
+	)
+	return converted, rate, nil
+}
+
+func writeCurrencyError(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
 }
 
 func getSupportedCurrenciesHandler(w http.ResponseWriter, r *http.Request) {
@@ -129,13 +291,10 @@ func getSupportedCurrenciesHandler(w http.ResponseWriter, r *http.Request) {
 		attribute.String("rpc.system", "grpc"),
 		attribute.String("rpc.service", "oteldemo.CurrencyService"),
 		attribute.String("rpc.method", "GetSupportedCurrencies"),
-		attribute.Int("app.currencies.count", len(exchangeRates)),
 	)
 
-	currencies := make([]string, 0, len(exchangeRates))
-	for code := range exchangeRates {
-		currencies = append(currencies, code)
-	}
+	currencies := supportedCurrencies(ctx)
+	supportedRequests.Add(ctx, 1)
 
 	currencyLogger.InfoContext(ctx, "GetSupportedCurrencies",
 		"count", len(currencies),
@@ -143,5 +302,23 @@ func getSupportedCurrenciesHandler(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, `{"currencies": %d}`, len(currencies))
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"currencies": currencies,
+		"count":      len(currencies),
+	})
+}
+
+// supportedCurrencies returns the known currency codes, sorted
+func supportedCurrencies(ctx context.Context) []string {
+	_, span := currencyTracer.Start(ctx, "supportedCurrencies")
+	defer span.End()
+
+	currencies := make([]string, 0, len(baseExchangeRates))
+	for code := range baseExchangeRates {
+		currencies = append(currencies, code)
+	}
+	sort.Strings(currencies)
+
+	span.SetAttributes(attribute.Int("app.currencies.count", len(currencies)))
+	return currencies
 }
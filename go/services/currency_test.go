@@ -0,0 +1,166 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"otel-mock/common"
+	"otel-mock/config"
+	"slices"
+	"testing"
+	"time"
+
+	lognoop "go.opentelemetry.io/otel/log/noop"
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func TestGetSupportedCurrencies(t *testing.T) {
+	setConfig(t, &config.CurrencyRatesRefreshInterval, 0)
+	tp, exporter := common.NewInMemoryTracerProvider()
+	t.Cleanup(func() { tp.Shutdown(context.Background()) })
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	t.Cleanup(func() { mp.Shutdown(context.Background()) })
+	ts := httptest.NewServer(InitCurrencyService(context.Background(), ":0", tp, mp, lognoop.NewLoggerProvider()).Handler)
+	t.Cleanup(ts.Close)
+
+	resp, err := http.Get(ts.URL + "/currencies")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Currencies []string `json:"currencies"`
+		Count      int      `json:"count"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+
+	want := []string{"AUD", "CAD", "CHF", "EUR", "GBP", "INR", "JPY", "USD"}
+	if !slices.Equal(body.Currencies, want) || body.Count != len(want) {
+		t.Errorf("GET /currencies = %v (count %d), want %v", body.Currencies, body.Count, want)
+	}
+
+	var names []string
+	for _, s := range exporter.GetSpans() {
+		names = append(names, s.Name)
+	}
+	for _, name := range []string{"GetSupportedCurrencies", "supportedCurrencies"} {
+		if !slices.Contains(names, name) {
+			t.Errorf("no %s span among %v", name, names)
+		}
+	}
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	var requests int64
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name == "currency.supported_requests" {
+				for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+					requests += dp.Value
+				}
+			}
+		}
+	}
+	if requests != 1 {
+		t.Errorf("currency.supported_requests = %d, want 1", requests)
+	}
+}
+
+func TestRefreshRates(t *testing.T) {
+	setConfig(t, &config.CurrencyRatesRefreshInterval, 0)
+	t.Cleanup(func() {
+		ratesMu.Lock()
+		exchangeRates = maps.Clone(baseExchangeRates)
+		ratesMu.Unlock()
+	})
+	tp, exporter := common.NewInMemoryTracerProvider()
+	t.Cleanup(func() { tp.Shutdown(context.Background()) })
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	t.Cleanup(func() { mp.Shutdown(context.Background()) })
+	InitCurrencyService(context.Background(), ":0", tp, mp, lognoop.NewLoggerProvider())
+
+	ratesMu.RLock()
+	before := ratesLastRefresh
+	ratesMu.RUnlock()
+	time.Sleep(time.Millisecond)
+	refreshRates(context.Background())
+
+	ratesMu.RLock()
+	after := ratesLastRefresh
+	rates := maps.Clone(exchangeRates)
+	ratesMu.RUnlock()
+	if !after.After(before) {
+		t.Errorf("last refresh = %v, want it after %v", after, before)
+	}
+	for code, base := range baseExchangeRates {
+		rate, ok := rates[code]
+		if !ok || math.Abs(rate-base) > base*rateDrift {
+			t.Errorf("%s rate = %v, want within %v of %v", code, rate, rateDrift, base)
+		}
+	}
+	if rates["USD"] != 1 {
+		t.Errorf("USD rate = %v, want 1", rates["USD"])
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 || spans[0].Name != "refreshRates" || spans[0].Parent.IsValid() {
+		t.Errorf("spans = %v, want one root refreshRates span", spans)
+	}
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	var gauge float64
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name == "currency.rates.last_refresh" {
+				gauge = m.Data.(metricdata.Gauge[float64]).DataPoints[0].Value
+			}
+		}
+	}
+	if want := float64(after.UnixMilli()) / 1000; gauge != want {
+		t.Errorf("currency.rates.last_refresh = %v, want %v", gauge, want)
+	}
+}
+
+func TestStartRatesRefreshStopsOnCancel(t *testing.T) {
+	t.Cleanup(func() {
+		ratesMu.Lock()
+		exchangeRates = maps.Clone(baseExchangeRates)
+		ratesMu.Unlock()
+	})
+	tp, exporter := common.NewInMemoryTracerProvider()
+	t.Cleanup(func() { tp.Shutdown(context.Background()) })
+	setConfig(t, &config.CurrencyRatesRefreshInterval, 0)
+	InitCurrencyService(context.Background(), ":0", tp, metricnoop.NewMeterProvider(), lognoop.NewLoggerProvider())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	startRatesRefresh(ctx, 10*time.Millisecond)
+	deadline := time.Now().Add(2 * time.Second)
+	for len(exporter.GetSpans()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no refresh within 2s at a 10ms interval")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	// A refresh already under way may still finish
+	time.Sleep(20 * time.Millisecond)
+	stopped := len(exporter.GetSpans())
+	time.Sleep(50 * time.Millisecond)
+	if got := len(exporter.GetSpans()); got != stopped {
+		t.Errorf("%d more refreshes ran after cancel", got-stopped)
+	}
+}
@@ -4,11 +4,13 @@ import (
 	"context"
 	"encoding/json"
 	"log/slog"
-	"math/rand"
+	"math"
 	"net/http"
+	"otel-mock/common"
+	"otel-mock/config"
+	"time"
 
-	"go.opentelemetry.io/contrib/bridges/otelslog"
-	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"github.com/segmentio/kafka-go"
 	"go.opentelemetry.io/otel/attribute"
 	otellog "go.opentelemetry.io/otel/log"
 	"go.opentelemetry.io/otel/metric"
@@ -21,70 +23,96 @@ var (
 	fraudLogger *slog.Logger
 )
 
+// fraudConsumerGroup is the Kafka consumer group, also reported on mocked deliveries
+const fraudConsumerGroup = "frauddetectionservice"
+
 var (
-	ordersScanned  metric.Int64Counter
-	fraudsDetected metric.Int64Counter
+	ordersScanned        metric.Int64Counter
+	fraudsDetected       metric.Int64Counter
+	fraudFlagged         metric.Int64Counter
+	fraudProcessDuration metric.Float64Histogram
 )
 
-func InitFraudDetectionService(port string, tp trace.TracerProvider, mp metric.MeterProvider, lp otellog.LoggerProvider) *http.Server {
+func InitFraudDetectionService(ctx context.Context, port string, tp trace.TracerProvider, mp metric.MeterProvider, lp otellog.LoggerProvider) *http.Server {
 	fraudTracer = tp.Tracer("fraud-detection")
 	fraudMeter = mp.Meter("fraud-detection")
+	fraudLogger = common.NewLogger("fraud-detection", lp)
 
 	var err error
 	ordersScanned, err = fraudMeter.Int64Counter("app.fraud.orders_scanned",
 		metric.WithDescription("Total orders scanned for fraud"),
 		metric.WithUnit("{orders}"))
 	if err != nil {
-		slog.Error("Failed to create orders_scanned counter", "error", err)
+		fraudLogger.Error("Failed to create orders_scanned counter", "error", err)
 	}
 
 	fraudsDetected, err = fraudMeter.Int64Counter("app.fraud.detected",
 		metric.WithDescription("Total fraudulent orders detected"),
 		metric.WithUnit("{orders}"))
 	if err != nil {
-		slog.Error("Failed to create frauds_detected counter", "error", err)
+		fraudLogger.Error("Failed to create frauds_detected counter", "error", err)
+	}
+
+	fraudFlagged, err = fraudMeter.Int64Counter("fraud.flagged",
+		metric.WithDescription("Orders whose fraud score exceeded FRAUD_SCORE_THRESHOLD"),
+		metric.WithUnit("{orders}"))
+	if err != nil {
+		fraudLogger.Error("Failed to create fraud.flagged counter", "error", err)
+	}
+
+	fraudProcessDuration, err = newProcessDuration(fraudMeter)
+	if err != nil {
+		fraudLogger.Error("Failed to create messaging.process.duration histogram", "error", err)
 	}
 
 	mux := http.NewServeMux()
-	// Wrap with otelhttp to extract trace context from incoming requests
-	mux.Handle("/consume", otelhttp.NewHandler(
-		http.HandlerFunc(handleFraudConsume),
-		"orders receive",
-		otelhttp.WithTracerProvider(tp),
-	))
+	mux.Handle("/consume", common.Recover("fraud-detection", mp, lp, common.InjectFaults("fraud-detection", http.HandlerFunc(handleFraudConsume))))
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(`{"status":"ok"}`))
 	})
+	health := common.NewHealth()
+	health.AddCheck("collector", common.CollectorCheck())
+	health.Register(mux)
 
+	// The server span extracts trace context from the mocked Kafka message
 	server := &http.Server{
 		Addr:    port,
-		Handler: mux,
+		Handler: common.NewServerHandler(mux, "fraud-detection", tp, mp, map[string]string{"/consume": "orders receive"}),
+	}
+
+	if len(config.KafkaBrokers) > 0 {
+		health.AddCheck("kafka", common.KafkaCheck(config.KafkaBrokers, ordersTopic))
+		startOrdersConsumer(ctx, server, tp, fraudMeter, fraudConsumerGroup, fraudLogger, consumeFraudMessage)
 	}
 
-	fraudLogger = otelslog.NewLogger("fraud-detection", otelslog.WithLoggerProvider(lp))
 	fraudLogger.Info("Fraud Detection Service starting", "port", port)
+	// Telemetry is initialized before any service starts, so startup is done
+	health.MarkReady()
 	return server
 }
 
 func handleFraudConsume(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
-	// Get span from otelhttp handler (already creates "orders receive" span)
+	// Get span from the server handler (already named "orders receive")
 	span := trace.SpanFromContext(ctx)
+	linkProducer(r)
 
 	// Add Kafka messaging attributes to the existing span
 	span.SetAttributes(
 		attribute.String("messaging.system", "kafka"),
 		attribute.String("messaging.destination.name", "orders"),
 		attribute.String("messaging.operation.type", "receive"),
-		attribute.String("messaging.consumer.group.name", "frauddetectionservice"),
+		attribute.String("messaging.consumer.group.name", fraudConsumerGroup),
 	)
 
-	fraudLogger.InfoContext(ctx, "Received order from Kafka", "topic", "orders", "consumer_group", "frauddetectionservice")
+	fraudLogger.InfoContext(ctx, "Received order from Kafka", "topic", "orders", "consumer_group", fraudConsumerGroup)
 
 	// Simulate fraud detection
-	fraudDetected := detectFraud(ctx)
+	start := time.Now()
+	fraudDetected := detectFraud(ctx, orderFromRequest(r))
+	recordProcessDuration(ctx, fraudProcessDuration, fraudConsumerGroup, start)
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -93,46 +121,71 @@ func handleFraudConsume(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func detectFraud(ctx context.Context) bool {
+// fraudScore rates an order from 0 to 1: mostly on its USD value, saturating
+// at $500, and partly on item count, saturating at 10 items
+func fraudScore(order orderEvent) float64 {
+	amountUSD := order.Amount
+	if rate, ok := exchangeRate(order.Currency); ok {
+		amountUSD = order.Amount / rate
+	}
+	score := 0.7*math.Min(amountUSD/500, 1) + 0.3*math.Min(float64(order.ItemCount)/10, 1)
+	return math.Round(score*1000) / 1000
+}
+
+func detectFraud(ctx context.Context, order orderEvent) bool {
 	ctx, span := fraudTracer.Start(ctx, "detectFraud")
 	defer span.End()
 
-	orderID := "order-" + randomString(8)
-	amount := float64(rand.Intn(50000)+1000) / 100.0
-	userID := "user-" + randomString(6)
+	fraudLogger.InfoContext(ctx, "DetectFraud started", "order_id", order.OrderID, "user_id", order.UserID, "amount", order.Amount)
 
-	fraudLogger.InfoContext(ctx, "DetectFraud started", "order_id", orderID, "user_id", userID, "amount", amount)
+	score := fraudScore(order)
+	isFraud := score > config.FraudScoreThreshold
 
 	span.SetAttributes(
-		attribute.String("app.order.id", orderID),
-		attribute.Float64("app.order.amount", amount),
-		attribute.String("app.user.id", userID),
+		attribute.String("app.order.id", order.OrderID),
+		attribute.Float64("app.order.amount", order.Amount),
+		attribute.String("app.order.currency", order.Currency),
+		attribute.Int("app.order.items.count", order.ItemCount),
+		attribute.String("app.user.id", order.UserID),
+		attribute.Float64("fraud.score", score),
+		attribute.Bool("app.fraud.detected", isFraud),
 	)
 
-	// 2% chance of fraud detection
-	isFraud := rand.Float32() < 0.02
-
-	span.SetAttributes(attribute.Bool("app.fraud.detected", isFraud))
-
 	ordersScanned.Add(ctx, 1)
 
 	if isFraud {
 		fraudsDetected.Add(ctx, 1)
+		fraudFlagged.Add(ctx, 1)
 		span.AddEvent("fraud_detected", trace.WithAttributes(
-			attribute.String("app.order.id", orderID),
-			attribute.String("app.fraud.reason", "suspicious_pattern"),
+			attribute.String("app.order.id", order.OrderID),
+			attribute.String("app.fraud.reason", "score_above_threshold"),
 		))
 		fraudLogger.WarnContext(ctx, "Fraud detected!",
-			"order_id", orderID,
-			"user_id", userID,
-			"amount", amount,
+			"order_id", order.OrderID,
+			"user_id", order.UserID,
+			"amount", order.Amount,
+			"currency", order.Currency,
+			"fraud_score", score,
+			"threshold", config.FraudScoreThreshold,
 		)
 	} else {
 		span.AddEvent("order_cleared")
 		fraudLogger.InfoContext(ctx, "Order cleared",
-			"order_id", orderID,
+			"order_id", order.OrderID,
+			"fraud_score", score,
 		)
 	}
 
 	return isFraud
 }
+
+// consumeFraudMessage handles an order delivered through Kafka. The
+// CONSUMER span is already started, and undecodable messages were already
+// dead-lettered.
+func consumeFraudMessage(ctx context.Context, msg kafka.Message, order orderEvent) error {
+	fraudLogger.InfoContext(ctx, "Received order from Kafka", "topic", msg.Topic, "consumer_group", fraudConsumerGroup, "offset", msg.Offset, "order_id", order.OrderID)
+	start := time.Now()
+	detectFraud(ctx, order)
+	recordProcessDuration(ctx, fraudProcessDuration, fraudConsumerGroup, start)
+	return nil
+}
@@ -0,0 +1,123 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"otel-mock/common"
+	"otel-mock/config"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	otellog "go.opentelemetry.io/otel/log"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	loadgenTracer trace.Tracer
+	loadgenLogger *slog.Logger
+)
+
+// RunLoadGenerator starts rps shopping sessions per second against the local
+// services, spread over concurrency workers, until ctx is cancelled. Each
+// session is its own trace: browse the catalog, add to cart, then check out.
+// Ticks that find every worker busy are dropped rather than queued.
+func RunLoadGenerator(ctx context.Context, tp trace.TracerProvider, mp metric.MeterProvider, lp otellog.LoggerProvider, rps float64, concurrency int) {
+	loadgenLogger = common.NewLogger("loadgen", lp)
+	loadgenTracer = tp.Tracer("loadgen")
+
+	client := common.NewHTTPClient(tp, mp, 30*time.Second)
+
+	sessions := make(chan struct{})
+	var wg sync.WaitGroup
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range sessions {
+				runSession(ctx, client)
+			}
+		}()
+	}
+
+	loadgenLogger.Info("Load generator starting", "rps", rps, "concurrency", concurrency)
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / rps))
+	defer ticker.Stop()
+
+	dropped := 0
+	for {
+		select {
+		case <-ctx.Done():
+			close(sessions)
+			wg.Wait()
+			loadgenLogger.Info("Load generator stopped", "dropped_sessions", dropped)
+			return
+		case <-ticker.C:
+			select {
+			case sessions <- struct{}{}:
+			default:
+				dropped++
+			}
+		}
+	}
+}
+
+func runSession(ctx context.Context, client *http.Client) {
+	// Mark the whole trace as generated traffic for downstream services
+	ctx, _ = common.WithBaggage(ctx, attribute.Bool(common.SyntheticKey, true))
+
+	userID := fmt.Sprintf("user-%d", rand.Intn(10000))
+	ctx, span := loadgenTracer.Start(ctx, "loadgen session",
+		trace.WithNewRoot(),
+		trace.WithAttributes(attribute.String("app.user.id", userID)))
+	defer span.End()
+
+	productID := GetProductID()
+	steps := []struct {
+		name, method, url string
+	}{
+		{"browse", "GET", config.ProductCatalogURL + "/products"},
+		{"view_product", "GET", fmt.Sprintf("%s/products/%s", config.ProductCatalogURL, productID)},
+		{"add_to_cart", "POST", fmt.Sprintf("%s/cart/add?user_id=%s&product_id=%s", config.CartURL, userID, productID)},
+		{"view_cart", "GET", fmt.Sprintf("%s/cart?user_id=%s", config.CartURL, userID)},
+		{"checkout", "POST", config.CheckoutURL + "/checkout"},
+	}
+	for _, step := range steps {
+		if err := sendLoadgenRequest(ctx, client, step.method, step.url); err != nil {
+			span.RecordError(err)
+			loadgenLogger.WarnContext(ctx, "Session step failed", "step", step.name, "error", err)
+			return
+		}
+		span.AddEvent(step.name)
+
+		// Think time between page views
+		select {
+		case <-time.After(time.Duration(rand.Intn(200)+50) * time.Millisecond):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func sendLoadgenRequest(ctx context.Context, client *http.Client, method, url string) error {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("%s %s returned %d", method, url, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"otel-mock/common"
+	"otel-mock/config"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ordersTopic is where checkout publishes placed orders
+const ordersTopic = "orders"
+
+// orderEvent is the message published to ordersTopic
+type orderEvent struct {
+	OrderID   string  `json:"order_id"`
+	UserID    string  `json:"user_id"`
+	Amount    float64 `json:"amount"`
+	Currency  string  `json:"currency"`
+	ItemCount int     `json:"item_count"`
+}
+
+// orderFromRequest decodes the order POSTed by checkout's Kafka mock. A bare
+// POST (e.g. from curl) gets a made-up order so the endpoint stays easy to poke.
+func orderFromRequest(r *http.Request) orderEvent {
+	var order orderEvent
+	if err := json.NewDecoder(r.Body).Decode(&order); err != nil || order.OrderID == "" {
+		return randomOrder()
+	}
+	return order
+}
+
+// linkProducer links the /consume server span to the span that sent the
+// mocked message (checkout's HTTP client span under "orders publish"),
+// mirroring the link on CONSUMER spans of real Kafka deliveries
+func linkProducer(r *http.Request) {
+	producer := otel.GetTextMapPropagator().Extract(context.Background(), propagation.HeaderCarrier(r.Header))
+	if sc := trace.SpanContextFromContext(producer); sc.IsValid() {
+		trace.SpanFromContext(r.Context()).AddLink(trace.Link{SpanContext: sc})
+	}
+}
+
+func randomOrder() orderEvent {
+	return orderEvent{
+		OrderID:   "order-" + randomString(8),
+		UserID:    "user-" + randomString(6),
+		Amount:    float64(rand.Intn(50000)+1000) / 100.0,
+		Currency:  []string{"USD", "EUR", "GBP", "JPY"}[rand.Intn(4)],
+		ItemCount: rand.Intn(5) + 1,
+	}
+}
+
+// orderHandler handles one decoded order delivered through Kafka; the
+// CONSUMER span is already started
+type orderHandler func(ctx context.Context, msg kafka.Message, order orderEvent) error
+
+// startOrdersConsumer consumes ordersTopic from KAFKA_ADDR as group, passing
+// each order to handle, until ctx is cancelled or server shuts down. Messages that don't decode
+// are moved to ordersTopic.dlq, and left uncommitted if that never succeeds.
+// The group's lag is reported on meter.
+func startOrdersConsumer(ctx context.Context, server *http.Server, tp trace.TracerProvider, meter metric.Meter, group string, logger *slog.Logger, handle orderHandler) {
+	consumer := common.NewKafkaConsumer(config.KafkaBrokers, ordersTopic, group, tp)
+	if err := consumer.RegisterLag(meter); err != nil {
+		logger.Error("Failed to register consumer lag gauge", "group", group, "error", err)
+	}
+	dlq := newDeadLetterQueue(meter, group, logger)
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		err := consumer.Run(ctx, func(ctx context.Context, msg kafka.Message) error {
+			var order orderEvent
+			if err := json.Unmarshal(msg.Value, &order); err != nil {
+				err = fmt.Errorf("undecodable order message: %w", err)
+				if dlqErr := dlq.send(ctx, msg, err); dlqErr != nil {
+					return dlqErr
+				}
+				return err
+			}
+			return handle(ctx, msg, order)
+		})
+		if err != nil {
+			logger.Error("Kafka consumer stopped", "group", group, "error", err)
+		}
+	}()
+
+	common.OnShutdown(server, func() {
+		cancel()
+		<-done
+		if err := consumer.Close(); err != nil {
+			logger.Error("Closing Kafka consumer failed", "group", group, "error", err)
+		} else {
+			logger.Info("Kafka consumer closed", "group", group)
+		}
+		if err := dlq.producer.Close(); err != nil {
+			logger.Error("Closing dead-letter producer failed", "group", group, "error", err)
+		}
+	})
+	logger.Info("Consuming orders from Kafka", "brokers", config.KafkaBrokers, "topic", ordersTopic, "group", group)
+}
+
+// Retries of a failed dead-letter publish back off from dlqInitialBackoff
+// up to dlqMaxBackoff
+const (
+	dlqInitialBackoff = 500 * time.Millisecond
+	dlqMaxBackoff     = 30 * time.Second
+)
+
+// publisher is the part of *common.KafkaProducer the dead-letter queue uses
+type publisher interface {
+	Publish(ctx context.Context, topic string, key, value []byte, headers ...kafka.Header) error
+	Close() error
+}
+
+// deadLetterQueue republishes messages a consumer group can't process
+type deadLetterQueue struct {
+	producer publisher
+	sent     metric.Int64Counter
+	group    string
+	logger   *slog.Logger
+}
+
+func newDeadLetterQueue(meter metric.Meter, group string, logger *slog.Logger) *deadLetterQueue {
+	sent, err := meter.Int64Counter("messaging.dlq.sent",
+		metric.WithDescription("Messages moved to a dead-letter topic"),
+		metric.WithUnit("{message}"))
+	if err != nil {
+		logger.Error("Failed to create messaging.dlq.sent counter", "error", err)
+	}
+	return &deadLetterQueue{
+		producer: common.NewKafkaProducer(config.KafkaBrokers),
+		sent:     sent,
+		group:    group,
+		logger:   logger,
+	}
+}
+
+// send copies msg to <topic>.dlq with the failure in a dlq.error header. The
+// message mustn't be committed before it's safely dead-lettered, so a failed
+// publish is retried until it succeeds or ctx is done; then send returns an
+// error wrapping common.ErrRedeliver to keep it uncommitted.
+func (q *deadLetterQueue) send(ctx context.Context, msg kafka.Message, reason error) error {
+	topic := msg.Topic + ".dlq"
+	backoff := dlqInitialBackoff
+	for {
+		err := q.producer.Publish(ctx, topic, msg.Key, msg.Value, kafka.Header{Key: "dlq.error", Value: []byte(reason.Error())})
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("%w: dead-lettering to %s failed: %w", common.ErrRedeliver, topic, err)
+		}
+		q.logger.ErrorContext(ctx, "Dead-lettering message failed, retrying", "topic", topic, "offset", msg.Offset, "retry_in", backoff, "error", err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: dead-lettering to %s failed: %w", common.ErrRedeliver, topic, err)
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, dlqMaxBackoff)
+	}
+
+	q.sent.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("messaging.destination.name", topic),
+		attribute.String("messaging.consumer.group.name", q.group),
+	))
+	trace.SpanFromContext(ctx).AddEvent("dead_lettered", trace.WithAttributes(
+		attribute.String("messaging.destination.name", topic),
+		attribute.String("error.message", reason.Error()),
+	))
+	q.logger.WarnContext(ctx, "Moved unprocessable message to dead-letter topic", "topic", topic, "offset", msg.Offset, "error", reason)
+	return nil
+}
+
+// newProcessDuration creates the messaging.process.duration histogram, with
+// buckets sized for sub-second message handling
+func newProcessDuration(meter metric.Meter) (metric.Float64Histogram, error) {
+	return meter.Float64Histogram("messaging.process.duration",
+		metric.WithDescription("Duration of processing one order message"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1))
+}
+
+// recordProcessDuration records the time since start for one ordersTopic
+// message handled by group
+func recordProcessDuration(ctx context.Context, h metric.Float64Histogram, group string, start time.Time) {
+	h.Record(ctx, time.Since(start).Seconds(), metric.WithAttributes(
+		attribute.String("messaging.system", "kafka"),
+		attribute.String("messaging.destination.name", ordersTopic),
+		attribute.String("messaging.consumer.group.name", group),
+	))
+}
@@ -0,0 +1,179 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"otel-mock/common"
+	"otel-mock/config"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel/attribute"
+	otellog "go.opentelemetry.io/otel/log"
+	lognoop "go.opentelemetry.io/otel/log/noop"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/trace"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
+)
+
+// fakePublisher fails the first failures publishes, then succeeds
+type fakePublisher struct {
+	failures  int
+	attempts  int
+	published []string
+}
+
+func (p *fakePublisher) Publish(_ context.Context, topic string, _, _ []byte, _ ...kafka.Header) error {
+	p.attempts++
+	if p.attempts <= p.failures {
+		return errors.New("broker unavailable")
+	}
+	p.published = append(p.published, topic)
+	return nil
+}
+
+func (p *fakePublisher) Close() error { return nil }
+
+func newTestDLQ(producer publisher) *deadLetterQueue {
+	sent, _ := noop.NewMeterProvider().Meter("test").Int64Counter("messaging.dlq.sent")
+	return &deadLetterQueue{
+		producer: producer,
+		sent:     sent,
+		group:    "test",
+		logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+}
+
+func TestDeadLetterQueueRetriesPublish(t *testing.T) {
+	producer := &fakePublisher{failures: 1}
+	dlq := newTestDLQ(producer)
+
+	err := dlq.send(context.Background(), kafka.Message{Topic: "orders", Offset: 7}, errors.New("undecodable"))
+	if err != nil {
+		t.Fatalf("send = %v, want nil after a retry", err)
+	}
+	if producer.attempts != 2 || len(producer.published) != 1 || producer.published[0] != "orders.dlq" {
+		t.Errorf("attempts = %d, published = %v; want 2 attempts and one publish to orders.dlq", producer.attempts, producer.published)
+	}
+}
+
+func TestDeadLetterQueueRedeliversWhenCancelled(t *testing.T) {
+	producer := &fakePublisher{failures: 1 << 30}
+	dlq := newTestDLQ(producer)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := dlq.send(ctx, kafka.Message{Topic: "orders", Offset: 7}, errors.New("undecodable"))
+	if !errors.Is(err, common.ErrRedeliver) {
+		t.Errorf("send = %v, want an error wrapping ErrRedeliver", err)
+	}
+	if len(producer.published) != 0 {
+		t.Errorf("published = %v, want nothing", producer.published)
+	}
+}
+
+func TestConsumeHandlersServerSpans(t *testing.T) {
+	tests := []struct {
+		service string
+		init    func(context.Context, string, trace.TracerProvider, metric.MeterProvider, otellog.LoggerProvider) *http.Server
+	}{
+		{"accounting", InitAccountingService},
+		{"fraud-detection", InitFraudDetectionService},
+	}
+	for _, tt := range tests {
+		t.Run(tt.service, func(t *testing.T) {
+			usePropagator(t)
+			setConfig(t, &config.KafkaBrokers, nil)
+			tp, exporter := common.NewInMemoryTracerProvider()
+			t.Cleanup(func() { tp.Shutdown(context.Background()) })
+			ts := httptest.NewServer(tt.init(context.Background(), ":0", tp, noop.NewMeterProvider(), lognoop.NewLoggerProvider()).Handler)
+			t.Cleanup(ts.Close)
+
+			const traceID = "0af7651916cd43dd8448eb211c80319c"
+			req, _ := http.NewRequest(http.MethodPost, ts.URL+"/consume", nil)
+			req.Header.Set("traceparent", "00-"+traceID+"-b7ad6b7169203331-01")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			var found bool
+			for _, s := range exporter.GetSpans() {
+				if s.Name != "orders receive" {
+					continue
+				}
+				found = true
+				if s.SpanKind != trace.SpanKindServer {
+					t.Errorf("orders receive kind = %v, want server", s.SpanKind)
+				}
+				if s.SpanContext.TraceID().String() != traceID {
+					t.Errorf("orders receive trace ID = %s, want the incoming %s", s.SpanContext.TraceID(), traceID)
+				}
+			}
+			if !found {
+				t.Errorf("no orders receive span among %d spans", len(exporter.GetSpans()))
+			}
+		})
+	}
+}
+
+func TestConsumeHandlersRecordProcessDuration(t *testing.T) {
+	tests := []struct {
+		service string
+		group   string
+		init    func(context.Context, string, trace.TracerProvider, metric.MeterProvider, otellog.LoggerProvider) *http.Server
+	}{
+		{"accounting", accountingConsumerGroup, InitAccountingService},
+		{"fraud-detection", fraudConsumerGroup, InitFraudDetectionService},
+	}
+	for _, tt := range tests {
+		t.Run(tt.service, func(t *testing.T) {
+			setConfig(t, &config.KafkaBrokers, nil)
+			reader := sdkmetric.NewManualReader()
+			mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+			t.Cleanup(func() { mp.Shutdown(context.Background()) })
+			ts := httptest.NewServer(tt.init(context.Background(), ":0", tracenoop.NewTracerProvider(), mp, lognoop.NewLoggerProvider()).Handler)
+			t.Cleanup(ts.Close)
+
+			resp, err := http.Post(ts.URL+"/consume", "application/json", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			var rm metricdata.ResourceMetrics
+			if err := reader.Collect(context.Background(), &rm); err != nil {
+				t.Fatal(err)
+			}
+			var points []metricdata.HistogramDataPoint[float64]
+			for _, sm := range rm.ScopeMetrics {
+				for _, m := range sm.Metrics {
+					if m.Name == "messaging.process.duration" {
+						points = m.Data.(metricdata.Histogram[float64]).DataPoints
+					}
+				}
+			}
+			if len(points) != 1 || points[0].Count != 1 {
+				t.Fatalf("messaging.process.duration points = %+v, want one recording", points)
+			}
+			want := map[attribute.Key]string{
+				"messaging.system":              "kafka",
+				"messaging.destination.name":    ordersTopic,
+				"messaging.consumer.group.name": tt.group,
+			}
+			for key, value := range want {
+				if got, _ := points[0].Attributes.Value(key); got.AsString() != value {
+					t.Errorf("%s = %q, want %q", key, got.AsString(), value)
+				}
+			}
+		})
+	}
+}
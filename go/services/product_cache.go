@@ -0,0 +1,51 @@
+package services
+
+import (
+	"container/list"
+	"sync"
+)
+
+// productLRU is a fixed-size, least-recently-used cache of products by ID. A
+// size of zero or less caches nothing. It is safe for concurrent use.
+type productLRU struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List // of Product, most recently used first
+	entries map[string]*list.Element
+}
+
+func newProductLRU(size int) *productLRU {
+	return &productLRU{size: size, order: list.New(), entries: make(map[string]*list.Element, max(size, 0))}
+}
+
+// get returns the cached product for id and marks it most recently used
+func (c *productLRU) get(id string) (Product, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[id]
+	if !ok {
+		return Product{}, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(Product), true
+}
+
+// add caches p, evicting the least recently used product once size is reached
+func (c *productLRU) add(p Product) {
+	if c.size <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[p.ID]; ok {
+		e.Value = p
+		c.order.MoveToFront(e)
+		return
+	}
+	if c.order.Len() >= c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(Product).ID)
+	}
+	c.entries[p.ID] = c.order.PushFront(p)
+}
@@ -0,0 +1,95 @@
+package services
+
+import (
+	"slices"
+	"testing"
+)
+
+// lruOp is a get or, when add is set, an add of a product with id and name
+type lruOp struct {
+	add  bool
+	id   string
+	name string
+}
+
+func TestProductLRU(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		ops  []lruOp
+		// want maps every probed ID to its cached name, "" meaning absent
+		want map[string]string
+	}{
+		{
+			name: "evicts the least recently added at size",
+			size: 2,
+			ops:  []lruOp{{add: true, id: "a"}, {add: true, id: "b"}, {add: true, id: "c"}},
+			want: map[string]string{"a": "", "b": "b", "c": "c"},
+		},
+		{
+			name: "get refreshes recency",
+			size: 2,
+			ops:  []lruOp{{add: true, id: "a"}, {add: true, id: "b"}, {id: "a"}, {add: true, id: "c"}},
+			want: map[string]string{"a": "a", "b": "", "c": "c"},
+		},
+		{
+			name: "adding an existing ID replaces it without evicting",
+			size: 2,
+			ops:  []lruOp{{add: true, id: "a"}, {add: true, id: "b"}, {add: true, id: "a", name: "a2"}},
+			want: map[string]string{"a": "a2", "b": "b"},
+		},
+		{
+			name: "replacing refreshes recency",
+			size: 2,
+			ops:  []lruOp{{add: true, id: "a"}, {add: true, id: "b"}, {add: true, id: "a", name: "a2"}, {add: true, id: "c"}},
+			want: map[string]string{"a": "a2", "b": "", "c": "c"},
+		},
+		{
+			name: "size zero caches nothing",
+			size: 0,
+			ops:  []lruOp{{add: true, id: "a"}, {add: true, id: "b"}},
+			want: map[string]string{"a": "", "b": ""},
+		},
+		{
+			name: "negative size caches nothing",
+			size: -1,
+			ops:  []lruOp{{add: true, id: "a"}},
+			want: map[string]string{"a": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newProductLRU(tt.size)
+			for _, op := range tt.ops {
+				if !op.add {
+					c.get(op.id)
+					continue
+				}
+				name := op.name
+				if name == "" {
+					name = op.id
+				}
+				c.add(Product{ID: op.id, Name: name})
+			}
+
+			ids := make([]string, 0, len(tt.want))
+			for id := range tt.want {
+				ids = append(ids, id)
+			}
+			// Probe in a fixed order; get changes recency but nothing is
+			// added afterwards
+			slices.Sort(ids)
+			for _, id := range ids {
+				p, ok := c.get(id)
+				if want := tt.want[id]; want == "" && ok {
+					t.Errorf("get(%s) = %q, want a miss", id, p.Name)
+				} else if want != "" && (!ok || p.Name != want) {
+					t.Errorf("get(%s) = %q, %v; want %q", id, p.Name, ok, want)
+				}
+			}
+			if n := c.order.Len(); n > max(tt.size, 0) {
+				t.Errorf("cache holds %d products, more than size %d", n, tt.size)
+			}
+		})
+	}
+}
@@ -3,32 +3,38 @@ package services
 import (
 	"context"
 	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"log/slog"
 	"math/rand"
 	"net/http"
+	"otel-mock/common"
+	"otel-mock/config"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/XSAM/otelsql"
 	_ "github.com/mattn/go-sqlite3"
-	"go.opentelemetry.io/contrib/bridges/otelslog"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
-	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 	otellog "go.opentelemetry.io/otel/log"
 	"go.opentelemetry.io/otel/metric"
-	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	"go.opentelemetry.io/otel/trace"
 )
 
 var (
-	productLogger  *slog.Logger
-	productMeter   metric.Meter
-	productCounter metric.Int64Counter
+	productTracer       trace.Tracer
+	productLogger       *slog.Logger
+	productMeter        metric.Meter
+	productCounter      metric.Int64Counter
+	productCacheLookups metric.Int64Counter
+	productCache        = newProductLRU(config.ProductCacheSize)
 )
 
-// Mock product data
 type Product struct {
 	ID          string   `json:"id"`
 	Name        string   `json:"name"`
@@ -37,21 +43,27 @@ type Product struct {
 	Categories  []string `json:"categories"`
 }
 
-var products = []Product{
-	{ID: "OLJCESPC7Z", Name: "Sunglasses", Description: "High quality sunglasses", Price: 19.99, Categories: []string{"accessories"}},
-	{ID: "66VCHSJNUP", Name: "Tank Top", Description: "Comfortable tank top", Price: 18.99, Categories: []string{"clothing"}},
-	{ID: "1YMWWN1N4O", Name: "Watch", Description: "Classic wristwatch", Price: 109.99, Categories: []string{"accessories"}},
-	{ID: "L9ECAV7KIM", Name: "Loafers", Description: "Leather loafers", Price: 89.99, Categories: []string{"footwear"}},
-	{ID: "2ZYFJ3GM2N", Name: "Hairdryer", Description: "Professional hairdryer", Price: 24.99, Categories: []string{"beauty"}},
-	{ID: "0PUK6V6EV0", Name: "Candle Holder", Description: "Decorative candle holder", Price: 15.99, Categories: []string{"home"}},
-	{ID: "LS4PSXUNUM", Name: "Salt Shaker", Description: "Ceramic salt shaker", Price: 9.99, Categories: []string{"home"}},
-	{ID: "9SIQT8TOJO", Name: "Bamboo Glass Jar", Description: "Eco-friendly glass jar", Price: 14.99, Categories: []string{"home"}},
-	{ID: "6E92ZMYYFZ", Name: "Mug", Description: "Ceramic coffee mug", Price: 12.99, Categories: []string{"home"}},
+// ErrProductNotFound is returned by GetProduct for an unknown ID
+var ErrProductNotFound = errors.New("product not found")
+
+//go:embed products.json
+var productsJSON []byte
+
+// products is the catalog, loaded from products.json when the package is
+// initialized so other services can pick product IDs before this one starts
+var products = loadProducts()
+
+func loadProducts() []Product {
+	var catalog []Product
+	if err := json.Unmarshal(productsJSON, &catalog); err != nil {
+		panic(fmt.Sprintf("parsing products.json: %v", err))
+	}
+	return catalog
 }
 
 var sqliteDB *sql.DB
 
-func initSQLite(tp *sdktrace.TracerProvider) {
+func initSQLite(ctx context.Context, tp trace.TracerProvider, mp metric.MeterProvider) {
 	db, err := otelsql.Open("sqlite3", "file::memory:?cache=shared",
 		otelsql.WithAttributes(
 			attribute.String("db.system", "sqlite"),
@@ -60,21 +72,21 @@ func initSQLite(tp *sdktrace.TracerProvider) {
 		otelsql.WithTracerProvider(tp),
 	)
 	if err != nil {
-		log.Printf("Failed to open SQLite: %v", err)
+		productLogger.Error("Failed to open SQLite", "error", err)
 		return
 	}
 
 	// Register DB stats metrics
 	if _, err := otelsql.RegisterDBStatsMetrics(db,
 		otelsql.WithAttributes(attribute.String("db.system", "sqlite")),
+		otelsql.WithMeterProvider(mp),
 	); err != nil {
-		log.Printf("Failed to register SQLite metrics: %v", err)
+		productLogger.Error("Failed to register SQLite metrics", "error", err)
 	}
 
 	sqliteDB = db
 
 	// Create and seed products table - use ExecContext for instrumentation
-	ctx := context.Background()
 	_, err = sqliteDB.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS products (
 		id TEXT PRIMARY KEY,
 		name TEXT NOT NULL,
@@ -83,7 +95,7 @@ func initSQLite(tp *sdktrace.TracerProvider) {
 		categories TEXT
 	)`)
 	if err != nil {
-		log.Printf("Failed to create products table: %v", err)
+		productLogger.Error("Failed to create products table", "error", err)
 		return
 	}
 
@@ -92,14 +104,14 @@ func initSQLite(tp *sdktrace.TracerProvider) {
 		_, err := sqliteDB.ExecContext(ctx, `INSERT OR REPLACE INTO products VALUES (?, ?, ?, ?, ?)`,
 			p.ID, p.Name, p.Description, p.Price, strings.Join(p.Categories, ","))
 		if err != nil {
-			log.Printf("Failed to insert product %s: %v", p.ID, err)
+			productLogger.Error("Failed to insert product", "product_id", p.ID, "error", err)
 		}
 	}
-	log.Printf("SQLite initialized with %d products", len(products))
+	productLogger.Info("SQLite initialized", "products", len(products))
 }
 
-func initProductMetrics() {
-	productMeter = otel.Meter("product-catalog")
+func initProductMetrics(mp metric.MeterProvider) {
+	productMeter = mp.Meter("product-catalog")
 	var err error
 
 	productCounter, err = productMeter.Int64Counter("app.products.requests",
@@ -108,27 +120,36 @@ func initProductMetrics() {
 	if err != nil {
 		panic(err)
 	}
+
+	productCacheLookups, err = productMeter.Int64Counter("product_catalog.cache",
+		metric.WithDescription("GetProduct cache lookups by result (hit or miss)"),
+		metric.WithUnit("{lookups}"))
+	if err != nil {
+		panic(err)
+	}
 }
 
-func RunProductCatalogService(tp *sdktrace.TracerProvider, lp otellog.LoggerProvider) {
-	productLogger = otelslog.NewLogger("product-catalog", otelslog.WithLoggerProvider(lp))
-	initProductMetrics()
-	initSQLite(tp)
+// InitProductCatalogService creates the product-catalog HTTP server on port; the caller starts it
+func InitProductCatalogService(ctx context.Context, port string, tp trace.TracerProvider, mp metric.MeterProvider, lp otellog.LoggerProvider) *http.Server {
+	productLogger = common.NewLogger("product-catalog", lp)
+	productTracer = tp.Tracer("product-catalog")
+	initProductMetrics(mp)
+	initSQLite(ctx, tp, mp)
 
 	listHandler := otelhttp.NewHandler(
-		http.HandlerFunc(listProductsHandler),
+		common.Recover("product-catalog", mp, lp, common.InjectFaults("product-catalog", http.HandlerFunc(listProductsHandler))),
 		"ListProducts",
 		otelhttp.WithTracerProvider(tp),
 	)
 
 	getHandler := otelhttp.NewHandler(
-		http.HandlerFunc(getProductHandler),
+		common.Recover("product-catalog", mp, lp, common.InjectFaults("product-catalog", http.HandlerFunc(getProductHandler))),
 		"GetProduct",
 		otelhttp.WithTracerProvider(tp),
 	)
 
 	searchHandler := otelhttp.NewHandler(
-		http.HandlerFunc(searchProductsHandler),
+		common.Recover("product-catalog", mp, lp, common.InjectFaults("product-catalog", http.HandlerFunc(searchProductsHandler))),
 		"SearchProducts",
 		otelhttp.WithTracerProvider(tp),
 	)
@@ -138,11 +159,8 @@ func RunProductCatalogService(tp *sdktrace.TracerProvider, lp otellog.LoggerProv
 	mux.Handle("/products/", getHandler) // /products/{id}
 	mux.Handle("/products/search", searchHandler)
 
-	port := ":8085"
 	productLogger.Info("Product Catalog Service starting", "port", port)
-	if err := http.ListenAndServe(port, mux); err != nil {
-		productLogger.Error("Product Catalog Service failed", "error", err)
-	}
+	return &http.Server{Addr: port, Handler: mux}
 }
 
 func listProductsHandler(w http.ResponseWriter, r *http.Request) {
@@ -150,21 +168,24 @@ func listProductsHandler(w http.ResponseWriter, r *http.Request) {
 	span := trace.SpanFromContext(ctx)
 
 	span.SetAttributes(
-		attribute.Int("app.products.count", len(products)),
 		attribute.String("rpc.system", "grpc"),
 		attribute.String("rpc.service", "oteldemo.ProductCatalogService"),
 		attribute.String("rpc.method", "ListProducts"),
 	)
 
+	results := ListProducts(ctx)
+	span.SetAttributes(attribute.Int("app.products.count", len(results)))
+
 	productCounter.Add(ctx, 1, metric.WithAttributes(
 		attribute.String("method", "ListProducts"),
 	))
 
-	productLogger.InfoContext(ctx, "ListProducts", "count", len(products))
+	productLogger.InfoContext(ctx, "ListProducts", "count", len(results))
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, `{"products": %d}`, len(products))
+	writeProductJSON(w, http.StatusOK, map[string]interface{}{
+		"products": results,
+		"count":    len(results),
+	})
 }
 
 func getProductHandler(w http.ResponseWriter, r *http.Request) {
@@ -172,8 +193,7 @@ func getProductHandler(w http.ResponseWriter, r *http.Request) {
 	span := trace.SpanFromContext(ctx)
 
 	// Extract product ID from path
-	path := r.URL.Path
-	id := strings.TrimPrefix(path, "/products/")
+	id := strings.TrimPrefix(r.URL.Path, "/products/")
 
 	span.SetAttributes(
 		attribute.String("app.product.id", id),
@@ -182,23 +202,23 @@ func getProductHandler(w http.ResponseWriter, r *http.Request) {
 		attribute.String("rpc.method", "GetProduct"),
 	)
 
-	var found Product
-	err := sqliteDB.QueryRowContext(ctx,
-		`SELECT id, name, description, price FROM products WHERE id = ?`, id).
-		Scan(&found.ID, &found.Name, &found.Description, &found.Price)
-
-	if err == sql.ErrNoRows {
+	found, err := GetProduct(ctx, id)
+	if errors.Is(err, ErrProductNotFound) {
 		span.SetAttributes(attribute.Bool("product.found", false))
+		span.SetStatus(codes.Error, err.Error())
 		productCounter.Add(ctx, 1, metric.WithAttributes(
 			attribute.String("method", "GetProduct"),
 			attribute.String("status", "not_found"),
 		))
-		http.Error(w, "Product not found", http.StatusNotFound)
+		productLogger.WarnContext(ctx, "GetProduct not found", "product_id", id)
+		writeProductJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
 		return
 	}
 	if err != nil {
 		span.RecordError(err)
-		http.Error(w, "Database error", http.StatusInternalServerError)
+		span.SetStatus(codes.Error, err.Error())
+		productLogger.ErrorContext(ctx, "GetProduct failed", "product_id", id, "error", err)
+		writeProductJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
 		return
 	}
 
@@ -217,9 +237,7 @@ func getProductHandler(w http.ResponseWriter, r *http.Request) {
 		"product_name", found.Name,
 	)
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, `{"id": "%s", "name": "%s", "price": %.2f}`, found.ID, found.Name, found.Price)
+	writeProductJSON(w, http.StatusOK, found)
 }
 
 func searchProductsHandler(w http.ResponseWriter, r *http.Request) {
@@ -231,16 +249,20 @@ func searchProductsHandler(w http.ResponseWriter, r *http.Request) {
 		query = "sunglasses"
 	}
 
-	// Mock search
-	var results []Product
-	queryLower := strings.ToLower(query)
-	for _, p := range products {
-		if strings.Contains(strings.ToLower(p.Name), queryLower) ||
-			strings.Contains(strings.ToLower(p.Description), queryLower) {
-			results = append(results, p)
+	delay := searchDelay()
+	if raw := r.URL.Query().Get("slow_ms"); raw != "" {
+		ms, err := strconv.Atoi(raw)
+		if err != nil || ms < 0 {
+			err = fmt.Errorf("invalid slow_ms %q", raw)
+			span.SetStatus(codes.Error, err.Error())
+			writeProductJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
 		}
+		delay = time.Duration(ms) * time.Millisecond
 	}
 
+	results := searchProducts(ctx, query, delay)
+
 	span.SetAttributes(
 		attribute.String("search.query", query),
 		attribute.Int("app.products_search.count", len(results)),
@@ -258,9 +280,124 @@ func searchProductsHandler(w http.ResponseWriter, r *http.Request) {
 		"results", len(results),
 	)
 
+	writeProductJSON(w, http.StatusOK, map[string]interface{}{
+		"query":   query,
+		"results": results,
+		"count":   len(results),
+	})
+}
+
+func writeProductJSON(w http.ResponseWriter, status int, v interface{}) {
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, `{"query": "%s", "results": %d}`, query, len(results))
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// ListProducts returns the whole catalog
+func ListProducts(ctx context.Context) []Product {
+	_, span := productTracer.Start(ctx, "listProducts")
+	defer span.End()
+
+	span.SetAttributes(attribute.Int("app.products.count", len(products)))
+	return products
+}
+
+// GetProduct looks id up in the SQLite copy of the catalog, returning
+// ErrProductNotFound if there's no such product
+func GetProduct(ctx context.Context, id string) (Product, error) {
+	ctx, span := productTracer.Start(ctx, "getProduct", trace.WithAttributes(
+		attribute.String("product.id", id),
+	))
+	defer span.End()
+
+	if sqliteDB == nil {
+		err := errors.New("product database not initialized")
+		span.SetStatus(codes.Error, err.Error())
+		return Product{}, err
+	}
+
+	if cached, ok := productCache.get(id); ok {
+		recordCacheLookup(ctx, span, "hit")
+		return cached, nil
+	}
+	recordCacheLookup(ctx, span, "miss")
+
+	var found Product
+	var categories string
+	err := sqliteDB.QueryRowContext(ctx,
+		`SELECT id, name, description, price, categories FROM products WHERE id = ?`, id).
+		Scan(&found.ID, &found.Name, &found.Description, &found.Price, &categories)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = fmt.Errorf("%w: %s", ErrProductNotFound, id)
+		span.SetStatus(codes.Error, err.Error())
+		return Product{}, err
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return Product{}, err
+	}
+	if categories != "" {
+		found.Categories = strings.Split(categories, ",")
+	}
+	productCache.add(found)
+	return found, nil
+}
+
+// recordCacheLookup adds a cache.hit or cache.miss event to span and counts
+// the lookup in product_catalog.cache
+func recordCacheLookup(ctx context.Context, span trace.Span, result string) {
+	span.AddEvent("cache." + result)
+	if productCacheLookups != nil {
+		productCacheLookups.Add(ctx, 1, metric.WithAttributes(attribute.String("result", result)))
+	}
+}
+
+// SearchProducts returns the products whose name or description contains
+// query, ignoring case. PRODUCT_CATALOG_SLOW_SEARCH_MS or the
+// slowProductCatalog flag slows it down.
+func SearchProducts(ctx context.Context, query string) []Product {
+	return searchProducts(ctx, query, searchDelay())
+}
+
+// flagSearchDelay is how slow searches get while slowProductCatalog is on
+const flagSearchDelay = 2 * time.Second
+
+// searchDelay is the delay a search gets unless the request overrides it
+func searchDelay() time.Duration {
+	if common.Flags.Enabled(common.FlagSlowProductCatalog) {
+		return max(config.SlowSearchDelay, flagSearchDelay)
+	}
+	return config.SlowSearchDelay
+}
+
+// searchProducts sleeps for delay inside its span before searching, so a slow
+// search shows up as one long hop in the checkout trace
+func searchProducts(ctx context.Context, query string, delay time.Duration) []Product {
+	ctx, span := productTracer.Start(ctx, "searchProducts", trace.WithAttributes(
+		attribute.String("query", query),
+	))
+	defer span.End()
+
+	if delay > 0 {
+		span.SetAttributes(attribute.Int64("app.search.injected_delay_ms", delay.Milliseconds()))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+	}
+
+	results := []Product{}
+	queryLower := strings.ToLower(query)
+	for _, p := range products {
+		if strings.Contains(strings.ToLower(p.Name), queryLower) ||
+			strings.Contains(strings.ToLower(p.Description), queryLower) {
+			results = append(results, p)
+		}
+	}
+
+	span.SetAttributes(attribute.Int("app.products_search.count", len(results)))
+	return results
 }
 
 // GetRandomProduct returns a random product for other services to use
@@ -2,18 +2,22 @@ package services
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
-	"math/rand"
+	"math"
 	"net/http"
+	"net/url"
+	"otel-mock/common"
 	"otel-mock/config"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
-	"go.opentelemetry.io/contrib/bridges/otelslog"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
-	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 	otellog "go.opentelemetry.io/otel/log"
 	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/trace"
@@ -21,14 +25,15 @@ import (
 
 var (
 	shippingTracer      trace.Tracer
+	quoteClient         *http.Client
 	shippingLogger      *slog.Logger
 	shippingMeter       metric.Meter
 	shippingItemsCount  metric.Int64Counter
 	shippingQuoteMetric metric.Float64Histogram
 )
 
-func initShippingMetrics() {
-	shippingMeter = otel.Meter("shipping")
+func initShippingMetrics(mp metric.MeterProvider) {
+	shippingMeter = mp.Meter("shipping")
 	var err error
 
 	shippingItemsCount, err = shippingMeter.Int64Counter("app.shipping.items_count",
@@ -46,19 +51,21 @@ func initShippingMetrics() {
 	}
 }
 
-func RunShippingService(tp trace.TracerProvider, lp otellog.LoggerProvider) {
-	shippingLogger = otelslog.NewLogger("shipping", otelslog.WithLoggerProvider(lp))
+// InitShippingService creates the shipping HTTP server on port; the caller starts it
+func InitShippingService(ctx context.Context, port string, tp trace.TracerProvider, mp metric.MeterProvider, lp otellog.LoggerProvider) *http.Server {
+	shippingLogger = common.NewLogger("shipping", lp)
 	shippingTracer = tp.Tracer("shipping")
-	initShippingMetrics()
+	quoteClient = common.NewHTTPClient(tp, mp, 30*time.Second)
+	initShippingMetrics(mp)
 
 	handler := otelhttp.NewHandler(
-		http.HandlerFunc(shipHandler),
+		common.Recover("shipping", mp, lp, common.InjectFaults("shipping", http.HandlerFunc(shipHandler))),
 		"ship",
 		otelhttp.WithTracerProvider(tp),
 	)
 
 	quoteHandler := otelhttp.NewHandler(
-		http.HandlerFunc(getQuoteHandler),
+		common.Recover("shipping", mp, lp, common.InjectFaults("shipping", http.HandlerFunc(getQuoteHandler))),
 		"get-quote",
 		otelhttp.WithTracerProvider(tp),
 	)
@@ -67,143 +74,253 @@ func RunShippingService(tp trace.TracerProvider, lp otellog.LoggerProvider) {
 	mux.Handle("/ship", handler)
 	mux.Handle("/get-quote", quoteHandler)
 
-	port := ":8082"
 	shippingLogger.Info("Shipping Service starting", "port", port)
-	if err := http.ListenAndServe(port, mux); err != nil {
-		shippingLogger.Error("Shipping Service failed", "error", err)
+	return &http.Server{Addr: port, Handler: mux}
+}
+
+// Address is where an order ships to
+type Address struct {
+	StreetAddress string `json:"street_address"`
+	City          string `json:"city"`
+	State         string `json:"state"`
+	Country       string `json:"country"`
+	ZipCode       string `json:"zip_code"`
+}
+
+// Validation errors from GetQuote and ShipOrder
+var (
+	ErrInvalidAddress = errors.New("invalid address")
+	ErrNoItems        = errors.New("no items to ship")
+)
+
+func (a Address) validate() error {
+	if strings.TrimSpace(a.Country) == "" || strings.TrimSpace(a.ZipCode) == "" {
+		return fmt.Errorf("%w: country and zip code are required", ErrInvalidAddress)
+	}
+	return nil
+}
+
+func (a Address) attributes() []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("app.shipping.address.city", a.City),
+		attribute.String("app.shipping.address.state", a.State),
+		attribute.String("app.shipping.address.country", a.Country),
+		attribute.String("app.shipping.address.zip_code", a.ZipCode),
 	}
 }
 
+// addressFromQuery reads an address from the street, city, state, country and
+// zip query parameters
+func addressFromQuery(q url.Values) Address {
+	return Address{
+		StreetAddress: q.Get("street"),
+		City:          q.Get("city"),
+		State:         q.Get("state"),
+		Country:       q.Get("country"),
+		ZipCode:       q.Get("zip"),
+	}
+}
+
+// itemsFromQuery reads the comma-separated product IDs in the items parameter
+func itemsFromQuery(q url.Values) []string {
+	var items []string
+	for _, id := range strings.Split(q.Get("items"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			items = append(items, id)
+		}
+	}
+	return items
+}
+
+// Shipping cost heuristic: a flat base plus a per-kilo rate scaled by how far
+// the destination is from the US warehouse
+const (
+	shippingBaseRate = 5.99
+	shippingPerKilo  = 3.00
+	itemWeightKilos  = 0.5
+)
+
+// distanceFactor is 1 for domestic orders, 1.5 for neighbouring countries and
+// 2.5 for everywhere else
+func distanceFactor(country string) float64 {
+	switch strings.ToUpper(strings.TrimSpace(country)) {
+	case "US", "USA", "UNITED STATES":
+		return 1
+	case "CA", "CANADA", "MX", "MEXICO":
+		return 1.5
+	default:
+		return 2.5
+	}
+}
+
+// shippingCost prices itemCount items to addr, rounded to cents
+func shippingCost(addr Address, itemCount int) float64 {
+	weight := float64(itemCount) * itemWeightKilos
+	cost := shippingBaseRate + weight*shippingPerKilo*distanceFactor(addr.Country)
+	return math.Round(cost*100) / 100
+}
+
+// GetQuote prices shipping items to addr. The address needs at least a country
+// and zip code, and there must be something to ship.
+func GetQuote(ctx context.Context, addr Address, items []string) (float64, error) {
+	ctx, span := shippingTracer.Start(ctx, "GetQuote", trace.WithAttributes(addr.attributes()...))
+	defer span.End()
+	span.SetAttributes(attribute.Int("app.shipping.items.count", len(items)))
+
+	if err := validateShipment(addr, items); err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return 0, err
+	}
+
+	quote, err := createQuote(ctx, addr, len(items))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return 0, err
+	}
+	span.SetAttributes(attribute.Float64("app.shipping.cost.total", quote))
+	return quote, nil
+}
+
+// ShipOrder books the shipment and returns its tracking ID
+func ShipOrder(ctx context.Context, addr Address, items []string) (string, error) {
+	_, span := shippingTracer.Start(ctx, "ShipOrder", trace.WithAttributes(addr.attributes()...))
+	defer span.End()
+	span.SetAttributes(attribute.Int("app.shipping.items.count", len(items)))
+
+	if err := validateShipment(addr, items); err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return "", err
+	}
+
+	trackingID := uuid.New().String()
+	shippingItemsCount.Add(ctx, int64(len(items)))
+	span.SetAttributes(attribute.String("app.shipping.tracking.id", trackingID))
+	return trackingID, nil
+}
+
+func validateShipment(addr Address, items []string) error {
+	if err := addr.validate(); err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		return ErrNoItems
+	}
+	return nil
+}
+
 func shipHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	span := trace.SpanFromContext(ctx)
 
 	shippingLogger.InfoContext(ctx, "Processing shipping request")
 
-	itemCount := rand.Intn(5) + 1
-	quote, err := createQuoteFromCount(ctx, itemCount)
+	addr := addressFromQuery(r.URL.Query())
+	items := itemsFromQuery(r.URL.Query())
+	span.SetAttributes(addr.attributes()...)
+	span.SetAttributes(attribute.Int("shipping.items.count", len(items)))
+
+	trackingID, err := ShipOrder(ctx, addr, items)
 	if err != nil {
-		span.RecordError(err)
-		http.Error(w, "Failed to calculate quote", http.StatusInternalServerError)
+		span.SetStatus(codes.Error, err.Error())
+		shippingLogger.WarnContext(ctx, "ShipOrder rejected", "error", err)
+		writeShippingJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 		return
 	}
 
-	trackingID := uuid.New().String()
-
-	span.SetAttributes(
-		attribute.String("shipping.tracking.id", trackingID),
-		attribute.Int("shipping.items.count", itemCount),
-		attribute.Float64("app.shipping.cost.total", quote),
-	)
-
-	span.AddEvent("Received Quote", trace.WithAttributes(
-		attribute.Float64("app.shipping.cost.total", quote),
-	))
+	span.SetAttributes(attribute.String("shipping.tracking.id", trackingID))
 
 	shippingLogger.InfoContext(ctx, "Shipping successful",
 		"tracking_id", trackingID,
-		"items", itemCount,
-		"quote", quote,
+		"items", len(items),
+		"country", addr.Country,
 	)
 
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, `{"tracking_id": "%s", "cost": %.2f}`, trackingID, quote)
+	writeShippingJSON(w, http.StatusOK, map[string]interface{}{
+		"tracking_id": trackingID,
+		"items":       len(items),
+	})
 }
 
 func getQuoteHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	span := trace.SpanFromContext(ctx)
 
-	itemCount := rand.Intn(10) + 1
+	addr := addressFromQuery(r.URL.Query())
+	items := itemsFromQuery(r.URL.Query())
+	span.SetAttributes(addr.attributes()...)
+	span.SetAttributes(attribute.Int("app.quote.items.count", len(items)))
 
-	quote, err := createQuoteFromCount(ctx, itemCount)
+	quote, err := GetQuote(ctx, addr, items)
 	if err != nil {
-		span.RecordError(err)
-		http.Error(w, "Failed to calculate quote", http.StatusInternalServerError)
+		span.SetStatus(codes.Error, err.Error())
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrInvalidAddress) || errors.Is(err, ErrNoItems) {
+			status = http.StatusBadRequest
+		}
+		shippingLogger.WarnContext(ctx, "GetQuote failed", "error", err)
+		writeShippingJSON(w, status, map[string]string{"error": err.Error()})
 		return
 	}
 
-	span.SetAttributes(
-		attribute.Int("app.quote.items.count", itemCount),
-		attribute.Float64("app.quote.cost.total", quote),
-	)
+	span.SetAttributes(attribute.Float64("app.quote.cost.total", quote))
+
+	shippingLogger.InfoContext(ctx, "GetQuote", "items", len(items), "quote", quote)
 
-	shippingLogger.InfoContext(ctx, "GetQuote", "items", itemCount, "quote", quote)
+	writeShippingJSON(w, http.StatusOK, map[string]interface{}{
+		"quote": quote,
+		"items": len(items),
+	})
+}
 
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, `{"quote": %.2f, "items": %d}`, quote, itemCount)
+func writeShippingJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
 }
 
-func createQuoteFromCount(ctx context.Context, count int) (float64, error) {
+// createQuote prices the shipment with shippingCost. The Python quote service
+// is still called so the trace crosses languages; if it's down the quote is
+// marked as calculated locally.
+func createQuote(ctx context.Context, addr Address, count int) (float64, error) {
 	start := time.Now()
 
-	ctx, span := shippingTracer.Start(ctx, "createQuoteFromCount",
+	ctx, span := shippingTracer.Start(ctx, "createQuote",
 		trace.WithSpanKind(trace.SpanKindClient))
 	defer span.End()
 
-	shippingLogger.InfoContext(ctx, "CreateQuoteFromCount", "items", count)
+	shippingLogger.InfoContext(ctx, "CreateQuote", "items", count)
 
-	// Record items metric
-	shippingItemsCount.Add(ctx, int64(count))
+	quote := shippingCost(addr, count)
+	span.SetAttributes(
+		attribute.Int("quote.items.count", count),
+		attribute.Float64("quote.base_rate", shippingBaseRate),
+		attribute.Float64("quote.distance_factor", distanceFactor(addr.Country)),
+		attribute.Float64("quote.total", quote),
+	)
 
 	// Call external quote service (Python FastAPI) with OTel trace context propagation
-	client := &http.Client{
-		Timeout:   30 * time.Second,
-		Transport: otelhttp.NewTransport(http.DefaultTransport),
-	}
+	external := true
 	req, err := http.NewRequestWithContext(ctx, "POST", config.QuoteURL+"/quote", nil)
-	if err != nil {
-		span.RecordError(err)
-		// Fallback to local calculation
-		return calculateQuoteLocally(ctx, span, count, start)
+	if err == nil {
+		var resp *http.Response
+		if resp, err = quoteClient.Do(req); err == nil {
+			resp.Body.Close()
+			common.SetSpanStatusFromHTTP(span, resp.StatusCode)
+		}
 	}
-
-	resp, err := client.Do(req)
 	if err != nil {
 		span.RecordError(err)
 		shippingLogger.WarnContext(ctx, "QuoteService unavailable, using fallback", "error", err)
-		return calculateQuoteLocally(ctx, span, count, start)
+		external = false
 	}
-	defer resp.Body.Close()
-
-	quote := 5.99 + (float64(count) * 1.50) + float64(rand.Intn(300))/100.0
-
-	span.SetAttributes(
-		attribute.Int("quote.items.count", count),
-		attribute.Float64("quote.total", quote),
-		attribute.Bool("quote.external_service", true),
-	)
-
-	span.AddEvent("Quote received from service", trace.WithAttributes(
-		attribute.Float64("app.shipping.cost.total", quote),
-	))
-
-	shippingLogger.InfoContext(ctx, "QuoteReceived", "items", count, "quote", quote)
-
-	duration := float64(time.Since(start).Milliseconds())
-	shippingQuoteMetric.Record(ctx, duration)
-
-	return quote, nil
-}
-
-func calculateQuoteLocally(ctx context.Context, span trace.Span, count int, start time.Time) (float64, error) {
-	baseRate := 5.99
-	perItemRate := 1.50
-	quote := baseRate + (float64(count) * perItemRate) + float64(rand.Intn(300))/100.0
-
-	span.SetAttributes(
-		attribute.Int("quote.items.count", count),
-		attribute.Float64("quote.base_rate", baseRate),
-		attribute.Float64("quote.per_item_rate", perItemRate),
-		attribute.Float64("quote.total", quote),
-		attribute.Bool("quote.external_service", false),
-	)
+	span.SetAttributes(attribute.Bool("quote.external_service", external))
 
-	span.AddEvent("Quote calculated locally", trace.WithAttributes(
+	span.AddEvent("Quote calculated", trace.WithAttributes(
 		attribute.Float64("app.shipping.cost.total", quote),
 	))
 
-	shippingLogger.InfoContext(ctx, "QuoteCalculatedLocally", "items", count, "quote", quote)
+	shippingLogger.InfoContext(ctx, "QuoteReceived", "items", count, "quote", quote, "external", external)
 
 	duration := float64(time.Since(start).Milliseconds())
 	shippingQuoteMetric.Record(ctx, duration)
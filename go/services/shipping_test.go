@@ -0,0 +1,72 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"otel-mock/config"
+	"testing"
+
+	lognoop "go.opentelemetry.io/otel/log/noop"
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestShippingCost(t *testing.T) {
+	tests := []struct {
+		name    string
+		country string
+		items   int
+		want    float64
+	}{
+		{"nothing to ship pays the base rate", "US", 0, 5.99},
+		{"domestic single item", "US", 1, 7.49},
+		{"domestic several items", "US", 4, 11.99},
+		{"country names are case and space insensitive", " united states ", 1, 7.49},
+		{"neighbouring country", "CA", 2, 10.49},
+		{"neighbouring country by name", "mexico", 1, 8.24},
+		{"rest of the world", "DE", 3, 17.24},
+		{"unknown country is priced as far away", "", 1, 9.74},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := shippingCost(Address{Country: tt.country}, tt.items); got != tt.want {
+				t.Errorf("shippingCost(%q, %d) = %v, want %v", tt.country, tt.items, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetQuote(t *testing.T) {
+	quote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(quote.Close)
+	setConfig(t, &config.QuoteURL, quote.URL)
+	InitShippingService(context.Background(), ":0", tracenoop.NewTracerProvider(), metricnoop.NewMeterProvider(), lognoop.NewLoggerProvider())
+
+	us := Address{StreetAddress: "1600 Amphitheatre Parkway", City: "Mountain View", State: "CA", Country: "US", ZipCode: "94043"}
+	tests := []struct {
+		name    string
+		addr    Address
+		items   []string
+		want    float64
+		wantErr error
+	}{
+		{"valid order", us, []string{"OLJCESPC7Z", "66VCHSJNUP"}, 8.99, nil},
+		{"empty address", Address{}, []string{"OLJCESPC7Z"}, 0, ErrInvalidAddress},
+		{"missing zip code", Address{Country: "US"}, []string{"OLJCESPC7Z"}, 0, ErrInvalidAddress},
+		{"blank country", Address{Country: "  ", ZipCode: "94043"}, []string{"OLJCESPC7Z"}, 0, ErrInvalidAddress},
+		{"no items", us, nil, 0, ErrNoItems},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := GetQuote(context.Background(), tt.addr, tt.items)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("GetQuote error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("GetQuote = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -39,7 +39,7 @@ function handleCharge(req, res, parentCtx) {
         try {
             const baggage = propagation.getBaggage(trace.setSpan(parentCtx, span));
             if (baggage) {
-                const syntheticEntry = baggage.getEntry('synthetic_request');
+                const syntheticEntry = baggage.getEntry('synthetic');
                 span.setAttribute('app.payment.charged', !(syntheticEntry && syntheticEntry.value === 'true'));
             } else {
                 span.setAttribute('app.payment.charged', true);